@@ -0,0 +1,153 @@
+package z80asm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/scanner"
+)
+
+// Annotate writes a copy of the named source file to w, with a
+// comment at the end of each line that uses labels or consts
+// giving their values, for example "ld hl, table // = 0x8100".
+// When a line uses more than one, they're named: "// a = 0x0001,
+// b = 0x0002". Labels and consts are looked up in the final
+// symbol table, so it is only valid after the assembler has run.
+func (asm *Assembler) Annotate(filename string, w io.Writer) error {
+	f, err := asm.opener(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open source file %q: %v", filename, err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read source file %q: %v", filename, err)
+	}
+	notes, err := asm.annotations(filename, data)
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for i, line := range lines {
+		if ns := notes[i+1]; len(ns) > 0 {
+			text := string(line)
+			end := len(strings.TrimRight(text, "\r\n"))
+			line = []byte(text[:end] + " // " + formatNotes(ns) + text[end:])
+		}
+		if _, err := w.Write(line); err != nil {
+			return fmt.Errorf("failed to write annotated source: %v", err)
+		}
+	}
+	return nil
+}
+
+// definesName lists the directives whose first argument is the
+// name of a const that they define.
+var definesName = map[string]bool{"const": true, "blocksize": true, "tlabel": true}
+
+// An annotation is the value of a label or const used in the source.
+type annotation struct {
+	name string
+	v    int64
+}
+
+// annotations finds the labels and consts used on each line of
+// the source, keyed by line number.
+func (asm *Assembler) annotations(filename string, data []byte) (map[int][]annotation, error) {
+	var s scanner.Scanner
+	s.Init(bytes.NewReader(data))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanChars | scanner.ScanStrings | scanner.ScanRawStrings | scanner.ScanComments | scanner.SkipComments
+	s.Whitespace = (1 << ' ') | (1 << '\t')
+	s.Position.Filename = filename
+	var scanErr error
+	s.Error = func(s *scanner.Scanner, msg string) {
+		// The file has already been assembled, so its strings are
+		// fine, and dspec's \{...} escapes aren't valid Go escapes.
+		if scanErr == nil && msg != "invalid char escape" {
+			scanErr = fmt.Errorf("%s: %s", s.Position, msg)
+		}
+	}
+	notes := map[int][]annotation{}
+	majLabel := ""
+	atStart := true
+	for t := s.Scan(); t != scanner.EOF; t = s.Scan() {
+		start := atStart
+		atStart = t == '\n' || t == ';'
+		if t == '.' && start {
+			// A minor label definition.
+			s.Scan()
+			continue
+		}
+		if t != scanner.Ident {
+			continue
+		}
+		id := s.TokenText()
+		line := s.Position.Line
+		if start {
+			if s.Peek() == ':' {
+				majLabel = id
+				continue
+			}
+			cmd := strings.ToLower(id)
+			if _, ok := asm.commandTable[cmd]; ok {
+				if definesName[cmd] {
+					s.Scan()
+				}
+				continue
+			}
+			// Otherwise it's name equ value.
+			continue
+		}
+		if _, ok := regFromString[id]; ok {
+			continue
+		}
+		if _, ok := ccFromString[id]; ok {
+			continue
+		}
+		n, ok := asm.symbolValue(majLabel, id)
+		if !ok {
+			continue
+		}
+		dup := false
+		for _, a := range notes[line] {
+			dup = dup || a.name == id
+		}
+		if !dup {
+			notes[line] = append(notes[line], annotation{id, n})
+		}
+	}
+	return notes, scanErr
+}
+
+// symbolValue returns the value of the user-defined const or the
+// label with the given name, as it's used in the scope of majLabel.
+func (asm *Assembler) symbolValue(majLabel, id string) (int64, bool) {
+	if _, ok := asm.predefined[id]; !ok && asm.constsDef[id] {
+		return asm.consts[id], true
+	}
+	if _, v, ok := asm.lookupLabel(majLabel, id); ok {
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func formatNotes(ns []annotation) string {
+	hex := func(n int64) string {
+		if n < 0 {
+			return fmt.Sprintf("-0x%04x", -n)
+		}
+		return fmt.Sprintf("0x%04x", n)
+	}
+	if len(ns) == 1 {
+		return "= " + hex(ns[0].v)
+	}
+	var parts []string
+	for _, a := range ns {
+		parts = append(parts, a.name+" = "+hex(a.v))
+	}
+	return strings.Join(parts, ", ")
+}
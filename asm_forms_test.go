@@ -0,0 +1,212 @@
+package z80asm
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A FormCase is a single source line that exercises one
+// (mnemonic, argument variant) entry of the instruction tables.
+type FormCase struct {
+	Cmd    string
+	Args   arg
+	Source string
+	Opcode []byte // the table entry for the form
+}
+
+// formArgSource returns source text for a single argument,
+// with concrete values substituted for the placeholders.
+func formArgSource(a arg) string {
+	switch a {
+	case reladdr8:
+		return "target"
+	case const16, const16be, addr16:
+		return "0x1234"
+	case ind16:
+		return "(0x1234)"
+	case indIXplus:
+		return "(ix+0x12)"
+	case indIYplus:
+		return "(iy+0x12)"
+	case const8, constS8:
+		return "0x12"
+	case port8:
+		return "(0x12)"
+	}
+	return a.String()
+}
+
+// formArgSize returns the number of operand bytes written for
+// the given argument variant.
+func formArgSize(a arg) int {
+	if a >= 1024 {
+		return formArgSize(a/1024) + formArgSize(a%1024)
+	}
+	switch a {
+	case indIXplus, indIYplus:
+		return 1
+	case const8, const16, const16be, constS8, addr16, reladdr8, port8, ind16:
+		_, _, size := argRange(a)
+		return int(size)
+	}
+	return 0
+}
+
+// GenerateFormTests returns a FormCase for every instruction form
+// the assembler supports with the given core.
+func GenerateFormTests(core Z80Core) []FormCase {
+	asm, err := NewAssembler(UseNextCore(core))
+	if err != nil {
+		panic(err)
+	}
+	var r []FormCase
+	for cmd, ia := range asm.commandTable {
+		ca, ok := ia.(commandAssembler)
+		if !ok {
+			continue
+		}
+		for a, bs := range ca.args {
+			var parts []string
+			switch argLen(a) {
+			case 1:
+				parts = append(parts, formArgSource(a))
+			case 2:
+				parts = append(parts, formArgSource(a/1024), formArgSource(a%1024))
+			}
+			src := cmd
+			if len(parts) > 0 {
+				src += " " + strings.Join(parts, ", ")
+			}
+			r = append(r, FormCase{
+				Cmd:    cmd,
+				Args:   a,
+				Source: ".target " + src,
+				Opcode: bs,
+			})
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Source < r[j].Source })
+	return r
+}
+
+func TestAllForms(t *testing.T) {
+	for core := Z80Core(0); core < 3; core++ {
+		for _, fc := range GenerateFormTests(core) {
+			asm, err := NewAssembler(UseNextCore(core))
+			if err != nil {
+				t.Fatalf("failed to create assembler: %v", err)
+			}
+			asm.opener = ffs{"a.asm": fc.Source}.open
+			if err := asm.AssembleFile("a.asm"); err != nil {
+				t.Errorf("core %d: %q (%s %s) failed to assemble: %v", core, fc.Source, fc.Cmd, fc.Args, err)
+				continue
+			}
+			n := len(fc.Opcode)
+			if n > 2 {
+				n = 2
+			}
+			want := append(append(append([]byte{}, fc.Opcode[:n]...), make([]byte, formArgSize(fc.Args))...), fc.Opcode[n:]...)
+			got := append([]byte{}, asm.RAM()[0x8000:0x8000+len(want)]...)
+			// Blank out the operand bytes, which aren't part of the table entry.
+			for i := n; i < n+formArgSize(fc.Args); i++ {
+				got[i] = 0
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("core %d: %q assembled to %s, want %s", core, fc.Source, toHex(asm.RAM()[0x8000:0x8000+len(want)]), toHex(want))
+			}
+		}
+	}
+}
+
+// TestIndexedCommandsUseIndexRegister checks that every
+// dd- or fd-prefixed form generated from the hl forms
+// actually involves the index register.
+func TestIndexedCommandsUseIndexRegister(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cmds   map[string]args
+		prefix byte
+		uses   map[arg]bool
+	}{
+		{"ix", ixCommands, 0xdd, map[arg]bool{regIX: true, indIX: true, indIXplus: true, regIXH: true, regIXL: true}},
+		{"iy", iyCommands, 0xfd, map[arg]bool{regIY: true, indIY: true, indIYplus: true, regIYH: true, regIYL: true}},
+	} {
+		for cmd, variants := range tc.cmds {
+			for a, bs := range variants {
+				if !tc.uses[a/1024] && !tc.uses[a%1024] {
+					t.Errorf("%s: %s %s does not use %s", tc.name, cmd, a, tc.name)
+				}
+				if bs[0] != tc.prefix {
+					t.Errorf("%s: %s %s = %s, want prefix %02x", tc.name, cmd, a, toHex(bs), tc.prefix)
+				}
+				if len(bs) > 1 && bs[1] == 0xed {
+					t.Errorf("%s: %s %s = %s, prefix is ignored before ed", tc.name, cmd, a, toHex(bs))
+				}
+			}
+		}
+	}
+}
+
+// allFormsSource returns source that uses every instruction form
+// twice, with a major label before each instruction.
+func allFormsSource(core Z80Core) string {
+	var lines []string
+	for rep := 0; rep < 2; rep++ {
+		for i, fc := range GenerateFormTests(core) {
+			lines = append(lines, fmt.Sprintf("f%d_%d: %s", rep, i, fc.Source))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func assembleForms(tb testing.TB, src string, opts ...AssemblerOpt) *Assembler {
+	asm, err := NewAssembler(append([]AssemblerOpt{UseNextCore(Z80CoreNext2)}, opts...)...)
+	if err != nil {
+		tb.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = ffs{"a.asm": src}.open
+	if err := asm.AssembleFile("a.asm"); err != nil {
+		tb.Fatalf("failed to assemble: %v", err)
+	}
+	return asm
+}
+
+func TestComputeLabelsFirst(t *testing.T) {
+	src := allFormsSource(Z80CoreNext2)
+	want := assembleForms(t, src)
+	got := assembleForms(t, src, WithComputeLabelsFirst())
+	if !reflect.DeepEqual(got.l, want.l) {
+		for k, v := range want.l {
+			if gv := got.l[k]; gv != v {
+				t.Errorf("label %s = %04x, want %04x", k, gv, v)
+			}
+		}
+	}
+	if !bytes.Equal(got.RAM(), want.RAM()) {
+		t.Errorf("assembled code differs with WithComputeLabelsFirst")
+	}
+	if len(got.lengths) == 0 {
+		t.Errorf("no instruction lengths were cached")
+	}
+}
+
+func BenchmarkAssemble(b *testing.B) {
+	src := allFormsSource(Z80CoreNext2)
+	for _, bc := range []struct {
+		name string
+		opts []AssemblerOpt
+	}{
+		{"default", nil},
+		{"ComputeLabelsFirst", []AssemblerOpt{WithComputeLabelsFirst()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				assembleForms(b, src, bc.opts...)
+			}
+		})
+	}
+}
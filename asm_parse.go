@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"text/scanner"
 )
 
@@ -35,6 +36,23 @@ func getValidFixedArgs(m map[arg]int64) map[int64]bool {
 	return r
 }
 
+// parseIntLiteral parses an integer literal, which may have a 0x,
+// 0b or 0o prefix, and may use underscores to separate digits.
+func parseIntLiteral(s string) (int64, error) {
+	digits := strings.ToLower(s)
+	for _, prefix := range []string{"0x", "0b", "0o"} {
+		if strings.HasPrefix(digits, prefix) {
+			// An underscore may follow the base prefix.
+			digits = strings.TrimPrefix(digits[len(prefix):], "_")
+			break
+		}
+	}
+	if strings.HasPrefix(digits, "_") || strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+		return 0, fmt.Errorf("'_' must separate successive digits")
+	}
+	return strconv.ParseInt(strings.Replace(s, "_", "", -1), 0, 64)
+}
+
 func argRange(a arg) (min, max, size int64) {
 	switch a {
 	case const8:
@@ -43,6 +61,10 @@ func argRange(a arg) (min, max, size int64) {
 		return -32768, 65535, 2
 	case const16be:
 		return -32768, 65535, 2
+	case const24:
+		return 0, 0xffffff, 3
+	case constU8:
+		return 0, 255, 1
 	case constS8:
 		return -128, 127, 1
 	case addr16:
@@ -69,8 +91,9 @@ func writesBigEndian(a arg) bool {
 func serializeIntArg(asm *Assembler, i int64, a arg) ([]byte, bool, error) {
 	min, max, size := argRange(a)
 	if i < min || i > max {
-		return nil, false, asm.scanErrorf("%d is not in the range %d...%d", i, min, max)
+		return nil, false, asm.scanErrorf("%d (%#x) is not in the range %d...%d (%#x...%#x)", i, i, min, max, min, max)
 	}
+	// Negative values are written in two's complement.
 	ui := uint16(i)
 	switch size {
 	case 1:
@@ -81,6 +104,8 @@ func serializeIntArg(asm *Assembler, i int64, a arg) ([]byte, bool, error) {
 		} else {
 			return []byte{byte(ui % 256), byte(ui / 256)}, true, nil
 		}
+	case 3:
+		return []byte{byte(i), byte(i >> 8), byte(i >> 16)}, true, nil
 	default:
 		log.Fatalf("weird size %d", size)
 	}
@@ -125,21 +150,63 @@ var (
 		'>':       6,
 		tokNotEq:  6,
 		tokAndAnd: 4,
-		tokOrOr:   2,
+		tokOrOr:   3,
+		'?':       precTernary,
 	}
 )
 
+// precDup is the precedence of dup, which binds less
+// tightly than any other operator.
+const precDup = 1
+
+// precTernary is the precedence of cond ? e1 : e2, which binds
+// less tightly than any other operator except dup.
+const precTernary = 2
+
+func tokPrecedence(tok token) int {
+	if tok.t == scanner.Ident && tok.s == "dup" {
+		return precDup
+	}
+	return opPrecedence[tok.t]
+}
+
 func (a *Assembler) continueExpr(pri int, ex expr, tok token, err error) (expr, token, error) {
-	for err == nil && opPrecedence[tok.t] > 0 && opPrecedence[tok.t] > pri {
-		ex2, tok2, err2 := a.parseExpression(opPrecedence[tok.t], false)
+	for err == nil && tokPrecedence(tok) > 0 && tokPrecedence(tok) > pri {
+		if tok.t == '?' {
+			ex, tok, err = a.continueTernary(ex)
+			continue
+		}
+		ex2, tok2, err2 := a.parseExpression(tokPrecedence(tok), false)
 		if err2 != nil {
 			return nil, token{}, err2
 		}
-		ex, tok, err = exprBinaryOp{tok.t, ex, ex2}, tok2, err2
+		if tok.t == scanner.Ident {
+			ex, tok, err = exprDup{ex, ex2}, tok2, err2
+		} else {
+			ex, tok, err = exprBinaryOp{tok.t, ex, ex2}, tok2, err2
+		}
 	}
 	return ex, tok, err
 }
 
+// continueTernary parses the rest of cond ? e1 : e2, after the ?.
+// The ternary operator is right associative, so e2 may itself be
+// a ternary expression.
+func (a *Assembler) continueTernary(cond expr) (expr, token, error) {
+	e1, tok, err := a.parseExpression(precDup, false)
+	if err != nil {
+		return nil, token{}, err
+	}
+	if tok.t != ':' {
+		return nil, token{}, a.scanErrorf("found: %s, expected : in %s ? %s : ...", tok, cond, e1)
+	}
+	e2, tok, err := a.parseExpression(precTernary-1, false)
+	if err != nil {
+		return nil, token{}, err
+	}
+	return exprTernary{cond, e1, e2}, tok, nil
+}
+
 // parseExpression parses an expression from the scanner.
 // After parsing the expression, the scanner is advanced
 // to the token after the expression.
@@ -150,7 +217,15 @@ func (a *Assembler) continueExpr(pri int, ex expr, tok token, err error) (expr,
 // 3             ==  !=  <  <=  >  >=
 // 2             &&
 // 1             ||
+// 0             ?:
 func (a *Assembler) parseExpression(pri int, emptyOK bool) (expr, token, error) {
+	// Deeply nested expressions would otherwise overflow the stack
+	// when they're parsed or evaluated.
+	a.exprDepth++
+	defer func() { a.exprDepth-- }()
+	if a.exprDepth > a.maxExprDepth {
+		return nil, token{}, a.scanErrorf("expression nested more than %d deep", a.maxExprDepth)
+	}
 	for {
 		tok, err := a.nextToken()
 		if err != nil {
@@ -162,7 +237,7 @@ func (a *Assembler) parseExpression(pri int, emptyOK bool) (expr, token, error)
 				return nil, token{}, a.scanErrorf("unexpected %s", tok)
 			}
 			return nil, tok, nil
-		case '-', '^', '!':
+		case '-', '+', '^', '!':
 			op := tok.t
 			x, tok, err := a.parseExpression(precUnary, false)
 			return a.continueExpr(pri, exprUnaryOp{op, x}, tok, err)
@@ -177,8 +252,11 @@ func (a *Assembler) parseExpression(pri int, emptyOK bool) (expr, token, error)
 			ex = exprBracket{ex}
 			nt, err := a.nextToken()
 			return a.continueExpr(0, ex, nt, err)
+		case '$':
+			nt, err := a.nextToken()
+			return a.continueExpr(pri, exprPC{}, nt, err)
 		case scanner.Int:
-			i, err := strconv.ParseInt(tok.s, 0, 64)
+			i, err := parseIntLiteral(tok.s)
 			if err != nil {
 				return nil, token{}, a.scanErrorf("bad number %q: %v", tok, err)
 			}
@@ -199,10 +277,33 @@ func (a *Assembler) parseExpression(pri int, emptyOK bool) (expr, token, error)
 			nt, err := a.nextToken()
 			return exprChar{r}, nt, err
 		case scanner.Ident:
+			id := tok.s
+			// af' is the only identifier containing a quote, which
+			// the scanner would otherwise treat as the start of a char.
+			if id == "af" && a.scan().Peek() == '\'' {
+				a.scan().Next()
+				id += "'"
+			}
+			if _, ok := builtinFuncs[id]; ok && a.peekNonSpace() == '(' {
+				ex, err := a.parseCall(id)
+				if err != nil {
+					return nil, token{}, err
+				}
+				nt, err := a.nextToken()
+				return a.continueExpr(pri, ex, nt, err)
+			}
+			if id == "defined" && a.peekNonSpace() == '(' {
+				ex, err := a.parseDefined()
+				if err != nil {
+					return nil, token{}, err
+				}
+				nt, err := a.nextToken()
+				return a.continueExpr(pri, ex, nt, err)
+			}
 			expr := exprIdent{
-				id: tok.s,
-				r:  regFromString[tok.s],
-				cc: ccFromString[tok.s],
+				id: id,
+				r:  regFromString[id],
+				cc: ccFromString[id],
 			}
 			nt, err := a.nextToken()
 			return a.continueExpr(pri, expr, nt, err)
@@ -212,21 +313,80 @@ func (a *Assembler) parseExpression(pri int, emptyOK bool) (expr, token, error)
 	}
 }
 
+// peekNonSpace returns the next character, skipping the
+// spaces and tabs before it, so that high (x) is a call
+// just as high(x) is.
+func (a *Assembler) peekNonSpace() rune {
+	s := a.scan()
+	for s.Peek() == ' ' || s.Peek() == '\t' {
+		s.Next()
+	}
+	return s.Peek()
+}
+
+// parseCall parses the rest of a call of the builtin
+// function fn, such as high(label), after the name.
+func (a *Assembler) parseCall(fn string) (expr, error) {
+	if _, err := a.nextToken(); err != nil { // (
+		return nil, err
+	}
+	ex, tok, err := a.parseExpression(0, false)
+	if err != nil {
+		return nil, err
+	}
+	if tok.t != ')' {
+		return nil, a.scanErrorf("found: %s, expected ) after %s(%s", tok, fn, ex)
+	}
+	return exprCall{fn, ex}, nil
+}
+
+// parseDefined parses the rest of defined(name), after defined.
+// The name isn't parsed as an expression, since it's not evaluated.
+func (a *Assembler) parseDefined() (expr, error) {
+	var toks [3]token
+	for i := range toks {
+		tok, err := a.nextToken()
+		if err != nil {
+			return nil, err
+		}
+		toks[i] = tok
+	}
+	if toks[0].t != '(' || toks[1].t != scanner.Ident || toks[2].t != ')' {
+		return nil, a.scanErrorf("expected defined(<name>), found defined%s%s%s", toks[0], toks[1], toks[2])
+	}
+	return exprDefined{toks[1].s}, nil
+}
+
 func (a *Assembler) parseArgs(trailingOK bool) ([]expr, error) {
 	return a.parseSepArgs(',', trailingOK)
 }
 
 func (a *Assembler) parseSepArgs(sep rune, trailingOK bool) ([]expr, error) {
 	var r []expr
+	err := a.forEachArg(sep, trailingOK, func(e expr) error {
+		r = append(r, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// forEachArg parses the arguments up to the end of the statement,
+// calling f with each one as soon as it's parsed.
+func (a *Assembler) forEachArg(sep rune, trailingOK bool, f func(expr) error) error {
 	comma := false
 	for {
 		e, tok, err := a.parseExpression(0, true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if e != nil {
 			comma = false
-			r = append(r, e)
+			if err := f(e); err != nil {
+				return err
+			}
 		}
 		if tok.t == sep {
 			comma = true
@@ -235,11 +395,11 @@ func (a *Assembler) parseSepArgs(sep rune, trailingOK bool) ([]expr, error) {
 		switch tok.t {
 		case ';', '\n', scanner.EOF:
 			if comma && !trailingOK {
-				return nil, a.scanErrorf("unexpected trailing %c", sep)
+				return a.scanErrorf("unexpected trailing %c", sep)
 			}
-			return r, nil
+			return nil
 		default:
-			return nil, a.scanErrorf("unexpected %s", tok)
+			return a.scanErrorf("unexpected %s after instruction", tok)
 		}
 	}
 }
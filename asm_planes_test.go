@@ -53,7 +53,7 @@ var (
 		"in e, (c)", "out (c), e", "adc hl, de", "ld de, (**)", "?neg", "?retn", "im 2", "ld a, r",
 		"in h, (c)", "out (c), h", "sbc hl, hl", "?ld (**), hl", "?neg", "?retn", "?im 0", "rrd",
 		"in l, (c)", "out (c), l", "adc hl, hl", "?ld hl, (**)", "?neg", "?retn", "?im 0/1", "rld",
-		"?in (c)", "?out (c), 0", "sbc hl, sp", "ld (**), sp", "?neg", "?retn", "?im 1", "",
+		"in (c)", "out (c), 0", "sbc hl, sp", "ld (**), sp", "?neg", "?retn", "?im 1", "",
 		"in a, (c)", "out (c), a", "adc hl, sp", "ld sp, (**)", "?neg", "?retn", "?im 2", "",
 		"", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "",
 		"", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "",
@@ -85,7 +85,7 @@ var (
 		"in h, (c)", "out (c), h", "sbc hl, hl", "?ld (**), hl", "?neg", "?retn", "?im 0", "rrd",
 		"in l, (c)", "out (c), l", "adc hl, hl", "?ld hl, (**)", "?neg", "?retn", "?im 0/1", "rld",
 
-		"?in (c)", "?out (c), 0", "sbc hl, sp", "ld (**), sp", "?neg", "?retn", "?im 1", "",
+		"in (c)", "out (c), 0", "sbc hl, sp", "ld (**), sp", "?neg", "?retn", "?im 1", "",
 		"in a, (c)", "out (c), a", "adc hl, sp", "ld sp, (**)", "?neg", "?retn", "?im 2", "",
 
 		"", "", "", "", "", "", "", "",
@@ -123,7 +123,7 @@ var (
 		"in h, (c)", "out (c), h", "sbc hl, hl", "?ld (**), hl", "?neg", "?retn", "?im 0", "rrd",
 		"in l, (c)", "out (c), l", "adc hl, hl", "?ld hl, (**)", "?neg", "?retn", "?im 0/1", "rld",
 
-		"?in (c)", "?out (c), 0", "sbc hl, sp", "ld (**), sp", "?neg", "?retn", "?im 1", "",
+		"in (c)", "out (c), 0", "sbc hl, sp", "ld (**), sp", "?neg", "?retn", "?im 1", "",
 		"in a, (c)", "out (c), a", "adc hl, sp", "ld sp, (**)", "?neg", "?retn", "?im 2", "",
 
 		"", "", "", "", "", "", "", "",
@@ -146,7 +146,7 @@ var (
 		"rr b", "rr c", "rr d", "rr e", "rr h", "rr l", "rr (hl)", "rr a",
 		"sla b", "sla c", "sla d", "sla e", "sla h", "sla l", "sla (hl)", "sla a",
 		"sra b", "sra c", "sra d", "sra e", "sra h", "sra l", "sra (hl)", "sra a",
-		"?sll b", "?sll c", "?sll d", "?sll e", "?sll h", "?sll l", "?sll (hl)", "?sll a",
+		"sll b", "sll c", "sll d", "sll e", "sll h", "sll l", "sll (hl)", "sll a",
 		"srl b", "srl c", "srl d", "srl e", "srl h", "srl l", "srl (hl)", "srl a",
 		"bit 0, b", "bit 0, c", "bit 0, d", "bit 0, e", "bit 0, h", "bit 0, l", "bit 0, (hl)", "bit 0, a",
 		"bit 1, b", "bit 1, c", "bit 1, d", "bit 1, e", "bit 1, h", "bit 1, l", "bit 1, (hl)", "bit 1, a",
@@ -177,16 +177,16 @@ var (
 	ixPlaneTable = []string{
 		"", "", "", "", "", "", "", "", "", "add ix, bc", "", "", "", "", "", "",
 		"", "", "", "", "", "", "", "", "", "add ix, de", "", "", "", "", "", "",
-		"", "ld ix, **", "ld (**), ix", "inc ix", "?inc ixh", "?dec ixh", "?ld ixh, *", "", "", "add ix, ix", "ld ix, (**)", "dec ix", "?inc ixl", "?dec ixl", "?ld ixl, *", "",
+		"", "ld ix, **", "ld (**), ix", "inc ix", "inc ixh", "dec ixh", "ld ixh, *", "", "", "add ix, ix", "ld ix, (**)", "dec ix", "inc ixl", "dec ixl", "ld ixl, *", "",
 		"", "", "", "", "inc (ix+*)", "dec (ix+*)", "ld (ix+*), *", "", "", "add ix, sp", "", "", "", "", "", "",
-		"", "", "", "", "?ld b, ixh", "?ld b, ixl", "ld b, (ix+*)", "", "", "", "", "", "?ld c, ixh", "?ld c, ixl", "ld c, (ix+*)", "",
-		"", "", "", "", "?ld d, ixh", "?ld d, ixl", "ld d, (ix+*)", "", "", "", "", "", "?ld e, ixh", "?ld e, ixl", "ld e, (ix+*)", "",
-		"?ld ixh, b", "?ld ixh, c", "?ld ixh, d", "?ld ixh, e", "?ld ixh, ixh", "?ld ixh, ixl", "ld h, (ix+*)", "?ld ixh, a", "?ld ixl, b", "?ld ixl, c", "?ld ixl, d", "?ld ixl, e", "?ld ixl, ixh", "?ld ixl, ixl", "ld l, (ix+*)", "?ld ixl, a",
-		"ld (ix+*), b", "ld (ix+*), c", "ld (ix+*), d", "ld (ix+*), e", "ld (ix+*), h", "ld (ix+*), l", "", "ld (ix+*), a", "", "", "", "", "?ld a, ixh", "?ld a, ixl", "ld a, (ix+*)", "",
-		"", "", "", "", "?add a, ixh", "?add a, ixl", "add a, (ix+*)", "", "", "", "", "", "?adc a, ixh", "?adc a, ixl", "adc a, (ix+*)", "",
-		"", "", "", "", "?sub ixh", "?sub ixl", "sub (ix+*)", "", "", "", "", "", "?sbc a, ixh", "?sbc a, ixl", "sbc a, (ix+*)", "",
-		"", "", "", "", "?and ixh", "?and ixl", "and (ix+*)", "", "", "", "", "", "?xor ixh", "?xor ixl", "xor (ix+*)", "",
-		"", "", "", "", "?or ixh", "?or ixl", "or (ix+*)", "", "", "", "", "", "?cp ixh", "?cp ixl", "cp (ix+*)", "",
+		"", "", "", "", "ld b, ixh", "ld b, ixl", "ld b, (ix+*)", "", "", "", "", "", "ld c, ixh", "ld c, ixl", "ld c, (ix+*)", "",
+		"", "", "", "", "ld d, ixh", "ld d, ixl", "ld d, (ix+*)", "", "", "", "", "", "ld e, ixh", "ld e, ixl", "ld e, (ix+*)", "",
+		"ld ixh, b", "ld ixh, c", "ld ixh, d", "ld ixh, e", "ld ixh, ixh", "ld ixh, ixl", "ld h, (ix+*)", "ld ixh, a", "ld ixl, b", "ld ixl, c", "ld ixl, d", "ld ixl, e", "ld ixl, ixh", "ld ixl, ixl", "ld l, (ix+*)", "ld ixl, a",
+		"ld (ix+*), b", "ld (ix+*), c", "ld (ix+*), d", "ld (ix+*), e", "ld (ix+*), h", "ld (ix+*), l", "", "ld (ix+*), a", "", "", "", "", "ld a, ixh", "ld a, ixl", "ld a, (ix+*)", "",
+		"", "", "", "", "add a, ixh", "add a, ixl", "add a, (ix+*)", "", "", "", "", "", "adc a, ixh", "adc a, ixl", "adc a, (ix+*)", "",
+		"", "", "", "", "sub ixh", "sub ixl", "sub (ix+*)", "", "", "", "", "", "sbc a, ixh", "sbc a, ixl", "sbc a, (ix+*)", "",
+		"", "", "", "", "and ixh", "and ixl", "and (ix+*)", "", "", "", "", "", "xor ixh", "xor ixl", "xor (ix+*)", "",
+		"", "", "", "", "or ixh", "or ixl", "or (ix+*)", "", "", "", "", "", "cp ixh", "cp ixl", "cp (ix+*)", "",
 		"", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "",
 		"", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "",
 		"", "pop ix", "", "ex (sp), ix", "", "push ix", "", "", "", "jp (ix)", "", "", "", "", "", "",
@@ -195,16 +195,16 @@ var (
 	iyPlaneTable = []string{
 		"", "", "", "", "", "", "", "", "", "add iy, bc", "", "", "", "", "", "",
 		"", "", "", "", "", "", "", "", "", "add iy, de", "", "", "", "", "", "",
-		"", "ld iy, **", "ld (**), iy", "inc iy", "?inc iyh", "?dec iyh", "?ld iyh, *", "", "", "add iy, iy", "ld iy, (**)", "dec iy", "?inc iyl", "?dec iyl", "?ld iyl, *", "",
+		"", "ld iy, **", "ld (**), iy", "inc iy", "inc iyh", "dec iyh", "ld iyh, *", "", "", "add iy, iy", "ld iy, (**)", "dec iy", "inc iyl", "dec iyl", "ld iyl, *", "",
 		"", "", "", "", "inc (iy+*)", "dec (iy+*)", "ld (iy+*), *", "", "", "add iy, sp", "", "", "", "", "", "",
-		"", "", "", "", "?ld b, iyh", "?ld b, iyl", "ld b, (iy+*)", "", "", "", "", "", "?ld c, iyh", "?ld c, iyl", "ld c, (iy+*)", "",
-		"", "", "", "", "?ld d, iyh", "?ld d, iyl", "ld d, (iy+*)", "", "", "", "", "", "?ld e, iyh", "?ld e, iyl", "ld e, (iy+*)", "",
-		"?ld iyh, b", "?ld iyh, c", "?ld iyh, d", "?ld iyh, e", "?ld iyh, iyh", "?ld iyh, iyl", "ld h, (iy+*)", "?ld iyh, a", "?ld iyl, b", "?ld iyl, c", "?ld iyl, d", "?ld iyl, e", "?ld iyl, iyh", "?ld iyl, iyl", "ld l, (iy+*)", "?ld iyl, a",
-		"ld (iy+*), b", "ld (iy+*), c", "ld (iy+*), d", "ld (iy+*), e", "ld (iy+*), h", "ld (iy+*), l", "", "ld (iy+*), a", "", "", "", "", "?ld a, iyh", "?ld a, iyl", "ld a, (iy+*)", "",
-		"", "", "", "", "?add a, iyh", "?add a, iyl", "add a, (iy+*)", "", "", "", "", "", "?adc a, iyh", "?adc a, iyl", "adc a, (iy+*)", "",
-		"", "", "", "", "?sub iyh", "?sub iyl", "sub (iy+*)", "", "", "", "", "", "?sbc a, iyh", "?sbc a, iyl", "sbc a, (iy+*)", "",
-		"", "", "", "", "?and iyh", "?and iyl", "and (iy+*)", "", "", "", "", "", "?xor iyh", "?xor iyl", "xor (iy+*)", "",
-		"", "", "", "", "?or iyh", "?or iyl", "or (iy+*)", "", "", "", "", "", "?cp iyh", "?cp iyl", "cp (iy+*)", "",
+		"", "", "", "", "ld b, iyh", "ld b, iyl", "ld b, (iy+*)", "", "", "", "", "", "ld c, iyh", "ld c, iyl", "ld c, (iy+*)", "",
+		"", "", "", "", "ld d, iyh", "ld d, iyl", "ld d, (iy+*)", "", "", "", "", "", "ld e, iyh", "ld e, iyl", "ld e, (iy+*)", "",
+		"ld iyh, b", "ld iyh, c", "ld iyh, d", "ld iyh, e", "ld iyh, iyh", "ld iyh, iyl", "ld h, (iy+*)", "ld iyh, a", "ld iyl, b", "ld iyl, c", "ld iyl, d", "ld iyl, e", "ld iyl, iyh", "ld iyl, iyl", "ld l, (iy+*)", "ld iyl, a",
+		"ld (iy+*), b", "ld (iy+*), c", "ld (iy+*), d", "ld (iy+*), e", "ld (iy+*), h", "ld (iy+*), l", "", "ld (iy+*), a", "", "", "", "", "ld a, iyh", "ld a, iyl", "ld a, (iy+*)", "",
+		"", "", "", "", "add a, iyh", "add a, iyl", "add a, (iy+*)", "", "", "", "", "", "adc a, iyh", "adc a, iyl", "adc a, (iy+*)", "",
+		"", "", "", "", "sub iyh", "sub iyl", "sub (iy+*)", "", "", "", "", "", "sbc a, iyh", "sbc a, iyl", "sbc a, (iy+*)", "",
+		"", "", "", "", "and iyh", "and iyl", "and (iy+*)", "", "", "", "", "", "xor iyh", "xor iyl", "xor (iy+*)", "",
+		"", "", "", "", "or iyh", "or iyl", "or (iy+*)", "", "", "", "", "", "cp iyh", "cp iyl", "cp (iy+*)", "",
 		"", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "",
 		"", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "",
 		"", "pop iy", "", "ex (sp), iy", "", "push iy", "", "", "", "jp (iy)", "", "", "", "", "", "",
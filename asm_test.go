@@ -1,6 +1,7 @@
 package z80asm
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -123,12 +124,31 @@ func TestAsmSnippets(t *testing.T) {
 			},
 			want: b(0x21, 0x00, 0x80, 0x21, 0x03, 0x80),
 		},
+		{
+			// Names of directives can still be labels.
+			fs: ffs{
+				"a.asm": "data: db 1; code: nop; table : dw data, code, table",
+			},
+			want: b(1, 0, 0x00, 0x80, 0x01, 0x80, 0x02, 0x80),
+		},
+		{
+			fs: ffs{
+				"a.asm": "if 0; if: nop; endif: nop; endif; db 1",
+			},
+			want: b(1),
+		},
 		{
 			fs: ffs{
 				"a.asm": ".label push bc; jr label",
 			},
 			want: b(0xc5, 0x18, 0xfd),
 		},
+		{
+			fs: ffs{
+				"a.asm": "ex af, af'; ex de, hl",
+			},
+			want: b(0x08, 0xeb),
+		},
 		{
 			fs: ffs{
 				"a.asm": "rst 0x20",
@@ -147,6 +167,12 @@ func TestAsmSnippets(t *testing.T) {
 			},
 			want: b(1, 0, 2, 0, 0, 1),
 		},
+		{
+			fs: ffs{
+				"a.asm": `dt 0x123456, 0xffffff, label; .label`,
+			},
+			want: b(0x56, 0x34, 0x12, 0xff, 0xff, 0xff, 0x09, 0x80, 0x00),
+		},
 		{
 			fs: ffs{
 				"a.asm": `ds "hello\n"`,
@@ -276,6 +302,297 @@ func TestAsmSnippets(t *testing.T) {
 			},
 			want: []byte{0xed, 0x28, 0xed, 0x29, 0xed, 0x2a, 0xed, 0x2b, 0xed, 0x2c, 0xed, 0x98},
 		},
+		{
+			fs: ffs{
+				"a.asm": "f: ret; assert_range f, 0x8000, 0xbfff; assert_range g, 0x8000, 0x8001; g: ret",
+			},
+			want: b(0xc9, 0xc9),
+		},
+		{
+			fs: ffs{
+				"a.asm": "msg: ds \"hello\"; sizeof msg; table: dw 1, 2, 3; blocksize n, table; db msg_size, n",
+			},
+			want: b('h', 'e', 'l', 'l', 'o', 1, 0, 2, 0, 3, 0, 5, 6),
+		},
+		{
+			fs: ffs{
+				"a.asm": "db! 200, 0, 255; DB! 1",
+			},
+			want: b(200, 0, 255, 1),
+		},
+		{
+			fs: ffs{
+				"a.asm": "ld hl, -1; ld de, -32768; ld bc, -2",
+			},
+			want: b(0x21, 0xff, 0xff, 0x11, 0x00, 0x80, 0x01, 0xfe, 0xff),
+		},
+		{
+			fs: ffs{
+				"a.asm": "db 0b1010_1010; dw 0x12_34, 1_000, 0x_ff",
+			},
+			want: b(0xaa, 0x34, 0x12, 0xe8, 0x03, 0xff, 0x00),
+		},
+		{
+			fs: ffs{
+				"a.asm": "db 4 dup 0, 1; dw 3 dup 0x1234; db 1+1 dup 'a'",
+			},
+			want: b(0, 0, 0, 0, 1, 0x34, 0x12, 0x34, 0x12, 0x34, 0x12, 'a', 'a'),
+		},
+		{
+			fs: ffs{
+				"a.asm": "db 1; align 4; db 2; align 1; align 2, 0xff; tab: align 8; dw tab; align 4, -1",
+			},
+			want: b(1, 0, 0, 0, 2, 0xff, 0, 0, 0x06, 0x80, 0xff, 0xff),
+		},
+		{
+			fs: ffs{
+				"a.asm": `dspec "\{AT 1,2}hi\{INK 2}\r", "\\{\x41\{0x90}\{tab 5}\{ENTER}"; dspec ` + "`a\\{bright 1}`",
+			},
+			want: b(0x16, 1, 2, 'h', 'i', 0x10, 2, 0x0d, '\\', '{', 'A', 0x90, 0x17, 5, 0, 0x0d, 'a', 0x13, 1),
+		},
+		{
+			fs: ffs{
+				"a.asm": `if 0; dspec "\{INK 1}x"; endif` + "\n" +
+					`macro ink n; dspec "\{INK 2}A"; db n; endm; ink 7` + "\n" +
+					`rept 2; dspec "\{PAPER 3}"; endr`,
+			},
+			want: b(0x10, 2, 'A', 7, 0x11, 3, 0x11, 3),
+		},
+		{
+			fs: ffs{
+				"a.asm": `ds 3; ds 2, 0xff; ds 0; buf: ds 100; after: dw buf, after; ds "ab"`,
+			},
+			want: append(append(b(0, 0, 0, 0xff, 0xff), make([]byte, 100)...), 0x05, 0x80, 0x69, 0x80, 'a', 'b'),
+		},
+		{
+			fs: ffs{
+				"a.asm": "ds stop - start; x: dw x; start: nop; nop; stop:",
+			},
+			want: b(0, 0, 0x02, 0x80, 0, 0),
+		},
+		{
+			fs: ffs{
+				"a.asm": "nop; fill_to 0x8004, 0xff; nop; fill_to 0x8006; fill_to 0x8006; x: fill_to x + 2, 0x55; dw x",
+			},
+			want: b(0, 0xff, 0xff, 0xff, 0, 0, 0x55, 0x55, 0x06, 0x80),
+		},
+		{
+			fs: ffs{
+				"a.asm": "ds x1 - x0, 9\nx0: ds y1 - y0\nx1:\ny0: db 1, 2, 3; y1:",
+			},
+			want: b(9, 9, 9, 0, 0, 0, 1, 2, 3),
+		},
+		{
+			fs: ffs{
+				"a.asm": "fill_to 0x8000 + x1 - x0, 9\nx0: fill_to x0 + y1 - y0\nx1:\ny0: db 1, 2, 3; y1:",
+			},
+			want: b(9, 9, 9, 0, 0, 0, 1, 2, 3),
+		},
+		{
+			fs: ffs{
+				"a.asm": "if 1; db 1; else; db 2; endif; if 0; db 3; x: db 4; .y db 5; else; db 6; endif; x: db 7",
+			},
+			want: b(1, 6, 7),
+		},
+		{
+			fs: ffs{
+				"a.asm": "if 0\n if 1\n db 1\n else\n db 2\n endif\n db 3\nelse\n if 0\n db 4\n else\n db 5\n endif\nendif\nIF 2 > 1 ; db 6 ; ENDIF",
+			},
+			want: b(5, 6),
+		},
+		{
+			fs: ffs{
+				"a.asm": "if 0; skipped: endif; if 0; db 1; .skipped else; db 2; taken: endif; db 3",
+			},
+			want: b(2, 3),
+		},
+		{
+			fs: ffs{
+				"a.asm": "if later > 0x8000; nop; endif; later: db later & 0xff",
+			},
+			want: b(0),
+		},
+		{
+			fs: ffs{
+				"a.asm": "macro ldab x, y\n ld a, x\n ld b, y\nendm\nldab 1, 2\nLDAB 'c', (3+4)*2",
+			},
+			want: b(0x3e, 1, 0x06, 2, 0x3e, 'c', 0x06, 14),
+		},
+		{
+			fs: ffs{
+				"a.asm": "macro wait n\n ld b, n\n.loop djnz loop\nendm\nmacro twice r\n ld r, 1; wait 2\nendm\nf: twice a; twice (hl); .loop jr loop",
+			},
+			want: b(0x3e, 1, 0x06, 2, 0x10, 0xfe, 0x36, 1, 0x06, 2, 0x10, 0xfe, 0x18, 0xfe),
+		},
+		{
+			fs: ffs{
+				"a.asm": "macro m\ninner: nop\nendm\nf: .loop nop; m; jr loop",
+			},
+			want: b(0, 0, 0x18, 0xfc),
+		},
+		{
+			fs: ffs{
+				"a.asm": "if 0; macro m; nop; endm; endif; macro m; db 1; endm; m; macro swap\n ex af, af'\nendm\nswap",
+			},
+			want: b(1, 0x08),
+		},
+		{
+			fs: ffs{
+				"a.asm": "rept 3; db 1; endr; rept 4, n\n db n * 2\nendr\nrept 0; db 9; endr; rept 2, x; rept 2, y; db x * 16 + y; endr; endr",
+			},
+			want: b(1, 1, 1, 0, 2, 4, 6, 0x00, 0x01, 0x10, 0x11),
+		},
+		{
+			fs: ffs{
+				"a.asm": "f: rept 2\n.loop djnz loop\nendr\nrept y - x; nop; endr\nx: db 1, 2; y:",
+			},
+			want: b(0x10, 0xfe, 0x10, 0xfe, 0, 0, 1, 2),
+		},
+		{
+			fs: ffs{
+				"a.asm": "rept x1 - x0; db 9; endr\nx0: rept y1 - y0; nop; endr\nx1:\ny0: db 1, 2, 3; y1:",
+			},
+			want: b(9, 9, 9, 0, 0, 0, 1, 2, 3),
+		},
+		{
+			fs: ffs{
+				"a.asm": `incbin "d.bin"; incbin "d.bin", 3; incbin "d.bin", 1, 2; incbin "d.bin", 5, 0; x: db x & 0xff`,
+				"d.bin": "\x01\x02\x03\x04\x05",
+			},
+			want: b(1, 2, 3, 4, 5, 4, 5, 2, 3, 0x09),
+		},
+		{
+			fs: ffs{
+				"a.asm": "in (c); in f, (c); out (c), 0; in b, (c); out (c), a; in a, (c); f: out (c), f & 0",
+			},
+			want: b(0xed, 0x70, 0xed, 0x70, 0xed, 0x71, 0xed, 0x40, 0xed, 0x79, 0xed, 0x78, 0xed, 0x71),
+		},
+		{
+			fs: ffs{
+				"a.asm": "IN F, (c); In f, (c)",
+			},
+			want: b(0xed, 0x70, 0xed, 0x70),
+		},
+		{
+			fs: ffs{
+				"a.asm": "start: dwbe later, 0x1234, later + 1, -2; dw later; .mid dwbe mid, start; later:",
+			},
+			want: b(0x80, 0x0e, 0x12, 0x34, 0x80, 0x0f, 0xff, 0xfe, 0x0e, 0x80, 0x80, 0x0a, 0x80, 0x00),
+		},
+		{
+			fs: ffs{
+				"a.asm": "db 1 ? 2 : 3, 0 ? 2 : 3, 1 ? 0 ? 4 : 5 : 6, 0 ? 1 : 0 ? 7 : 8, 2 > 1 ? 9 : 10, (0 ? 1 : 2) + 9",
+			},
+			want: b(2, 3, 5, 8, 9, 11),
+		},
+		{
+			fs: ffs{
+				"a.asm": "const speed = 0; const fast = 1; db fast ? 1 : 256 / speed, speed ? 256 / speed : 2; ld a, x ? 3 : 4; x:",
+			},
+			want: b(1, 2, 0x3e, 3),
+		},
+		{
+			fs: ffs{
+				"a.asm": `dbhex "00 FF 10"; dbhex "DEADBEEF", "", "	c9\n 3e "`,
+			},
+			want: b(0x00, 0xff, 0x10, 0xde, 0xad, 0xbe, 0xef, 0xc9, 0x3e),
+		},
+		{
+			fs: ffs{
+				"a.asm": "jr +0; jr -2; djnz -3; jr nz, +127; jr c, -128; x: jr x; ld a, +5",
+			},
+			want: b(0x18, 0x00, 0x18, 0xfe, 0x10, 0xfd, 0x20, 0x7f, 0x38, 0x80, 0x18, 0xfe, 0x3e, 0x05),
+		},
+		{
+			fs: ffs{
+				"a.asm": "const x = 2; jr -x; djnz -(2); jr +(x * 2); jr z, -(x + 1); y: jr +y",
+			},
+			want: b(0x18, 0xfe, 0x10, 0xfe, 0x18, 0x04, 0x28, 0xfd, 0x18, 0xfe),
+		},
+		{
+			fs: ffs{
+				"a.asm": "const one = 1; db defined(one), defined(two), defined(f), !defined(g); f: nop; const two = 2; g: db defined(g), defined(two) + 1; if defined(three); db 5; else; db 6; endif",
+			},
+			want: b(0x01, 0x00, 0x00, 0x01, 0x00, 0x01, 0x02, 0x06),
+		},
+		{
+			fs: ffs{
+				"a.asm": "ld a, high(tbl); ld b, low(tbl); ld c, high(tbl + 0x100); ld d, low(tbl+16); db low(-1), high(0x1234) + 1, high(low(0x1234) << 8); tbl:",
+			},
+			want: b(0x3e, 0x80, 0x06, 0x0b, 0x0e, 0x81, 0x16, 0x1b, 0xff, 0x13, 0x34),
+		},
+		{
+			fs: ffs{
+				"a.asm": "org 0x8000; jr 0x8002; djnz 0x8000; x: jr nz, x + 4; jr c, 0x8000 + 8",
+			},
+			want: b(0x18, 0x00, 0x10, 0xfc, 0x20, 0x02, 0x38, 0x00),
+		},
+		{
+			fs: ffs{
+				"a.asm": "ld a, ixh; add a, ixl; inc iyh; ld ixl, 5; ld ixh, ixl; sub iyl; ld b, iyh; ld iyl, a; dec ixh",
+			},
+			want: b(0xdd, 0x7c, 0xdd, 0x85, 0xfd, 0x24, 0xdd, 0x2e, 0x05, 0xdd, 0x65, 0xfd, 0x95, 0xfd, 0x44, 0xfd, 0x6f, 0xdd, 0x25),
+		},
+		{
+			fs: ffs{
+				"a.asm": "sll b; sll (hl); sll a",
+			},
+			want: b(0xcb, 0x30, 0xcb, 0x36, 0xcb, 0x37),
+		},
+		{
+			fs: ffs{
+				"a.asm": `dz "hi"; dz "a", "", "bc"`,
+			},
+			want: b('h', 'i', 0, 'a', 0, 0, 'b', 'c', 0),
+		},
+		{
+			fs: ffs{
+				"a.asm": "jr $; start: ld a, 1; db $ - start, 0; dw $, $; here equ $; dw here; jp $ + 3",
+			},
+			want: b(0x18, 0xfe, 0x3e, 0x01, 0x02, 0x00, 0x06, 0x80, 0x06, 0x80, 0x0a, 0x80, 0xc3, 0x0f, 0x80),
+		},
+		{
+			fs: ffs{
+				"a.asm": "x equ 42 ; ld a, x; y EQU x+1; db y",
+			},
+			want: b(0x3e, 42, 43),
+		},
+		{
+			fs: ffs{
+				"a.asm": "table t, i*2, 4; ld a, i; dw t",
+			},
+			want: b(0, 2, 4, 6, 0xed, 0x57, 0x00, 0x80),
+		},
+		{
+			nextCore: Z80CoreNext1,
+			fs: ffs{
+				"a.asm": "ld bc, TBBLUE_REGISTER_SELECT_P_243B; out (TBBLUE_REGISTER_SELECT_P_243B >> 8), a; out (ULA_P_FE), a",
+			},
+			want: b(0x01, 0x3b, 0x24, 0xd3, 0x24, 0xd3, 0xfe),
+		},
+		{
+			nextCore: Z80CoreNext1,
+			fs: ffs{
+				"a.asm": "copwait 100, 10; copmove 0x40, 0x12; copwait 511, 63",
+			},
+			want: []byte{0x94, 0x64, 0x40, 0x12, 0xff, 0xff},
+		},
+		{
+			nextCore: Z80CoreNext1,
+			fs: ffs{
+				"a.asm": `palette "a.pal"; palette "b.nxp"`,
+				"a.pal": "\xff\x00\x00\x00\xff\x00\x00\x00\xff\x24\x48\xa0",
+				"b.nxp": "\x12\x01",
+			},
+			want: b(0xe0, 0x00, 0x1c, 0x00, 0x03, 0x01, 0x2a, 0x01, 0x12, 0x01),
+		},
+		{
+			nextCore: Z80CoreNext1,
+			fs: ffs{
+				"a.asm": "dmaload 0x4000, 0xc000, 0x180",
+			},
+			want: []byte{0x83, 0x7d, 0x00, 0x40, 0x80, 0x01, 0x54, 0x02, 0x50, 0x02, 0xad, 0x00, 0xc0, 0x82, 0xcf, 0x87},
+		},
 		{
 			// Test relocation: we set pc to 0x1000 but compile at 0x8000.
 			fs: ffs{
@@ -284,6 +601,13 @@ func TestAsmSnippets(t *testing.T) {
 			want: []byte{0xff, 0x01, 0x10},
 		},
 
+		{
+			// bank 2 is at 0x8000 to 0xbfff.
+			fs: ffs{
+				"a.asm": "org 0xc000; bank 2; db 1; .label; dw label",
+			},
+			want: []byte{0x01, 0x01, 0xc0},
+		},
 		{
 			fs: ffs{
 				"a.asm": "const x = 0xabcd; dw x & 0xf7f",
@@ -304,6 +628,26 @@ func TestAsmSnippets(t *testing.T) {
 			},
 			want: []byte{0x01, 0x02, 0xa0, 0x42},
 		},
+		{
+			fs: ffs{
+				"a.asm":     `db 0x01; includelist "files.txt"; db 0x04`,
+				"files.txt": "# sources\nb.asm\n\n  c.asm  \n",
+				"b.asm":     `db 0x02`,
+				"c.asm":     `db 0x03`,
+			},
+			want: []byte{0x01, 0x02, 0x03, 0x04},
+		},
+		{
+			// A file can be listed twice, and a listed file
+			// can include another.
+			fs: ffs{
+				"a.asm":     `includelist "files.txt"`,
+				"files.txt": "b.asm\nc.asm\nb.asm\n",
+				"b.asm":     `db 0x02`,
+				"c.asm":     `db 0x03; include "b.asm"`,
+			},
+			want: []byte{0x02, 0x03, 0x02, 0x02},
+		},
 	}
 	for _, tc := range testcases {
 		for c := Z80Core(0); c < 3; c++ {
@@ -420,14 +764,26 @@ func TestParseErrors(t *testing.T) {
 		{"ld a, (1+2*3", ")"},
 		{"ld a, )1+2*3", "unexpected token \")\""},
 		{"ld a, 2+3+", "EOF"},
-		{"ld a, 1 ld b, 2", "unexpected identifier \"ld\""},
+		{"ld a, 1 ld b, 2", "unexpected identifier \"ld\" after instruction"},
+		{"nop foo", "unexpected identifier \"foo\" after instruction"},
+		{"nop 1", "unexpected 1 after instruction"},
+		{"ret z foo", "unexpected identifier \"foo\" after instruction"},
+		{"db 1 2", "unexpected 2 after instruction"},
 		{"ld b, (123)", "no suitable"},
+		{"adc ix, bc", "no suitable"},
+		{"sbc iy, de", "no suitable"},
 		{"xor a,", "unexpected trailing ,"},
 		{"xor missing", "label"},
 		{"ld hl, 6/(4-4)", "zero"},
 		{"ld hl, 6%(4-4)", "zero"},
 		{"db 256", "not in the range"},
 		{"dw 65536", "not in the range"},
+		{"dt 0x1000000", "not in the range"},
+		{"dt -1", "not in the range"},
+		{"dw 1__0", "'_' must separate successive digits"},
+		{"dw 0x12_", "'_' must separate successive digits"},
+		{"ld hl, -40000", "-40000 (-0x9c40) is not in the range -32768...65535 (-0x8000...0xffff)"},
+		{"ld bc, 65536", "65536 (0x10000) is not in the range -32768...65535 (-0x8000...0xffff)"},
 		{"label: ld hl, 42 ; label: ld bc, 42", "label \"label\" redefined"},
 		{"a: .label ld hl, 42 ; .label: ld bc, 42", "label \"a.label\" redefined"},
 		{"ld z, (1+2)", "(1 + 2)"},
@@ -438,6 +794,107 @@ func TestParseErrors(t *testing.T) {
 		{"ld z, (1+2)+3", "1 + 2 + 3"},
 		{"ld a, x; const x = 42", "use of const \"x\" before defin"},
 		{`db 0x42; include "a.asm"`, "recursive"},
+		{"bank 3", "0xc000 or above"},
+		{"org 0xc000; bank 128", "out of range"},
+		{"orgif 1, 0x9000", "orgif takes three arguments"},
+		{"phase 0xc000; phase 0xd000", "phase inside another phase block"},
+		{"dephase", "dephase without phase"},
+		{`include "a.asm" 0x7000`, "to follow include"},
+		{`include "a.asm" at 0x10000`, "out of range"},
+		{"db! 256", "256 = 256 is not in the range 0...255"},
+		{"const x = 200; db! x + 56", "x + 56 = 256 is not in the range 0...255"},
+		{"db! -1", "-1 = -1 is not in the range 0...255"},
+		{"f: sizeof f; sizeof f", "redefining \"f_size\""},
+		{"blocksize n", "expected syntax: blocksize"},
+		{"tlabel", "expected syntax: tlabel"},
+		{"tlabel x; tlabel x", "redefining \"x\""},
+		{"assert_range f, 0x8000, 0xbfff; org 0xc000; f: ret", "assert_range failed: f is c000, not in the range 8000...bfff"},
+		{"assert_range f, 0x8000; f: ret", "assert_range takes three arguments"},
+		{"org missing; nop", "unknown const or label \"missing\""},
+		{"ld a, 2 dup 1", "no suitable"},
+		{"db -1 dup 1", "dup count -1"},
+		{"db 2 dup 256", "not in the range"},
+		{"orgif 0, 0x9000, 0x10000", "out of range"},
+		{`includelist "missing.txt"`, "failed to open include list"},
+		{"table t, i*100, 4", "i * 100 = 300 for i = 3 is not in the range"},
+		{"table t, i", "expected syntax: table"},
+		{"x equ 1; x equ 2", "redefining \"x\""},
+		{"ld a, x; x equ 1", "use of const \"x\" before definition"},
+		{"align 3", "align 3 is not a positive power of two"},
+		{"align 0", "align 0 is not a positive power of two"},
+		{"align 4, 256", "not in the range"},
+		{"org 0xfff0; nop; align 0x20000", "moves the pc past 0x10000"},
+		{`dspec "\{AT 1}"`, "AT takes 2 arguments, found 1"},
+		{`dspec "\{BLINK 1}"`, "unknown control code"},
+		{`dspec "\{INK 256}"`, "bad argument \"256\""},
+		{`dspec "\{INK 2"`, "unterminated escape"},
+		{`dspec "\q"`, "bad string"},
+		{`db "\q"`, "bad string"},
+		{`ld a, '\q'`, "invalid char literal"},
+		{"dspec 42", "dspec expects strings, found 42"},
+		{"ds -1", "ds count -1 is not in the range"},
+		{"ds 2, 256", "not in the range"},
+		{"ds 2, 0, 0", "expected syntax: ds <count>, <fill>"},
+		{"ds n; nop", `unknown const or label "n"`},
+		{"ds n; n equ 2", `use of const "n" before definition`},
+		{"ds a", "ds count should be a number, found a"},
+		{"ld a, 1; fill_to 0x8001", "fill_to 0x8001: the pc is already at 0x8002"},
+		{"fill_to 0x8004, 300", "not in the range"},
+		{"if 1; nop", "if without endif"},
+		{"else", "else without if"},
+		{"endif", "endif without if"},
+		{"if 1; else; else; endif", "more than one else"},
+		{"if 1; endif 2", "after endif"},
+		{"if later < 0x8001; nop; endif; later:", "if condition later < 32769 changed between passes"},
+		{"macro m; nop", "macro m without endm"},
+		{"endm", "endm without macro"},
+		{"macro m x; endm; m", "macro m expects 1 arguments, got 0"},
+		{"macro ld; endm", "can't define macro ld"},
+		{"macro m; endm; macro m; endm", "macro m is already defined"},
+		{"macro m x, x; endm", "duplicate macro parameter x"},
+		{"macro m; macro n; endm", "macro definitions can't be nested"},
+		{"macro m; m; endm; m", "macros nested more than 64 deep"},
+		{"m; macro m; endm", "unknown command m"},
+		{"rept 2; nop", "rept without endr"},
+		{"endr", "endr without rept"},
+		{"rept -1; endr", "rept count -1 is not in the range"},
+		{"rept 2, 3; endr", "rept variable should be a name, found 3"},
+		{"rept; endr", "expected syntax: rept <count>, <var>"},
+		{`incbin "missing.bin"`, `failed to open binary file "missing.bin"`},
+		{`incbin 42`, `expected "filename" to follow incbin`},
+		{`incbin "a.asm", 100`, `incbin offset 100 is past the end of "a.asm"`},
+		{`incbin "a.asm", 1, 100`, `incbin of 100 bytes at offset 1 is past the end of "a.asm"`},
+		{`incbin "a.asm", -1`, "should not be negative"},
+		{"out (c), 1", "no suitable form of out found"},
+		{"in f, (c), 1", "no suitable form of in found"},
+		{"db 1 ? 2", "expected : in 1 ? 2 : ..."},
+		{"db 0 ? 2 : 1 / 0", "divide by zero"},
+		{`dbhex "123"`, `dbhex string "123" has an odd number of hex digits`},
+		{`dbhex "12 3g"`, `dbhex string "12 3g" isn't hex`},
+		{"dbhex 12", "dbhex expects strings, found 12"},
+		{"jr +128", "128 (0x80) is not in the range -128...127"},
+		{"djnz -129", "-129 (-0x81) is not in the range -128...127"},
+		{"ld ixh, iyl", "no suitable form of ld found"},
+		{"ld ixh, h", "no suitable form of ld found"},
+		{"ld ixl, (hl)", "no suitable form of ld found"},
+		{"ld ixh, (ix+1)", "no suitable form of ld found"},
+		{"jr x; db 129 dup 0; x:", "relative jump to 0x8083 is out of range (-128..127), offset 129"},
+		{"x: db 127 dup 0; djnz x", "relative jump to 0x8000 is out of range (-128..127), offset -129"},
+		{"jr 0x8082", "relative jump to 0x8082 is out of range (-128..127), offset 128"},
+		{"x: jr x - 0x8002", "relative jump to -2 is outside the address range 0..0xffff"},
+		{"x: jr x + 0x8000", "relative jump to 65536 is outside the address range 0..0xffff"},
+		{"db defined(1)", "expected defined(<name>)"},
+		{"db defined(x", "expected defined(<name>)"},
+		{"set 8, b", "bit index must be 0..7, got 8"},
+		{"bit -1, a", "bit index must be 0..7, got -1"},
+		{"res 3 + 5, (ix+1)", "bit index must be 0..7, got 8"},
+		{"ld a, high(1", "expected ) after high(1"},
+		{"warning", "expected syntax: warning"},
+		{"warning 42", "expected syntax: warning"},
+		{"dz 42", "dz expects strings, found 42"},
+		{"equ 1", "expected syntax: <ident> equ <value>"},
+		{"x equ 1, 2", "expected syntax: x equ <value>"},
+		{"ld bc, TBBLUE_REGISTER_SELECT_P_243B", "unknown const or label"},
 	}
 	for _, tc := range testCases {
 		testFailureSnippet(t, 0, ffs{"a.asm": tc.asm}, tc.wantErr)
@@ -514,3 +971,959 @@ func TestIntExpressions(t *testing.T) {
 		testSnippet(t, 0, 0x6000, fs, want)
 	}
 }
+
+func TestParseExpr(t *testing.T) {
+	testCases := []struct {
+		text string
+		want string
+	}{
+		{"(1+2)", "(1 + 2)"},
+		{"1+(2*3)", "1 + 2 * 3"},
+		{"1*(2+3)", "1 * (2 + 3)"},
+		{"(1+2)*3", "(1 + 2) * 3"},
+		{"1+2+3", "1 + 2 + 3"},
+		{"1+(2+3)", "1 + (2 + 3)"},
+		{"(1+2)+3", "1 + 2 + 3"},
+		{"label-start", "label - start"},
+		{"-x*2", "-x * 2"},
+		{"a==b<<2", "a == b << 2"},
+		{"$+3", "$ + 3"},
+		{"high (0x1234) + 1", "high(4660) + 1"},
+		{"low\t(x)", "low(x)"},
+		{"defined ( x )", "defined(x)"},
+	}
+	for _, tc := range testCases {
+		e, err := ParseExpr(tc.text)
+		if err != nil {
+			t.Errorf("ParseExpr(%q) failed: %v", tc.text, err)
+			continue
+		}
+		if got := e.String(); got != tc.want {
+			t.Errorf("ParseExpr(%q).String() = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "1+", "(1+2", "1 2"} {
+		if _, err := ParseExpr(bad); err == nil {
+			t.Errorf("ParseExpr(%q) succeeded, expected error", bad)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	fs := ffs{
+		"a.asm": "const n = 3; start: ld hl, 0; .loop djnz loop; end: nop",
+	}
+	asm, err := NewAssembler()
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = fs.open
+	if err := asm.AssembleFile("a.asm"); err != nil {
+		t.Fatalf("failed to assemble: %v", err)
+	}
+	for _, tc := range []struct {
+		text string
+		want int64
+	}{
+		{"end - start + 1", 6},
+		{"end", 0x8005},
+		{"n * 2", 6},
+	} {
+		got, err := asm.Eval(tc.text)
+		if err != nil {
+			t.Errorf("Eval(%q) failed: %v", tc.text, err)
+		} else if got != tc.want {
+			t.Errorf("Eval(%q) = %d, want %d", tc.text, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		text    string
+		wantErr string
+	}{
+		{"missing + 1", "unknown const or label \"missing\""},
+		{"loop", "unknown const or label \"loop\""},
+		{`"str"`, "can't compute"},
+		{"1 +", "unexpected"},
+	} {
+		if _, err := asm.Eval(tc.text); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("Eval(%q) gave error %v, want %q", tc.text, err, tc.wantErr)
+		}
+	}
+}
+
+func TestWrittenRange(t *testing.T) {
+	testCases := []struct {
+		src        string
+		start, end int
+		written    int
+	}{
+		{"", 0, 0, 0},
+		{"nop", 0x8000, 0x8001, 1},
+		{"org 0x9000; ld hl, 0; org 0x8800; db 1, 2", 0x8800, 0x9003, 5},
+		{"org 0x100, 0x10000; db 1, 2", 0x10000, 0x10002, 2},
+	}
+	for _, tc := range testCases {
+		asm, err := NewAssembler()
+		if err != nil {
+			t.Fatalf("failed to create assembler: %v", err)
+		}
+		asm.opener = ffs{"a.asm": tc.src}.open
+		if err := asm.AssembleFile("a.asm"); err != nil {
+			t.Fatalf("%q: failed to assemble: %v", tc.src, err)
+		}
+		if start, end := asm.WrittenRange(); start != tc.start || end != tc.end {
+			t.Errorf("%q: WrittenRange() = %x, %x, want %x, %x", tc.src, start, end, tc.start, tc.end)
+		}
+		if got := asm.BytesWritten(); got != tc.written {
+			t.Errorf("%q: BytesWritten() = %d, want %d", tc.src, got, tc.written)
+		}
+	}
+}
+
+func TestPassHook(t *testing.T) {
+	var calls []string
+	hook := func(pass int, phase PassPhase) {
+		calls = append(calls, fmt.Sprintf("%d:%d", pass, phase))
+	}
+	asm, err := NewAssembler(WithPassHook(hook))
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = ffs{"a.asm": "nop"}.open
+	if err := asm.AssembleFile("a.asm"); err != nil {
+		t.Fatalf("failed to assemble: %v", err)
+	}
+	want := []string{
+		fmt.Sprintf("0:%d", PassStart), fmt.Sprintf("0:%d", PassEnd),
+		fmt.Sprintf("1:%d", PassStart), fmt.Sprintf("1:%d", PassEnd),
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got hook calls %v, want %v", calls, want)
+	}
+}
+
+// mustAssemble assembles a.asm from the given files using
+// the given options, and fails the test if there's an error.
+func mustAssemble(t *testing.T, fs ffs, opts ...AssemblerOpt) *Assembler {
+	t.Helper()
+	asm, err := NewAssembler(opts...)
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = fs.open
+	if err := asm.AssembleFile("a.asm"); err != nil {
+		t.Fatalf("%q: failed to assemble: %v", fs["a.asm"], err)
+	}
+	return asm
+}
+
+func TestAutoAlignData(t *testing.T) {
+	src := "db 1; dw 0x1234, label; .label dw 0x5678"
+	asm := mustAssemble(t, ffs{"a.asm": src}, WithAutoAlignData())
+	want := b(0x01, 0x00, 0x34, 0x12, 0x06, 0x80, 0x78, 0x56)
+	if got := asm.RAM()[0x8000 : 0x8000+len(want)]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", toHex(got), toHex(want))
+	}
+	diags := asm.Diagnostics()
+	if len(diags) != 1 || !strings.Contains(diags[0].String(), "a.asm") || !strings.Contains(diags[0].Message, "8001") {
+		t.Errorf("got diagnostics %v, want one about padding at 8001", diags)
+	}
+
+	asm = mustAssemble(t, ffs{"a.asm": src})
+	want = b(0x01, 0x34, 0x12, 0x05, 0x80, 0x78, 0x56)
+	if got := asm.RAM()[0x8000 : 0x8000+len(want)]; !reflect.DeepEqual(got, want) {
+		t.Errorf("without alignment, got %s, want %s", toHex(got), toHex(want))
+	}
+	if diags := asm.Diagnostics(); len(diags) != 0 {
+		t.Errorf("without alignment, got diagnostics %v, want none", diags)
+	}
+
+	asm = mustAssemble(t, ffs{"a.asm": "db 1; dwbe 0x1234"}, WithAutoAlignData())
+	want = b(0x01, 0x00, 0x12, 0x34)
+	if got := asm.RAM()[0x8000 : 0x8000+len(want)]; !reflect.DeepEqual(got, want) {
+		t.Errorf("dwbe got %s, want %s", toHex(got), toHex(want))
+	}
+}
+
+func TestUnusedLabels(t *testing.T) {
+	src := "main: jp used; used: ret; unused: ret; f: .loop djnz loop; .skip ret"
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	got := asm.UnusedLabels()
+	want := []string{"f", "f.skip", "unused"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UnusedLabels() = %q, want %q", got, want)
+	}
+}
+
+// memWriterAt is an in-memory io.Writer and io.WriterAt.
+type memWriterAt struct {
+	b []byte
+}
+
+func (m *memWriterAt) Write(p []byte) (int, error) {
+	return m.WriteAt(p, int64(len(m.b)))
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.b) {
+		m.b = append(m.b, make([]byte, end-len(m.b))...)
+	}
+	return copy(m.b[off:], p), nil
+}
+
+func TestStreamingOutput(t *testing.T) {
+	fs := ffs{"a.asm": "ld a, 1; org 0x8010; ld a, 2; org 0x8004; ld a, 3; ret"}
+	buffered := mustAssemble(t, fs)
+	start, end := buffered.WrittenRange()
+	want := buffered.RAM()[start:end]
+
+	var wa memWriterAt
+	streamed := mustAssemble(t, fs, WithStreamingOutput(&wa))
+	if !reflect.DeepEqual(wa.b, want) {
+		t.Errorf("streamed %s, want %s", toHex(wa.b), toHex(want))
+	}
+	if s, e := streamed.WrittenRange(); s != start || e != end {
+		t.Errorf("streamed WrittenRange() = %x, %x, want %x, %x", s, e, start, end)
+	}
+
+	// A plain writer can't go backwards, but gaps are filled.
+	fs = ffs{"a.asm": "ld a, 1; org 0x8010; ld a, 2"}
+	buffered = mustAssemble(t, fs)
+	start, end = buffered.WrittenRange()
+	var buf bytes.Buffer
+	mustAssemble(t, fs, WithStreamingOutput(&buf))
+	if got, want := buf.Bytes(), buffered.RAM()[start:end]; !reflect.DeepEqual(got, want) {
+		t.Errorf("streamed to plain writer %s, want %s", toHex(got), toHex(want))
+	}
+
+	asm, err := NewAssembler(WithStreamingOutput(&bytes.Buffer{}))
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = ffs{"a.asm": "org 0x8010; nop; org 0x8000; nop"}.open
+	if err := asm.AssembleFile("a.asm"); err == nil || !strings.Contains(err.Error(), "can't stream") {
+		t.Errorf("backward org with a plain writer gave error %v, want can't stream", err)
+	}
+}
+
+func TestOrgIf(t *testing.T) {
+	for _, tc := range []struct {
+		overlay int
+		org     int
+		want    []byte
+	}{
+		{1, 0x9000, b(0x00, 0x00, 0x90)},
+		{0, 0xa000, b(0x00, 0x00, 0xa0)},
+	} {
+		src := fmt.Sprintf("const overlay = %d; orgif overlay, 0x9000, 0xa000; .start nop; dw start", tc.overlay)
+		testSnippet(t, 0, tc.org, ffs{"a.asm": src}, tc.want)
+	}
+}
+
+func TestPeepholeAdvice(t *testing.T) {
+	asm := mustAssemble(t, ffs{"a.asm": "ld b, 0; ld a, 0; ld a, 1; xor a"}, WithPeepholeAdvice())
+	diags := asm.Diagnostics()
+	if len(diags) != 1 || !strings.Contains(diags[0].Message, "8002: ld a, 0 could be xor a") {
+		t.Errorf("got diagnostics %v, want one suggesting xor a at 8002", diags)
+	}
+
+	asm = mustAssemble(t, ffs{"a.asm": "ld a, 1; inc a; add a, 2; or a; ret"}, WithPeepholeAdvice())
+	if diags := asm.Diagnostics(); len(diags) != 0 {
+		t.Errorf("got diagnostics %v, want none", diags)
+	}
+
+	asm = mustAssemble(t, ffs{"a.asm": "ld a, 0"})
+	if diags := asm.Diagnostics(); len(diags) != 0 {
+		t.Errorf("without peephole advice, got diagnostics %v, want none", diags)
+	}
+}
+
+func TestOrgForwardReference(t *testing.T) {
+	src := `org endlabel; start: nop; dw start; org 0x9000; ds "x"; endlabel:`
+	testSnippet(t, 0, 0x9000, ffs{"a.asm": src}, b('x', 0x00, 0x01, 0x90))
+
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	if got, ok := asm.GetLabel("", "start"); !ok || got != 0x9001 {
+		t.Errorf("start = %04x, %v, want 9001, true", got, ok)
+	}
+
+	// Each org depends on a label after the next one, so the
+	// labels take more than one rerun of the first pass to settle.
+	src = "org aa\npp: dw pp\norg bb\nnop\naa:\norg 0xe000\nbb:"
+	testSnippet(t, 0, 0xe000, ffs{"a.asm": src}, b(0x00, 0x01, 0xe0))
+
+	// Labels that never settle are reported, with the first
+	// label that moved in the final pass.
+	circular := ffs{"a.asm": "org aa\npp: dw pp\norg pp+0x100\naa: nop"}
+	testFailureSnippet(t, 0, circular, "didn't settle")
+	testFailureSnippet(t, 0, circular, `label "pp" moved`)
+}
+
+func TestPhase(t *testing.T) {
+	// The loop is stored at 0x8000, but runs at 0xc000.
+	src := "phase 0xc000; .loop jr loop; dw loop; jr nz, loop; dephase; end: dw end"
+	testSnippet(t, 0, 0x8000, ffs{"a.asm": src}, b(0x18, 0xfe, 0x00, 0xc0, 0x20, 0xfa, 0x06, 0x80))
+}
+
+func TestRegions(t *testing.T) {
+	src := `nop; code; ld a, 1; ret; data; db 1, 2, 3; org 0x9000; dw 4; code; nop`
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	want := []Region{
+		{0x8001, 0x8004, RegionCode},
+		{0x8004, 0x8007, RegionData},
+		{0x9000, 0x9002, RegionData},
+		{0x9002, 0x9003, RegionCode},
+	}
+	if got := asm.Regions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Regions() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseIntLiteral(t *testing.T) {
+	for _, tc := range []struct {
+		s     string
+		want  int64
+		valid bool
+	}{
+		{"0b1010_1010", 0xaa, true},
+		{"0x12_34", 0x1234, true},
+		{"0X_ff", 0xff, true},
+		{"1_000_000", 1000000, true},
+		{"42", 42, true},
+		{"1__0", 0, false},
+		{"10_", 0, false},
+		{"_10", 0, false},
+		{"0x_", 0, false},
+	} {
+		got, err := parseIntLiteral(tc.s)
+		if tc.valid && (err != nil || got != tc.want) {
+			t.Errorf("parseIntLiteral(%q) = %d, %v, want %d", tc.s, got, err, tc.want)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("parseIntLiteral(%q) = %d, want error", tc.s, got)
+		}
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	src := `org 0x9000, 0x12000; crc: dw 0; start: ds "123456789"; end:`
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	crc, err := asm.CRC16("start", "end", 0x1021)
+	if err != nil {
+		t.Fatalf("CRC16 failed: %v", err)
+	}
+	// The check value of CRC-16/CCITT-FALSE.
+	if crc != 0x29b1 {
+		t.Errorf("CRC16 = %04x, want 29b1", crc)
+	}
+	if err := asm.Patch("crc", []byte{byte(crc), byte(crc >> 8)}); err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if got, want := asm.RAM()[0x12000:0x12003], b(0xb1, 0x29, '1'); !reflect.DeepEqual(got, want) {
+		t.Errorf("after patch, got %s, want %s", toHex(got), toHex(want))
+	}
+	if _, err := asm.CRC16("end", "start", 0x1021); err == nil {
+		t.Errorf("CRC16 with reversed labels succeeded, want error")
+	}
+	if err := asm.Patch("missing", []byte{1}); err == nil {
+		t.Errorf("Patch of a missing label succeeded, want error")
+	}
+}
+
+func TestRequiredLabels(t *testing.T) {
+	asm, err := NewAssembler(WithRequiredLabels("main", "init", "draw"))
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = ffs{"a.asm": "main: call init; ret; init: ret"}.open
+	err = asm.AssembleFile("a.asm")
+	if err == nil || !strings.Contains(err.Error(), `missing required label "draw"`) {
+		t.Errorf("got error %v, want missing draw", err)
+	}
+	if err != nil && (strings.Contains(err.Error(), `"main"`) || strings.Contains(err.Error(), `"init"`)) {
+		t.Errorf("got error %v, want only draw reported", err)
+	}
+
+	mustAssemble(t, ffs{"a.asm": ".main ret"}, WithRequiredLabels("main"))
+}
+
+func TestIncludeAt(t *testing.T) {
+	fs := ffs{
+		"a.asm":   `ld a, 1; include "lib.asm" at 0x7000; after: dw libf, after`,
+		"lib.asm": "libf: ret",
+	}
+	asm := mustAssemble(t, fs)
+	if got, ok := asm.GetLabel("", "libf"); !ok || got != 0x7000 {
+		t.Errorf("libf = %04x, %v, want 7000, true", got, ok)
+	}
+	if got, want := asm.RAM()[0x7000], byte(0xc9); got != want {
+		t.Errorf("byte at 7000 = %02x, want %02x", got, want)
+	}
+	want := b(0x3e, 0x01, 0x00, 0x70, 0x02, 0x80)
+	if got := asm.RAM()[0x8000 : 0x8000+len(want)]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", toHex(got), toHex(want))
+	}
+}
+
+func TestInstructionLength(t *testing.T) {
+	for _, tc := range []struct {
+		core Z80Core
+		text string
+		want int
+	}{
+		{0, "nop", 1},
+		{0, "ld hl, 0", 3},
+		{0, "ld (ix+0), 5", 4},
+		{0, "bit 0, (ix+0)", 4},
+		{0, "jp somewhere", 3},
+		{Z80CoreNext1, "nextreg 7, a", 3},
+	} {
+		got, err := InstructionLength(tc.core, tc.text)
+		if err != nil || got != tc.want {
+			t.Errorf("InstructionLength(%d, %q) = %d, %v, want %d", tc.core, tc.text, got, err, tc.want)
+		}
+	}
+	for _, text := range []string{"nextreg 7, a", "nop; nop", "nop\nret", ""} {
+		if got, err := InstructionLength(0, text); err == nil {
+			t.Errorf("InstructionLength(0, %q) = %d, want error", text, got)
+		}
+	}
+}
+
+func TestLabelPrefix(t *testing.T) {
+	syms := map[string]uint16{}
+	for _, m := range []struct {
+		prefix, src string
+	}{
+		{"gfx_", "org 0x9000; init: ld hl, buf; .loop jr loop; buf: db 4 dup 0"},
+		{"snd_", "org 0xa000; init: ld hl, buf; call init; buf: db 2 dup 0"},
+	} {
+		asm := mustAssemble(t, ffs{"a.asm": m.src}, WithLabelPrefix(m.prefix))
+		if got, ok := asm.GetLabel("", "init"); !ok || got != asm.l[m.prefix+"init"] {
+			t.Errorf("%s: GetLabel(init) = %04x, %v, want the value of %sinit", m.prefix, got, ok, m.prefix)
+		}
+		for k, v := range asm.l {
+			if !strings.HasPrefix(k, m.prefix) {
+				t.Errorf("label %q doesn't have prefix %q", k, m.prefix)
+			}
+			if _, ok := syms[k]; ok {
+				t.Errorf("label %q defined in more than one module", k)
+			}
+			syms[k] = v
+		}
+	}
+	want := map[string]uint16{
+		"gfx_init":      0x9000,
+		"gfx_init.loop": 0x9003,
+		"gfx_buf":       0x9005,
+		"snd_init":      0xa000,
+		"snd_buf":       0xa006,
+	}
+	if !reflect.DeepEqual(syms, want) {
+		t.Errorf("got labels %v, want %v", syms, want)
+	}
+}
+
+func TestRelocations(t *testing.T) {
+	src := "const k = 0x1234; main: ld hl, label; ld bc, k; ld (ix+1), 2; jp main; ld (label), a; label: dw label, k, label+1"
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	want := []Reloc{
+		{0x8001, "label"},
+		{0x800b, "main"},
+		{0x800e, "label"},
+		{0x8010, "label"},
+	}
+	if got := asm.Relocations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got relocations %v, want %v", got, want)
+	}
+}
+
+func TestExprDepth(t *testing.T) {
+	nested := func(n int) string {
+		return "db " + strings.Repeat("(", n) + "1" + strings.Repeat(")", n)
+	}
+	testSnippet(t, 0, 0x8000, ffs{"a.asm": nested(100)}, b(0x01))
+	testFailureSnippet(t, 0, ffs{"a.asm": nested(100000)}, "expression nested more than 256 deep")
+	testFailureSnippet(t, 0, ffs{"a.asm": "db " + strings.Repeat("-", 100000) + "1"}, "expression nested more than 256 deep")
+
+	asm, err := NewAssembler(WithMaxExprDepth(10))
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = ffs{"a.asm": nested(20)}.open
+	if err := asm.AssembleFile("a.asm"); err == nil || !strings.Contains(err.Error(), "nested more than 10 deep") {
+		t.Errorf("got error %v, want nesting error", err)
+	}
+}
+
+func TestCoreConst(t *testing.T) {
+	// The same source assembles differently depending on the core.
+	src := ffs{"a.asm": "orgif __CORE__ >= 1, 0x9000, 0x8000; db __CORE__, __CORE__ == 2"}
+	testSnippet(t, Z80CoreStandard, 0x8000, src, b(0, 0))
+	testSnippet(t, Z80CoreNext2, 0x9000, src, b(2, 1))
+}
+
+func TestPeekTarget(t *testing.T) {
+	asm := mustAssemble(t, ffs{"a.asm": "org 0x9000, 0x12000; db 0x42, 0x17; org 0x9004, 0x12004; db 0"})
+	for _, tc := range []struct {
+		offset int
+		want   byte
+		ok     bool
+	}{
+		{0x12000, 0x42, true},
+		{0x12001, 0x17, true},
+		{0x11fff, 0, false},
+		{0x12002, 0, false},
+		{0x12003, 0, false},
+		{0x12004, 0, true},
+		{0x12005, 0, false},
+		{-1, 0, false},
+		{1 << 30, 0, false},
+	} {
+		if got, ok := asm.PeekTarget(tc.offset); got != tc.want || ok != tc.ok {
+			t.Errorf("PeekTarget(%#x) = %02x, %v, want %02x, %v", tc.offset, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestAppendCode(t *testing.T) {
+	asm := mustAssemble(t, ffs{"a.asm": "org 0x1000, 0x9000; db 0x42; org 0x1100, 0x9100; db 0x17"})
+	pc, err := asm.AppendCode(b(0xc3, 0x00, 0x10))
+	if err != nil {
+		t.Fatalf("AppendCode failed: %v", err)
+	}
+	if pc != 0x1101 {
+		t.Errorf("AppendCode returned pc %04x, want 1101", pc)
+	}
+	if start, end := asm.WrittenRange(); start != 0x9000 || end != 0x9104 {
+		t.Errorf("WrittenRange() = %x, %x, want 9000, 9104", start, end)
+	}
+	if got, ok := asm.PeekTarget(0x9103); got != 0x10 || !ok {
+		t.Errorf("PeekTarget(0x9103) = %02x, %v, want 10, true", got, ok)
+	}
+	if _, err := asm.AppendCode(make([]byte, 0x10000)); err == nil || !strings.Contains(err.Error(), "no room") {
+		t.Errorf("got error %v, want no room", err)
+	}
+}
+
+func TestWriteIHEX(t *testing.T) {
+	asm := mustAssemble(t, ffs{"a.asm": "org 0x9000; db 0, 1; org 0x9100; nop"})
+	var buf bytes.Buffer
+	if err := asm.WriteIHEX(&buf); err != nil {
+		t.Fatalf("WriteIHEX failed: %v", err)
+	}
+	// The bytes skipped over by org aren't written, but
+	// the zero bytes that were assembled are.
+	want := ":0290000000016D\n:01910000006E\n:00000001FF\n"
+	if got := buf.String(); got != want {
+		t.Errorf("WriteIHEX gave %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	if err := asm.WriteIHEX(&buf, [2]int{0x9001, 0x9100}); err != nil {
+		t.Fatalf("WriteIHEX failed: %v", err)
+	}
+	want = ":01900000006F\n:01910000006E\n:00000001FF\n"
+	if got := buf.String(); got != want {
+		t.Errorf("WriteIHEX with gaps gave %q, want %q", got, want)
+	}
+}
+
+func TestIfCore(t *testing.T) {
+	src := ffs{"a.asm": "if __CORE__ >= 1; nextreg 7, 2; else; ld a, 2; endif"}
+	testSnippet(t, Z80CoreStandard, 0x8000, src, b(0x3e, 0x02))
+	testSnippet(t, Z80CoreNext2, 0x8000, src, b(0xed, 0x91, 0x07, 0x02))
+}
+
+// longDataList returns a db directive with n values, and the
+// bytes it should produce.
+func longDataList(n int) (string, []byte) {
+	var sb strings.Builder
+	var want []byte
+	sb.WriteString("db ")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%d", i*7%256)
+		want = append(want, byte(i*7))
+	}
+	return sb.String(), want
+}
+
+func TestLongDataList(t *testing.T) {
+	src, want := longDataList(10000)
+	asm := mustAssemble(t, ffs{"a.asm": "org 0x1000; " + src})
+	if got := asm.RAM()[0x1000 : 0x1000+len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("long db list assembled incorrectly")
+	}
+	// The same data written one value per line.
+	lines := strings.Replace(src, ", ", "\ndb ", -1)
+	asm = mustAssemble(t, ffs{"a.asm": "org 0x1000\n" + lines})
+	if got := asm.RAM()[0x1000 : 0x1000+len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("db one value per line differs from long db list")
+	}
+}
+
+func BenchmarkLongDataList(b *testing.B) {
+	src, _ := longDataList(10000)
+	fs := ffs{"a.asm": "org 0x1000; " + src}
+	for i := 0; i < b.N; i++ {
+		asm, err := NewAssembler()
+		if err != nil {
+			b.Fatalf("failed to create assembler: %v", err)
+		}
+		asm.opener = fs.open
+		if err := asm.AssembleFile("a.asm"); err != nil {
+			b.Fatalf("failed to assemble: %v", err)
+		}
+	}
+}
+
+func TestCollectLabels(t *testing.T) {
+	fs := ffs{
+		"a.asm": "org 0x9000\nstart: nop\n.loop djnz loop\ninclude \"b.asm\"\nafter: ld a, (later)\n",
+		"b.asm": "\nlib: ret\n",
+	}
+	asm, err := NewAssembler()
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = fs.open
+	got, err := asm.CollectLabels("a.asm")
+	if err != nil {
+		t.Fatalf("CollectLabels failed: %v", err)
+	}
+	want := []LabelInfo{
+		{"start", "a.asm", 2, 0x9000},
+		{"start.loop", "a.asm", 3, 0x9001},
+		{"lib", "b.asm", 2, 0x9003},
+		{"after", "a.asm", 5, 0x9004},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CollectLabels = %+v, want %+v", got, want)
+	}
+	if start, end := asm.WrittenRange(); start != end {
+		t.Errorf("CollectLabels wrote bytes %04x...%04x", start, end)
+	}
+
+	// As in AssembleFile, the first pass is run until the
+	// labels settle.
+	asm, err = NewAssembler()
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = ffs{"a.asm": "org aa\npp: dw pp\norg bb\nnop\naa:\norg 0xe000\nbb:"}.open
+	got, err = asm.CollectLabels("a.asm")
+	if err != nil {
+		t.Fatalf("CollectLabels failed: %v", err)
+	}
+	if got[0].Name != "pp" || got[0].Addr != 0xe001 {
+		t.Errorf("CollectLabels found %+v, want pp at e001", got[0])
+	}
+}
+
+func TestAssembleReader(t *testing.T) {
+	asm, err := NewAssembler()
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = ffs{"b.asm": "db 3"}.open
+	src := "org 0x9000; db 1, 2; include \"b.asm\"; jp later; later:"
+	if err := asm.AssembleReader("main.asm", strings.NewReader(src)); err != nil {
+		t.Fatalf("AssembleReader failed: %v", err)
+	}
+	want := b(1, 2, 3, 0xc3, 0x06, 0x90)
+	if got := asm.RAM()[0x9000 : 0x9000+len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("AssembleReader wrote %s, want %s", toHex(got), toHex(want))
+	}
+	if got, want := asm.SourceFiles(), []string{"main.asm", "b.asm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SourceFiles() = %q, want %q", got, want)
+	}
+
+	asm, err = NewAssembler()
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	err = asm.AssembleReader("bad.asm", strings.NewReader("nop\nld q, 1"))
+	if err == nil || !strings.Contains(err.Error(), "bad.asm:2") {
+		t.Errorf("AssembleReader gave error %v, want it at bad.asm:2", err)
+	}
+}
+
+func TestSymbolTable(t *testing.T) {
+	src := "org 0x9000; const size = 3 * 4\nmain: nop\n.loop djnz loop\nf: ret"
+	asm := mustAssemble(t, ffs{"a.asm": src}, UseNextCore(Z80CoreNext2))
+	want := map[string]uint16{"main": 0x9000, "main.loop": 0x9001, "f": 0x9003}
+	got := asm.SymbolTable()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SymbolTable() = %v, want %v", got, want)
+	}
+	got["main"] = 0
+	if v, _ := asm.GetLabel("", "main"); v != 0x9000 {
+		t.Errorf("changing the result of SymbolTable changed label main to %04x", v)
+	}
+	// The Next's predefined consts aren't included.
+	if got, want := asm.Constants(), map[string]int64{"size": 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Constants() = %v, want %v", got, want)
+	}
+}
+
+func TestListing(t *testing.T) {
+	fs := ffs{
+		"a.asm": "org 0x9000\nstart:\n    ld ix, (1049)\n    ld a, 1 ; inc a\n    db 1, 2, 3, 4, 5, 6\n.loop djnz loop\ninclude \"b.asm\"\n    ret",
+		"b.asm": "// b\n    nop\n",
+	}
+	var buf bytes.Buffer
+	mustAssemble(t, fs, WithListing(&buf))
+	want := strings.Join([]string{
+		"                   org 0x9000",
+		"                   start:",
+		"9000  dd 2a 19 04      ld ix, (1049)",
+		"9004  3e 01 3c         ld a, 1 ; inc a",
+		"9007  01 02 03 04      db 1, 2, 3, 4, 5, 6",
+		"900b  05 06",
+		"900d  10 fe        .loop djnz loop",
+		`                   include "b.asm"`,
+		"                   // b",
+		"900f  00               nop",
+		"9010  c9               ret",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("got listing:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelShadowsRegister(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{"f: .z nop; jr f", `label "z" has the same name as a condition code`},
+		{"nc: nop", `label "nc" has the same name as a condition code`},
+		{"f: .hl nop", `label "hl" has the same name as a register`},
+		{"f: .loop djnz loop; Z: nop", ""},
+	} {
+		asm := mustAssemble(t, ffs{"a.asm": tc.src})
+		diags := asm.Diagnostics()
+		if tc.want == "" {
+			if len(diags) != 0 {
+				t.Errorf("%q: got diagnostics %v, want none", tc.src, diags)
+			}
+			continue
+		}
+		if len(diags) != 1 || !strings.Contains(diags[0].Message, tc.want) {
+			t.Errorf("%q: got diagnostics %v, want one containing %q", tc.src, diags, tc.want)
+		}
+	}
+}
+
+func TestWriteSymbols(t *testing.T) {
+	src := "org 0x0100; start: nop\n.loop djnz loop\norg 0x9000; main: jp start; const k = 3"
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{SymbolsMap, "0100 start\n0101 start.loop\n9000 main\n"},
+		{SymbolsEqu, "start: equ $0100\nstart.loop: equ $0101\nmain: equ $9000\n"},
+	} {
+		var buf bytes.Buffer
+		if err := WriteSymbols(&buf, asm, tc.format); err != nil {
+			t.Fatalf("WriteSymbols(%q) failed: %v", tc.format, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("WriteSymbols(%q) = %q, want %q", tc.format, got, tc.want)
+		}
+	}
+	if err := WriteSymbols(ioutil.Discard, asm, "xyz"); err == nil {
+		t.Errorf("WriteSymbols with an unknown format succeeded")
+	}
+}
+
+func TestWarning(t *testing.T) {
+	src := "const old = 1\nif defined(old)\n  warning \"old is deprecated\"\nendif\nif defined(older); warning \"older is deprecated\"; endif\nld a, old"
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	diags := asm.Diagnostics()
+	if len(diags) != 1 || !strings.HasPrefix(diags[0].Location, "a.asm:3.") || diags[0].Message != "old is deprecated" {
+		t.Errorf("got diagnostics %v, want one on line 3 that old is deprecated", diags)
+	}
+	if got, want := asm.RAM()[0x8000:0x8002], b(0x3e, 0x01); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", toHex(got), toHex(want))
+	}
+}
+
+func TestSizeByLabel(t *testing.T) {
+	src := "small: nop; big: db 10 dup 0; .loop djnz loop; org 0x9000; mid: db 5 dup 0; empty:"
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	want := []LabelSize{
+		{"big", 0x8001, 12},
+		{"mid", 0x9000, 5},
+		{"small", 0x8000, 1},
+		{"empty", 0x9005, 0},
+	}
+	if got := asm.SizeByLabel(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SizeByLabel() = %+v, want %+v", got, want)
+	}
+
+	// The labels in a macro and a rept don't split the block
+	// they're used in.
+	src = "macro wait n\n ld b, n\nw: djnz w\nendm\nmain: nop; wait 3; ld a, 1; ret\nf: rept 2; l: nop; endr"
+	asm = mustAssemble(t, ffs{"a.asm": src})
+	want = []LabelSize{
+		{"main", 0x8000, 8},
+		{"f", 0x8008, 2},
+	}
+	if got := asm.SizeByLabel(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SizeByLabel() with a macro = %+v, want %+v", got, want)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	src := "const k = 3\norg 0x8000\nmain: ld hl, label\n  ld a, (hl) // load\n.loop djnz loop\n  ld bc, label + k; jr main\nlabel: db k\n"
+	asm := mustAssemble(t, ffs{"a.asm": src})
+	var buf bytes.Buffer
+	if err := asm.Annotate("a.asm", &buf); err != nil {
+		t.Fatalf("Annotate failed: %v", err)
+	}
+	want := "const k = 3\norg 0x8000\nmain: ld hl, label // = 0x800b\n  ld a, (hl) // load\n.loop djnz loop // = 0x8004\n" +
+		"  ld bc, label + k; jr main // label = 0x800b, k = 0x0003, main = 0x8000\nlabel: db k // = 0x0003\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Annotate gave:\n%s\nwant:\n%s", got, want)
+	}
+	if err := asm.Annotate("missing.asm", ioutil.Discard); err == nil {
+		t.Errorf("Annotate of a missing file succeeded")
+	}
+
+	// The \{...} escapes of dspec aren't errors.
+	src = "main: ld hl, main\ndspec \"\\{INK 2}A\"\n"
+	asm = mustAssemble(t, ffs{"a.asm": src})
+	buf.Reset()
+	if err := asm.Annotate("a.asm", &buf); err != nil {
+		t.Fatalf("Annotate with dspec failed: %v", err)
+	}
+	want = "main: ld hl, main // = 0x8000\ndspec \"\\{INK 2}A\"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Annotate gave:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaps(t *testing.T) {
+	asm := mustAssemble(t, ffs{"a.asm": "org 0x8000; db 1, 2; ds 2; org 0x8008; db 3; org 0x800a; db 4"})
+	for _, tc := range []struct {
+		start, end int
+		want       [][2]int
+	}{
+		{0x8000, 0x800b, [][2]int{{0x8004, 0x8008}, {0x8009, 0x800a}}},
+		{0x8000, 0x8004, nil},
+		{0x8006, 0x8009, [][2]int{{0x8006, 0x8008}}},
+		{0x7ffe, 0x8001, [][2]int{{0x7ffe, 0x8000}}},
+		{0x800a, 0x800c, [][2]int{{0x800b, 0x800c}}},
+	} {
+		if got := asm.Gaps(tc.start, tc.end); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Gaps(%04x, %04x) = %x, want %x", tc.start, tc.end, got, tc.want)
+		}
+	}
+}
+
+func TestTLabel(t *testing.T) {
+	asm := mustAssemble(t, ffs{"a.asm": "org 0x1000, 0x8000; start: tlabel src; db 1, 2; tlabel far; org 0xc000; bank 5; tlabel b5"})
+	for _, tc := range []struct {
+		name string
+		want int64
+	}{
+		{"src", 0x8000},
+		{"far", 0x8002},
+		{"b5", 0x14000},
+	} {
+		if got, ok, err := asm.GetConst(tc.name); err != nil || !ok || got != tc.want {
+			t.Errorf("%s = %#x, %v, %v, want %#x", tc.name, got, ok, err, tc.want)
+		}
+	}
+	if got, ok := asm.GetLabel("", "start"); !ok || got != 0x1000 {
+		t.Errorf("start = %#x, %v, want 0x1000", got, ok)
+	}
+
+	// Like a label, a tlabel can be used before it's defined.
+	asm = mustAssemble(t, ffs{"a.asm": "ld hl, src; ret; org 0xc000, 0x9000; tlabel src; db 1, 2"})
+	if got, want := asm.RAM()[0x8000:0x8004], b(0x21, 0x00, 0x90, 0xc9); !bytes.Equal(got, want) {
+		t.Errorf("ld hl, src before tlabel src assembled to % x, want % x", got, want)
+	}
+}
+
+func TestWithRAM(t *testing.T) {
+	buf := make([]uint8, 0x8010)
+	buf[0x8005] = 0xaa
+	asm := mustAssemble(t, ffs{"a.asm": "ld a, 1; ret; org 0x8006; db 2"}, WithRAM(buf))
+	want := b(0x3e, 0x01, 0xc9, 0x00, 0x00, 0xaa, 0x02)
+	if got := buf[0x8000:0x8007]; !reflect.DeepEqual(got, want) {
+		t.Errorf("buffer has %s, want %s", toHex(got), toHex(want))
+	}
+	if &asm.RAM()[0] != &buf[0] {
+		t.Errorf("RAM() isn't the buffer passed to WithRAM")
+	}
+
+	// The buffer can't grow.
+	asm, err := NewAssembler(WithRAM(buf))
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	asm.opener = ffs{"a.asm": "org 0x800f; db 1, 2"}.open
+	if err := asm.AssembleFile("a.asm"); err == nil || !strings.Contains(err.Error(), "past the end of the 32784 byte RAM buffer") {
+		t.Errorf("got error %v, want past the end of the buffer", err)
+	}
+	if _, err := NewAssembler(WithRAM(nil)); err == nil {
+		t.Errorf("WithRAM(nil) succeeded")
+	}
+}
+
+func TestFillGaps(t *testing.T) {
+	asm := mustAssemble(t, ffs{"a.asm": "org 0x8000; db 1, 0; org 0x8004; db 0, 2; ds 2; org 0x800a; db 3"})
+	asm.FillGaps(0xff)
+	want := b(0x01, 0x00, 0xff, 0xff, 0x00, 0x02, 0x00, 0x00, 0xff, 0xff, 0x03)
+	start, end := asm.WrittenRange()
+	if got := asm.RAM()[start:end]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", toHex(got), toHex(want))
+	}
+	// Memory outside the written range isn't changed.
+	if got := asm.RAM()[start-1]; got != 0 {
+		t.Errorf("byte before the written range is %02x, want 00", got)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	for _, tc := range []struct {
+		src          string
+		undocumented bool
+	}{
+		{"sll b", true},
+		{"sll (hl)", true},
+		{"in (c)", true},
+		{"in f, (c)", true},
+		{"out (c), 0", true},
+		{"ld a, ixh", true},
+		{"inc iyl", true},
+		{"ld ixl, 5", true},
+		{"srl b", false},
+		{"in a, (c)", false},
+		{"ld a, (ix+1)", false},
+		{"ld h, (iy-1)", false},
+	} {
+		for _, strict := range []bool{false, true} {
+			asm, err := NewAssembler(Strict(strict))
+			if err != nil {
+				t.Fatalf("failed to create assembler: %v", err)
+			}
+			asm.opener = ffs{"a.asm": tc.src}.open
+			err = asm.AssembleFile("a.asm")
+			wantErr := strict && tc.undocumented
+			if wantErr && (err == nil || !strings.Contains(err.Error(), "undocumented instruction")) {
+				t.Errorf("%q in strict mode: got error %v, want undocumented instruction", tc.src, err)
+			}
+			if !wantErr && err != nil {
+				t.Errorf("%q (strict=%v) failed: %v", tc.src, strict, err)
+			}
+		}
+	}
+}
@@ -2,22 +2,58 @@ package z80asm
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/bits"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"text/scanner"
 )
 
 var baseCommandTable = map[string]instrAssembler{
 	"org":     commandOrg{},
+	"orgif":   commandOrgIf{},
+	"phase":   commandPhase{},
+	"dephase": commandDephase{},
+	"code":    commandRegion(RegionCode),
+	"data":    commandRegion(RegionData),
+	"bank":    commandBank{},
 	"db":      cmdData(const8),
+	"db!":     cmdData(constU8),
 	"dw":      cmdData(const16),
+	"dwbe":    cmdData(const16be),
+	"dt":      cmdData(const24),
 	"ds":      cmdData(argstring),
+	"dz":      cmdStringZ{},
+	"dbhex":   cmdHex{},
+	"dspec":   commandDSpec{},
 	"const":   commandConst{},
+	"equ":     commandEqu{},
+	"sizeof":  commandSizeOf{},
 	"include": commandInclude{},
+	"incbin":  commandIncbin{},
+
+	"includelist":  commandIncludeList{},
+	"assert_range": commandAssertRange{},
+	"warning":      commandWarning{},
+	"blocksize":    commandBlockSize{},
+	"tlabel":       commandTLabel{},
+	"table":        commandTable{},
+	"align":        commandAlign{},
+	"fill_to":      commandFillTo{},
+	"if":           commandIf{},
+	"else":         commandElse{},
+	"endif":        commandEndif{},
+	"macro":        commandMacro{},
+	"endm":         commandEndm{},
+	"rept":         commandRept{},
+	"endr":         commandEndr{},
 }
 
 type commandAssembler struct {
@@ -32,22 +68,133 @@ type Assembler struct {
 	opener       func(string) (io.ReadCloser, error)
 	pass         int
 	pc           int // The PC from the point of view of the code
+	statementPC  int // The PC at the start of the statement, for $
+	commands     int // The number of commands assembled, for InstructionLength
 	target       int // Where in the total memory the code is written
 	l            map[string]uint16
 	consts       map[string]int64
 	constsDef    map[string]bool
+	predefined   map[string]int64 // consts defined before assembly
+	tlabels      map[string]bool  // consts defined by tlabel, which can be used before they're defined
 
 	currentMajorLabel string
 	labelAssign       map[string]string
+	labelDefs         []LabelInfo    // in the order they're first defined
+	labelTarget       map[string]int // where in memory each label is
+	labelUsed         map[string]bool
+	labelsDef         map[string]bool // labels defined so far in this pass
 	m                 []uint8
 
+	// unresolved is set in pass 0 when an expression uses a
+	// label that's not yet defined, and provisionalOrg when
+	// such an expression is used by org, fill_to or a ds count.
+	unresolved     bool
+	provisionalOrg bool
+
+	// When in a phase block, the pc and target at its start.
+	phased               bool
+	phasePC, phaseTarget int
+
+	// The range of targets written to so far.
+	written                bool
+	minWritten, maxWritten int
+	// maxWrittenPC is the pc of the byte written at maxWritten.
+	maxWrittenPC int
+	// writtenBits has a bit set for each target written to.
+	writtenBits []uint64
+
+	// fixedRAM is set if m was given by WithRAM, and can't grow.
+	fixedRAM bool
+
+	strict bool // reject undocumented instructions
+
+	// In a table directive, the value of the loop variable i.
+	inTable    bool
+	tableIndex int64
+
+	regionKind RegionKind // set by the code and data directives
+	regions    []Region
+
 	// These are stacks, used when we "include" another file.
 	scanners  []*scanner.Scanner
 	closers   []io.Closer
-	openFiles []string // to avoid recursive includes
+	openFiles []string       // to avoid recursive includes
+	onPop     []func() error // called when the file is finished, or nil
+
+	sourceFiles []string // files read in the final pass, in order
 
 	scanErr   error
 	lastToken token
+
+	// The stack of if blocks, and the result of each if
+	// condition evaluated in pass 0, in order.
+	conds       []condState
+	condCount   int
+	condResults []bool
+
+	// The macros defined so far in this pass, the number of
+	// macros used (to make their labels unique), and how
+	// deeply macro expansions are nested.
+	macros     map[string]*macro
+	macroCount int
+	macroDepth int
+
+	// localLabels are the names given to the labels that are
+	// local to a macro or rept expansion.
+	localLabels map[string]bool
+
+	passHooks     []func(pass int, phase PassPhase)
+	autoAlignData bool
+	stream        *streamWriter
+	peepholes     bool
+
+	// With computeLabelsFirst, instruction lengths in pass 0
+	// are cached by the shape of the instruction.
+	computeLabelsFirst bool
+	lengths            map[string]int
+
+	requiredLabels []string
+	labelPrefix    string
+
+	exprDepth, maxExprDepth int
+
+	// pendingReloc is set when a label is evaluated as a 16-bit
+	// value, with Addr relative to the start of the argument data.
+	relocs       []Reloc
+	pendingReloc *Reloc
+
+	diagnostics []Diagnostic
+
+	listing *lister // nil unless there's a listing
+}
+
+// A Diagnostic is a warning or note about the assembled code.
+type Diagnostic struct {
+	Location string // filename:line.column
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return d.Location + ": " + d.Message
+}
+
+// Diagnostics returns the warnings and notes produced
+// while assembling.
+func (asm *Assembler) Diagnostics() []Diagnostic {
+	return asm.diagnostics
+}
+
+// diagf records a diagnostic at the current location.
+// Diagnostics are only recorded in the final pass, so
+// that they aren't reported twice.
+func (asm *Assembler) diagf(fs string, args ...interface{}) {
+	if asm.pass != 1 {
+		return
+	}
+	asm.diagnostics = append(asm.diagnostics, Diagnostic{
+		Location: asm.location(),
+		Message:  fmt.Sprintf(fs, args...),
+	})
 }
 
 func openFile(filename string) (io.ReadCloser, error) {
@@ -55,6 +202,18 @@ func openFile(filename string) (io.ReadCloser, error) {
 	return f, err
 }
 
+// dirOpener returns an opener that tries dir for files
+// that don't exist relative to the current directory.
+func dirOpener(dir string) func(string) (io.ReadCloser, error) {
+	return func(filename string) (io.ReadCloser, error) {
+		f, err := os.Open(filename)
+		if os.IsNotExist(err) && !filepath.IsAbs(filename) {
+			f, err = os.Open(filepath.Join(dir, filename))
+		}
+		return f, err
+	}
+}
+
 type Z80Core int
 
 const (
@@ -64,7 +223,20 @@ const (
 )
 
 type assemblerOption struct {
-	core Z80Core
+	core          Z80Core
+	passHooks     []func(pass int, phase PassPhase)
+	autoAlignData bool
+	stream        io.Writer
+	peepholes     bool
+
+	computeLabelsFirst bool
+	requiredLabels     []string
+	labelPrefix        string
+	maxExprDepth       int
+	listing            io.Writer
+	ram                []uint8
+	strict             bool
+	includeDir         string
 }
 
 type AssemblerOpt func(*assemblerOption) error
@@ -77,11 +249,143 @@ func UseNextCore(core Z80Core) AssemblerOpt {
 	}
 }
 
+// A PassPhase says whether a pass hook is being called
+// at the start or end of a pass.
+type PassPhase int
+
+const (
+	PassStart PassPhase = iota
+	PassEnd
+)
+
+// WithPassHook adds a function that's called at the start and end
+// of each assembler pass. Passes are numbered from 0. Pass 0 is
+// run twice if an org uses a label that's defined after it.
+func WithPassHook(f func(pass int, phase PassPhase)) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.passHooks = append(a.passHooks, f)
+		return nil
+	}
+}
+
+// WithAutoAlignData makes dw and dwbe write their words at even
+// addresses, writing a zero pad byte first if necessary. Each pad
+// byte is reported as a diagnostic.
+func WithAutoAlignData() AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.autoAlignData = true
+		return nil
+	}
+}
+
+// WithStreamingOutput makes the assembler write the bytes it
+// assembles to w as they're produced, rather than into RAM, which
+// stays zero. The output starts with the first byte written.
+// If w is an io.WriterAt, gaps and backward jumps in the code (for
+// example, from org) are written at the right offset. Otherwise
+// gaps are filled with zeros, and code can't go backwards.
+func WithStreamingOutput(w io.Writer) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.stream = w
+		return nil
+	}
+}
+
+// WithPeepholeAdvice makes the assembler report a diagnostic for
+// each instruction that has a shorter or faster alternative, for
+// example ld a, 0 which could be xor a.
+func WithPeepholeAdvice() AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.peepholes = true
+		return nil
+	}
+}
+
+// WithComputeLabelsFirst speeds up pass 0, which computes the
+// label addresses, by caching the length of each form of
+// instruction rather than fully assembling every instruction.
+// The labels are the same as without the option.
+func WithComputeLabelsFirst() AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.computeLabelsFirst = true
+		return nil
+	}
+}
+
+// WithRequiredLabels makes assembly fail if any of the named
+// labels aren't defined, for example the entrypoint main.
+func WithRequiredLabels(names ...string) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.requiredLabels = append(a.requiredLabels, names...)
+		return nil
+	}
+}
+
+// DefaultMaxExprDepth is how deeply expressions may be nested,
+// unless changed with WithMaxExprDepth.
+const DefaultMaxExprDepth = 256
+
+// WithMaxExprDepth sets how deeply expressions may be nested,
+// for example with brackets or unary operators.
+func WithMaxExprDepth(n int) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		if n < 1 {
+			return fmt.Errorf("expression depth %d should be at least 1", n)
+		}
+		a.maxExprDepth = n
+		return nil
+	}
+}
+
+// WithLabelPrefix adds the given prefix to the names of all
+// labels defined, so that the labels from separately assembled
+// modules don't collide. Within the module, and when using
+// GetLabel, labels may be referred to without the prefix.
+func WithLabelPrefix(prefix string) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.labelPrefix = prefix
+		return nil
+	}
+}
+
+// Strict makes it an error to use undocumented instructions,
+// such as sll and those that use ixh, ixl, iyh and iyl, if on
+// is true.
+func Strict(on bool) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.strict = on
+		return nil
+	}
+}
+
+// WithRAM makes the assembler write into buf, rather than
+// allocating 64k of RAM, so that a buffer can be reused. Bytes
+// that aren't assembled keep their values, and it's an error to
+// write past the end of buf.
+func WithRAM(buf []uint8) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		if len(buf) == 0 {
+			return fmt.Errorf("the RAM buffer is empty")
+		}
+		a.ram = buf
+		return nil
+	}
+}
+
+// WithIncludeDir makes the assembler look for included files in
+// dir, if they aren't found relative to the current directory.
+func WithIncludeDir(dir string) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.includeDir = dir
+		return nil
+	}
+}
+
 // NewAssembler constructs a new assembler.
 // By default, the assembler will assemble code starting at address
 // 0x8000.
 func NewAssembler(opts ...AssemblerOpt) (*Assembler, error) {
-	var aopt assemblerOption
+	aopt := assemblerOption{maxExprDepth: DefaultMaxExprDepth}
 	for _, opt := range opts {
 		if err := opt(&aopt); err != nil {
 			return nil, err
@@ -99,6 +403,9 @@ func NewAssembler(opts ...AssemblerOpt) (*Assembler, error) {
 	if aopt.core > 0 {
 		cmd0s = append(cmd0s, commands0argNext1)
 		cmds = append(cmds, commandsArgsNext1)
+		for k, v := range nextDirectiveTable {
+			cmdTable[k] = v
+		}
 	}
 	if aopt.core > 1 {
 		cmds = append(cmds, commandsArgsNext2)
@@ -120,16 +427,55 @@ func NewAssembler(opts ...AssemblerOpt) (*Assembler, error) {
 		cmdTable[c0] = commandAssembler{c0, os}
 	}
 
+	ram := aopt.ram
+	if ram == nil {
+		ram = make([]uint8, 64*1024)
+	}
 	a := &Assembler{
-		commandTable: cmdTable,
-		opener:       openFile,
-		pc:           0x8000,
-		target:       0x8000,
-		l:            make(map[string]uint16),
-		consts:       make(map[string]int64),
-		constsDef:    make(map[string]bool),
-		labelAssign:  make(map[string]string),
-		m:            make([]uint8, 64*1024),
+		commandTable:  cmdTable,
+		opener:        openFile,
+		pc:            0x8000,
+		target:        0x8000,
+		l:             make(map[string]uint16),
+		consts:        make(map[string]int64),
+		predefined:    make(map[string]int64),
+		tlabels:       make(map[string]bool),
+		constsDef:     make(map[string]bool),
+		labelAssign:   make(map[string]string),
+		labelTarget:   make(map[string]int),
+		labelUsed:     make(map[string]bool),
+		labelsDef:     make(map[string]bool),
+		macros:        make(map[string]*macro),
+		localLabels:   make(map[string]bool),
+		m:             ram,
+		fixedRAM:      aopt.ram != nil,
+		passHooks:     aopt.passHooks,
+		autoAlignData: aopt.autoAlignData,
+		peepholes:     aopt.peepholes,
+
+		computeLabelsFirst: aopt.computeLabelsFirst,
+		lengths:            make(map[string]int),
+
+		requiredLabels: aopt.requiredLabels,
+		labelPrefix:    aopt.labelPrefix,
+		maxExprDepth:   aopt.maxExprDepth,
+		strict:         aopt.strict,
+	}
+	a.predefined["__CORE__"] = int64(aopt.core)
+	if aopt.core > 0 {
+		for k, v := range nextPorts {
+			a.predefined[k] = v
+		}
+	}
+	if aopt.stream != nil {
+		a.stream = &streamWriter{w: aopt.stream}
+	}
+	if aopt.includeDir != "" {
+		a.opener = dirOpener(aopt.includeDir)
+	}
+
+	if aopt.listing != nil {
+		a.listing = &lister{w: aopt.listing}
 	}
 	return a, nil
 }
@@ -138,30 +484,273 @@ func (asm *Assembler) RAM() []uint8 {
 	return asm.m
 }
 
+// WrittenRange returns the range of RAM that the assembler
+// has written to, as [start, end). Bytes in the range that were
+// skipped over (for example, by org) are included.
+// If nothing has been written, start and end are both 0.
+func (asm *Assembler) WrittenRange() (start, end int) {
+	if !asm.written {
+		return 0, 0
+	}
+	return asm.minWritten, asm.maxWritten + 1
+}
+
+// isWritten reports whether the assembler has written to
+// the given target.
+func (asm *Assembler) isWritten(target int) bool {
+	if target < 0 || target/64 >= len(asm.writtenBits) {
+		return false
+	}
+	return asm.writtenBits[target/64]&(1<<uint(target%64)) != 0
+}
+
+// BytesWritten returns the number of bytes of RAM that the
+// assembler has written to. Unlike the size of WrittenRange,
+// bytes skipped over (for example, by org) aren't counted.
+// It is only valid after the assembler has run.
+func (asm *Assembler) BytesWritten() int {
+	n := 0
+	for _, w := range asm.writtenBits {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// Gaps returns the ranges of RAM in [start, end) that the
+// assembler hasn't written to, each as [start, end), in order.
+// For example, bytes skipped over by org are in a gap, but bytes
+// written by ds are not. It is only valid after the assembler
+// has run.
+func (asm *Assembler) Gaps(start, end int) [][2]int {
+	var r [][2]int
+	for i := start; i < end; i++ {
+		if asm.isWritten(i) {
+			continue
+		}
+		if n := len(r); n > 0 && r[n-1][1] == i {
+			r[n-1][1] = i + 1
+		} else {
+			r = append(r, [2]int{i, i + 1})
+		}
+	}
+	return r
+}
+
+// FillGaps sets the bytes of RAM in the written range that
+// weren't written, for example because they were skipped over
+// by org, to fill. Bytes that were written keep their values,
+// even if they're zero. It is only valid after the assembler
+// has run.
+func (asm *Assembler) FillGaps(fill uint8) {
+	start, end := asm.WrittenRange()
+	for _, g := range asm.Gaps(start, end) {
+		for i := g[0]; i < g[1]; i++ {
+			asm.m[i] = fill
+		}
+	}
+}
+
 // AssembleFile reads the named file, and assembles it as z80
 // instructions.
 func (asm *Assembler) AssembleFile(filename string) error {
+	return asm.assembleSource(filename, asm.fileSource(filename))
+}
+
+// AssembleReader assembles the source read from r, as if it were
+// the contents of the named file. Files it includes are opened as
+// usual.
+func (asm *Assembler) AssembleReader(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %v", name, err)
+	}
+	return asm.assembleSource(name, asm.textSource(name, data))
+}
+
+// fileSource returns a function that pushes a scanner for
+// the named file.
+func (asm *Assembler) fileSource(filename string) func() error {
+	return func() error {
+		return asm.pushScanner(filename)
+	}
+}
+
+// textSource returns a function that pushes a scanner that
+// reads data, with errors reported as coming from name. Since
+// each pass reads the source again, data is held in memory.
+func (asm *Assembler) textSource(name string, data []byte) func() error {
+	return func() error {
+		if asm.pass == 1 {
+			asm.addSourceFile(name)
+		}
+		asm.pushReader(name, ioutil.NopCloser(bytes.NewReader(data)))
+		return nil
+	}
+}
+
+// assembleSource runs the passes of the assembler, with push
+// making the top-level source the current scanner.
+func (asm *Assembler) assembleSource(filename string, push func() error) error {
 	pc := asm.pc
 	target := asm.target
 	defer func() {
 		asm.pc = pc
 		asm.target = target
 	}()
-	for pass := 0; pass < 2; pass++ {
-		asm.pc = pc
-		asm.target = target
-		asm.pass = pass
-		asm.currentMajorLabel = ""
-		// Reset the map that says whether we've seen a const.
-		// We use this to prevent use of const before definition.
-		asm.constsDef = make(map[string]bool)
-		if err := asm.assembleFile(filename); pass == 1 && err != nil {
-			return err
+	// Errors in the first pass are found again, and
+	// reported, by the final pass.
+	settled, _ := asm.runFirstPass(filename, push, pc, target)
+	err := asm.runPass(filename, push, 1, pc, target)
+	if !settled {
+		// The final pass says which label moved.
+		if err != nil {
+			return fmt.Errorf("%v\n%v", errUnsettled, err)
+		}
+		return errUnsettled
+	}
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, name := range asm.requiredLabels {
+		if _, ok := asm.GetLabel("", name); !ok {
+			missing = append(missing, fmt.Sprintf("missing required label %q", name))
 		}
 	}
+	if len(missing) > 0 {
+		return errors.New(strings.Join(missing, "\n"))
+	}
+	if asm.listing != nil && asm.listing.err != nil {
+		return fmt.Errorf("failed to write listing: %v", asm.listing.err)
+	}
+	if asm.stream != nil {
+		return asm.stream.flush()
+	}
 	return nil
 }
 
+// runPass assembles the named file starting at pc and target,
+// with push making it the current scanner.
+func (asm *Assembler) runPass(filename string, push func() error, pass int, pc, target int) error {
+	asm.pc = pc
+	asm.target = target
+	asm.pass = pass
+	asm.provisionalOrg = false
+	asm.phased = false
+	asm.regionKind = RegionNone
+	asm.condCount = 0
+	asm.resetMacros()
+	asm.currentMajorLabel = ""
+	// Reset the map that says whether we've seen a const.
+	// We use this to prevent use of const before definition.
+	asm.constsDef = make(map[string]bool)
+	for k, v := range asm.predefined {
+		asm.consts[k] = v
+		asm.constsDef[k] = true
+	}
+	asm.labelsDef = make(map[string]bool)
+	if asm.listing != nil {
+		asm.listing.active = pass == 1
+	}
+	asm.callPassHooks(pass, PassStart)
+	err := asm.assembleFile(filename, push)
+	asm.callPassHooks(pass, PassEnd)
+	if asm.listing != nil {
+		asm.listing.active = false
+	}
+	return err
+}
+
+// maxFirstPasses is the most times that the first pass is run
+// while the labels are still moving.
+const maxFirstPasses = 10
+
+var errUnsettled = fmt.Errorf("the labels didn't settle after %d passes: an org, ds, fill_to, rept or if depends on a label that it moves", maxFirstPasses)
+
+// runFirstPass runs pass 0, which finds the labels. If an org (or
+// ds, fill_to, rept or if) used a label that wasn't yet defined,
+// the labels after it may be wrong, so pass 0 is run again with
+// the labels found so far, until they stop moving. It reports
+// whether they settled, and the error from the last run.
+func (asm *Assembler) runFirstPass(filename string, push func() error, pc, target int) (bool, error) {
+	err := asm.runPass(filename, push, 0, pc, target)
+	if !asm.provisionalOrg {
+		return true, err
+	}
+	for i := 1; i < maxFirstPasses; i++ {
+		before := asm.labelLayout()
+		err = asm.runPass(filename, push, 0, pc, target)
+		if sameLayout(before, asm.labelLayout()) {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+// labelLayout returns the pc and target of each label, and the
+// value of each tlabel.
+func (asm *Assembler) labelLayout() map[string][2]int {
+	r := make(map[string][2]int, len(asm.l)+len(asm.tlabels))
+	for k, v := range asm.l {
+		r[k] = [2]int{int(v), asm.labelTarget[k]}
+	}
+	for k := range asm.tlabels {
+		r["tlabel "+k] = [2]int{int(asm.consts[k]), 0}
+	}
+	return r
+}
+
+func sameLayout(a, b map[string][2]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelInfo describes where a label is defined.
+type LabelInfo struct {
+	Name string // the full name, for example major.minor for minor labels
+	File string
+	Line int
+	Addr uint16
+}
+
+// CollectLabels finds the labels defined in the named file (and
+// the files it includes) without fully assembling it: only the
+// first pass is run, and no bytes are written. The labels are
+// returned in the order they're defined. If there's an error,
+// the labels found are returned with it.
+func (asm *Assembler) CollectLabels(filename string) ([]LabelInfo, error) {
+	pc := asm.pc
+	target := asm.target
+	defer func() {
+		asm.pc = pc
+		asm.target = target
+	}()
+	push := asm.fileSource(filename)
+	settled, err := asm.runFirstPass(filename, push, pc, target)
+	if err == nil && !settled {
+		err = errUnsettled
+	}
+	var r []LabelInfo
+	for _, li := range asm.labelDefs {
+		li.Addr = asm.l[li.Name]
+		r = append(r, li)
+	}
+	return r, err
+}
+
+func (asm *Assembler) callPassHooks(pass int, phase PassPhase) {
+	for _, f := range asm.passHooks {
+		f(pass, phase)
+	}
+}
+
 func endStatement(t token) bool {
 	return t.t == ';' || t.t == scanner.EOF || t.t == '\n'
 }
@@ -173,6 +762,16 @@ func (asm *Assembler) popScanner() (bool, error) {
 	asm.closers = asm.closers[:len(asm.closers)-1]
 	asm.scanners = asm.scanners[:len(asm.scanners)-1]
 	asm.openFiles = asm.openFiles[:len(asm.openFiles)-1]
+	onPop := asm.onPop[len(asm.onPop)-1]
+	asm.onPop = asm.onPop[:len(asm.onPop)-1]
+	asm.listPop()
+	// onPop may push another source, so it's called once
+	// the finished source is off the stacks.
+	if onPop != nil {
+		if err := onPop(); err != nil {
+			return true, err
+		}
+	}
 	return len(asm.scanners) == 0, nil
 }
 
@@ -186,23 +785,54 @@ func (asm *Assembler) pushScanner(filename string) error {
 	if err != nil {
 		return fmt.Errorf("failed to assemble %q: %v", filename, err)
 	}
+	if asm.pass == 1 {
+		asm.addSourceFile(filename)
+	}
+	asm.pushReader(filename, f)
+	return nil
+}
+
+func (asm *Assembler) addSourceFile(filename string) {
+	for _, f := range asm.sourceFiles {
+		if f == filename {
+			return
+		}
+	}
+	asm.sourceFiles = append(asm.sourceFiles, filename)
+}
+
+// SourceFiles returns the names of the files that were assembled,
+// including included files, in the order they were first read.
+// It is only valid after the assembler has run.
+func (asm *Assembler) SourceFiles() []string {
+	return append([]string{}, asm.sourceFiles...)
+}
 
+// pushReader makes f the current source, with errors reported
+// as coming from filename.
+func (asm *Assembler) pushReader(filename string, f io.ReadCloser) {
 	asm.openFiles = append(asm.openFiles, filename)
+	f = asm.listReader(f)
 	var scan scanner.Scanner
 	scan.Init(f)
 	scan.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanChars | scanner.ScanStrings | scanner.ScanRawStrings | scanner.ScanComments | scanner.SkipComments
 	scan.Whitespace = (1 << ' ') | (1 << '\t')
 	scan.Position.Filename = filename
 	scan.Error = func(s *scanner.Scanner, msg string) {
+		// Escapes are checked when strings and chars are parsed,
+		// so that dspec can use \{...} wherever it appears.
+		if msg == "invalid char escape" {
+			return
+		}
 		asm.scanErr = asm.scanErrorf("%s", msg)
 	}
 	asm.scanners = append(asm.scanners, &scan)
 	asm.closers = append(asm.closers, f)
-	return nil
+	asm.onPop = append(asm.onPop, nil)
 }
 
-func (asm *Assembler) assembleFile(filename string) error {
-	err := asm.pushScanner(filename)
+func (asm *Assembler) assembleFile(filename string, push func() error) error {
+	err := push()
 	if err != nil {
 		return err
 	}
@@ -218,6 +848,19 @@ func (asm *Assembler) assembleFile(filename string) error {
 			break
 		}
 	}
+	if asm.scanErr != nil && len(errs) == 0 {
+		errs = append(errs, asm.scanErr.Error())
+	}
+	if len(asm.conds) > 0 && len(errs) == 0 {
+		errs = append(errs, fmt.Sprintf("%s: if without endif", filename))
+	}
+	asm.conds = nil
+	// Errors may have stopped assembly part way through
+	// the files, so clean up for the next pass.
+	for len(asm.scanners) > 0 {
+		asm.popScanner()
+	}
+	asm.scanErr = nil
 	if len(errs) > 0 {
 		return errors.New(strings.Join(errs, "\n"))
 	}
@@ -319,6 +962,15 @@ func (asm *Assembler) assemble() error {
 		if err != nil {
 			return err
 		}
+		if tok.t != scanner.EOF {
+			asm.listStatement()
+		}
+		if asm.skipping() && tok.t != scanner.EOF {
+			if err := asm.skipOrAssemble(tok); err != nil {
+				return err
+			}
+			continue
+		}
 		switch tok.t {
 		case scanner.EOF:
 			done, err := asm.popScanner()
@@ -329,8 +981,27 @@ func (asm *Assembler) assemble() error {
 				return nil
 			}
 		case scanner.Ident:
-			// Might be a command
-			if f, ok := asm.commandTable[strings.ToLower(tok.s)]; ok {
+			// A name followed by a ':' is a label, even if it's
+			// also the name of a command, such as data: or table:.
+			if asm.peekNonSpace() == ':' {
+				if _, err := asm.nextToken(); err != nil {
+					return err
+				}
+				if err := asm.setLabel(tok.s, 0); err != nil {
+					return err
+				}
+				continue
+			}
+			// Might be a command. Commands like db! have a strict
+			// variant whose name ends with !.
+			cmd := strings.ToLower(tok.s)
+			if _, ok := asm.commandTable[cmd+"!"]; ok && asm.scan().Peek() == '!' {
+				asm.scan().Next()
+				cmd += "!"
+			}
+			asm.statementPC = asm.pc
+			if f, ok := asm.commandTable[cmd]; ok {
+				asm.commands++
 				if err := f.W(asm); err != nil {
 					return err
 				}
@@ -343,6 +1014,13 @@ func (asm *Assembler) assemble() error {
 			if err != nil {
 				return err
 			}
+			// name equ value defines a const.
+			if tok.t == scanner.Ident && strings.ToLower(tok.s) == "equ" {
+				if err := asm.assembleEqu(labName); err != nil {
+					return err
+				}
+				continue
+			}
 			if tok.t != ':' {
 				return asm.scanErrorf("unknown command %s", labName)
 			}
@@ -365,19 +1043,56 @@ func (asm *Assembler) assemble() error {
 }
 
 func (asm *Assembler) writeByte(u uint8) error {
-	if int(asm.target) >= len(asm.m) {
-		newLen := (asm.target + 16*1024 - 1) / (16 * 1024) * 16 * 1024
-		asm.m = append(asm.m, make([]uint8, newLen-len(asm.m))...)
-	}
 	if asm.pc >= 64*1024 || asm.pc < 0 {
 		return fmt.Errorf("pc out of range: %x", asm.pc)
 	}
-	asm.m[asm.target] = u
+	// Only the final pass writes, since addresses in
+	// pass 0 may be provisional.
+	if asm.pass == 1 {
+		if err := asm.storeByte(u); err != nil {
+			return err
+		}
+		asm.listByte(u)
+	}
 	asm.pc++
 	asm.target++
 	return nil
 }
 
+// storeByte stores u at the current target.
+func (asm *Assembler) storeByte(u uint8) error {
+	if asm.stream != nil {
+		if err := asm.stream.writeByte(asm.target, u); err != nil {
+			return asm.scanErrorf("%v", err)
+		}
+	} else {
+		if asm.fixedRAM && asm.target >= len(asm.m) {
+			return asm.scanErrorf("target %#x is past the end of the %d byte RAM buffer", asm.target, len(asm.m))
+		}
+		if int(asm.target) >= len(asm.m) {
+			newLen := (asm.target + 16*1024) / (16 * 1024) * 16 * 1024
+			asm.m = append(asm.m, make([]uint8, newLen-len(asm.m))...)
+		}
+		asm.m[asm.target] = u
+	}
+	if asm.regionKind != RegionNone {
+		asm.addToRegion()
+	}
+	for asm.target/64 >= len(asm.writtenBits) {
+		asm.writtenBits = append(asm.writtenBits, 0)
+	}
+	asm.writtenBits[asm.target/64] |= 1 << uint(asm.target%64)
+	if !asm.written || asm.target < asm.minWritten {
+		asm.minWritten = asm.target
+	}
+	if !asm.written || asm.target > asm.maxWritten {
+		asm.maxWritten = asm.target
+		asm.maxWrittenPC = asm.pc
+	}
+	asm.written = true
+	return nil
+}
+
 func (asm *Assembler) writeBytes(bs []byte) error {
 	for _, b := range bs {
 		if err := asm.writeByte(b); err != nil {
@@ -390,46 +1105,229 @@ func (asm *Assembler) writeBytes(bs []byte) error {
 // GetLabel returns the value of the given label.
 // It is only valid after the assembler has run.
 func (asm *Assembler) GetLabel(majLabel, l string) (uint16, bool) {
+	_, v, ok := asm.lookupLabel(majLabel, l)
+	return v, ok
+}
+
+// lookupLabel is like GetLabel, but also returns the
+// full name of the label found.
+func (asm *Assembler) lookupLabel(majLabel, l string) (string, uint16, bool) {
+	p := asm.labelPrefix
 	if strings.HasPrefix(l, ".") {
-		v, ok := asm.l[majLabel+l]
-		return v, ok
+		v, ok := asm.l[p+majLabel+l]
+		return p + majLabel + l, v, ok
 	}
-	v, ok := asm.l[majLabel+"."+l]
-	if ok {
-		return v, ok
+	if v, ok := asm.l[p+majLabel+"."+l]; ok {
+		return p + majLabel + "." + l, v, ok
 	}
-	v, ok = asm.l[l]
-	return v, ok
+	if v, ok := asm.l[p+l]; ok || p == "" {
+		return p + l, v, ok
+	}
+	// The label may be given with its prefix.
+	v, ok := asm.l[l]
+	return l, v, ok
 }
 
-// GetConst returns the value of the given const.
+// UnusedLabels returns the labels that are defined but never
+// used in an expression, in sorted order. The entrypoint
+// (main: or a top-level .main) is never reported.
 // It is only valid after the assembler has run.
-func (asm *Assembler) GetConst(c string) (int64, bool, error) {
-	if !asm.constsDef[c] {
-		if _, ok := asm.consts[c]; ok {
-			return 0, false, asm.scanErrorf("use of const %q before definition", c)
+func (asm *Assembler) UnusedLabels() []string {
+	var r []string
+	for l := range asm.l {
+		if l != asm.labelPrefix+"main" && l != asm.labelPrefix+".main" && !asm.labelUsed[l] {
+			r = append(r, l)
 		}
-		return 0, false, nil
 	}
-	v, ok := asm.consts[c]
-	return v, ok, nil
+	sort.Strings(r)
+	return r
 }
 
-type cmdData arg
+// SymbolCounts returns the number of labels, including minor
+// labels, and the number of consts that were defined.
+// Predefined consts, such as the Next's ports, aren't counted.
+// It is only valid after the assembler has run.
+func (asm *Assembler) SymbolCounts() (labels, consts int) {
+	for k := range asm.consts {
+		if _, ok := asm.predefined[k]; !ok {
+			consts++
+		}
+	}
+	return len(asm.l), consts
+}
 
-func (n cmdData) W(asm *Assembler) error {
-	args, err := asm.parseArgs(true)
-	if err != nil {
-		return err
+// SymbolTable returns a copy of all the labels and their values.
+// Minor labels are included with their full names, for example
+// "main.loop".
+// It is only valid after the assembler has run.
+func (asm *Assembler) SymbolTable() map[string]uint16 {
+	r := make(map[string]uint16, len(asm.l))
+	for k, v := range asm.l {
+		r[k] = v
 	}
-	for _, arg0 := range args {
-		bs, ok, err := arg0.evalAs(asm, arg(n), false)
+	return r
+}
+
+// Constants returns a copy of all the consts and their values.
+// Predefined consts, such as the Next's ports, aren't included.
+// It is only valid after the assembler has run.
+func (asm *Assembler) Constants() map[string]int64 {
+	r := make(map[string]int64, len(asm.consts))
+	for k, v := range asm.consts {
+		if _, ok := asm.predefined[k]; !ok {
+			r[k] = v
+		}
+	}
+	return r
+}
+
+// GetConst returns the value of the given const.
+// It is only valid after the assembler has run.
+func (asm *Assembler) GetConst(c string) (int64, bool, error) {
+	if !asm.constsDef[c] {
+		// Like a label, a tlabel has its value from the
+		// first pass.
+		if v, ok := asm.consts[c]; ok && asm.tlabels[c] {
+			return v, true, nil
+		}
+		if _, ok := asm.consts[c]; ok {
+			return 0, false, asm.scanErrorf("use of const %q before definition", c)
+		}
+		return 0, false, nil
+	}
+	v, ok := asm.consts[c]
+	return v, ok, nil
+}
+
+type cmdData arg
+
+func (n cmdData) W(asm *Assembler) error {
+	if asm.autoAlignData && (arg(n) == const16 || arg(n) == const16be) && asm.pc%2 != 0 {
+		asm.diagf("inserted a pad byte at %04x to align data", asm.pc)
+		if err := asm.writeByte(0); err != nil {
+			return err
+		}
+	}
+	// Each argument is written as soon as it's parsed, so that
+	// long lists of data don't have to be held in memory.
+	// reserveArgs are the arguments of ds count, fill, which
+	// reserves space rather than writing strings.
+	var reserveArgs []expr
+	first := true
+	err := asm.forEachArg(',', true, func(arg0 expr) error {
+		if first && arg(n) == argstring {
+			// Anything but a string is a count, even if it
+			// can't be computed yet.
+			if _, ok := arg0.(exprString); !ok {
+				reserveArgs = []expr{arg0}
+			}
+		} else if reserveArgs != nil {
+			reserveArgs = append(reserveArgs, arg0)
+		}
+		first = false
+		if reserveArgs != nil {
+			return nil
+		}
+		return n.writeArg(asm, arg0)
+	})
+	if err != nil {
+		return err
+	}
+	if reserveArgs != nil {
+		return asm.reserve(reserveArgs)
+	}
+	return nil
+}
+
+// writeArg writes a single argument of a data directive.
+func (n cmdData) writeArg(asm *Assembler, arg0 expr) error {
+	count := int64(1)
+	if d, ok := arg0.(exprDup); ok && arg(n) != argstring {
+		c, ok, err := getIntValue(asm, d.n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return asm.scanErrorf("dup count should be a number, found %s", d.n)
+		}
+		if c < 0 || c > 65535 {
+			return asm.scanErrorf("dup count %d is not in the range 0...65535", c)
+		}
+		count, arg0 = c, d.e
+	}
+	if arg(n) == constU8 {
+		// Report the expression, since strict data is
+		// often computed.
+		if v, ok, err := getIntValue(asm, arg0); err == nil && ok {
+			if min, max, _ := argRange(constU8); v < min || v > max {
+				return asm.scanErrorf("%s = %d is not in the range %d...%d", arg0, v, min, max)
+			}
+		}
+	}
+	asm.pendingReloc = nil
+	bs, ok, err := arg0.evalAs(asm, arg(n), false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("bad data value: %s", arg0)
+	}
+	reloc := asm.pendingReloc
+	for i := int64(0); i < count; i++ {
+		asm.addReloc(reloc)
+		if err := asm.writeBytes(bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserve writes count bytes of fill (by default 0), from
+// the arguments of ds count or ds count, fill.
+func (asm *Assembler) reserve(args []expr) error {
+	if len(args) > 2 {
+		return asm.scanErrorf("expected syntax: ds <count>, <fill>, got: ds %v", args)
+	}
+	asm.unresolved = false
+	count, ok, err := getIntValue(asm, args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("ds count should be a number, found %s", args[0])
+	}
+	if asm.pass == 0 && asm.unresolved {
+		// Like org, the labels after this are provisional
+		// until the count is known.
+		asm.provisionalOrg = true
+		count = 0
+	}
+	if count < 0 || count > 65535 {
+		return asm.scanErrorf("ds count %d is not in the range 0...65535", count)
+	}
+	var fill expr
+	if len(args) == 2 {
+		fill = args[1]
+	}
+	return asm.writeFill(count, fill)
+}
+
+// writeFill writes count copies of the byte fill, or 0s if
+// fill is nil.
+func (asm *Assembler) writeFill(count int64, fill expr) error {
+	bs := []byte{0}
+	if fill != nil {
+		var ok bool
+		var err error
+		bs, ok, err = fill.evalAs(asm, const8, false)
 		if err != nil {
 			return err
 		}
 		if !ok {
-			return asm.scanErrorf("bad data value: %s", arg0)
+			return asm.scanErrorf("bad fill value: %s", fill)
 		}
+	}
+	for i := int64(0); i < count; i++ {
 		if err := asm.writeBytes(bs); err != nil {
 			return err
 		}
@@ -437,11 +1335,129 @@ func (n cmdData) W(asm *Assembler) error {
 	return nil
 }
 
+type commandFillTo struct{}
+
+// W for fill_to writes fill bytes (by default 0) up to, but
+// not including, addr: fill_to addr or fill_to addr, fill.
+func (commandFillTo) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return asm.scanErrorf("expected syntax: fill_to <addr>, <fill>, got: fill_to %v", args)
+	}
+	asm.unresolved = false
+	addr, ok, err := getIntValue(asm, args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("fill_to address should be a number, found %s", args[0])
+	}
+	if asm.pass == 0 && asm.unresolved {
+		// Like org, the labels after this are provisional
+		// until the address is known.
+		asm.provisionalOrg = true
+		return nil
+	}
+	if addr > 0x10000 {
+		return asm.scanErrorf("fill_to address %#x is past 0x10000", addr)
+	}
+	if int64(asm.pc) > addr {
+		return asm.scanErrorf("fill_to %#04x: the pc is already at %#04x", addr, asm.pc)
+	}
+	var fill expr
+	if len(args) == 2 {
+		fill = args[1]
+	}
+	return asm.writeFill(addr-int64(asm.pc), fill)
+}
+
+type cmdStringZ struct{}
+
+// W for dz writes each string followed by a 0 byte.
+func (cmdStringZ) W(asm *Assembler) error {
+	args, err := asm.parseArgs(true)
+	if err != nil {
+		return err
+	}
+	for _, arg0 := range args {
+		bs, ok, err := arg0.evalAs(asm, argstring, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return asm.scanErrorf("dz expects strings, found %s", arg0)
+		}
+		if err := asm.writeBytes(append(bs, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cmdHex struct{}
+
+// W for dbhex writes the bytes given by each string of pairs
+// of hex digits, which may be separated by whitespace.
+func (cmdHex) W(asm *Assembler) error {
+	args, err := asm.parseArgs(true)
+	if err != nil {
+		return err
+	}
+	for _, arg0 := range args {
+		bs, ok, err := arg0.evalAs(asm, argstring, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return asm.scanErrorf("dbhex expects strings, found %s", arg0)
+		}
+		digits := strings.Join(strings.Fields(string(bs)), "")
+		if len(digits)%2 != 0 {
+			return asm.scanErrorf("dbhex string %s has an odd number of hex digits", arg0)
+		}
+		data, err := hex.DecodeString(digits)
+		if err != nil {
+			return asm.scanErrorf("dbhex string %s isn't hex: %v", arg0, err)
+		}
+		if err := asm.writeBytes(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Reloc records that the 16-bit address of a label was written
+// into memory, so that a linker could move the code.
+type Reloc struct {
+	Addr  int    // where in memory the address (low byte first) is
+	Label string // the full name of the label
+}
+
+// addReloc records r, with r.Addr relative to the current target.
+func (asm *Assembler) addReloc(r *Reloc) {
+	if r != nil {
+		asm.relocs = append(asm.relocs, Reloc{Addr: asm.target + r.Addr, Label: r.Label})
+	}
+}
+
+// Relocations returns the places where the address of a label
+// was written as a 16-bit value, in the order they were written.
+// Only values that are a single label are recorded: for example
+// ld hl, label or dw label, but not ld hl, label+1.
+// It is only valid after the assembler has run.
+func (asm *Assembler) Relocations() []Reloc {
+	return append([]Reloc{}, asm.relocs...)
+}
+
 type instrAssembler interface {
 	W(a *Assembler) error
 }
 
 func (asm *Assembler) argsCompatible(vals []expr, a arg) ([]byte, bool, error) {
+	asm.pendingReloc = nil
 	if len(vals) != argLen(a) {
 		return nil, false, nil
 	}
@@ -456,6 +1472,8 @@ func (asm *Assembler) argsCompatible(vals []expr, a arg) ([]byte, bool, error) {
 		if !ok {
 			return nil, false, nil
 		}
+		reloc0 := asm.pendingReloc
+		asm.pendingReloc = nil
 		a1, ok, err := vals[1].evalAs(asm, a%1024, true)
 		if err != nil {
 			return nil, false, err
@@ -463,16 +1481,63 @@ func (asm *Assembler) argsCompatible(vals []expr, a arg) ([]byte, bool, error) {
 		if !ok {
 			return nil, false, nil
 		}
+		if asm.pendingReloc != nil {
+			asm.pendingReloc.Addr = len(a0)
+		} else {
+			asm.pendingReloc = reloc0
+		}
 		return append(a0, a1...), true, nil
 	}
 	return vals[0].evalAs(asm, a, true)
 }
 
 func (ca commandAssembler) W(asm *Assembler) error {
-	vals, err := asm.parseArgs(false)
-	if err != nil {
-		return err
+	var vals []expr
+	if _, ok := ca.args[void]; ok && len(ca.args) == 1 {
+		// For instructions without arguments, anything following
+		// is likely garbage rather than a wrongly-written argument.
+		tok, err := asm.nextToken()
+		if err != nil {
+			return err
+		}
+		if !endStatement(tok) {
+			return asm.scanErrorf("unexpected %s after instruction", tok)
+		}
+	} else {
+		var err error
+		vals, err = asm.parseArgs(false)
+		if err != nil {
+			return err
+		}
 	}
+	// in f, (c) is another way to write in (c), which
+	// reads from the port but only sets the flags.
+	if ca.cmd == "in" && len(vals) == 2 {
+		if id, ok := vals[0].(exprIdent); ok && strings.EqualFold(id.id, "f") {
+			vals = vals[1:]
+		}
+	}
+	// The bit index is a fixed argument, so an index that's out
+	// of range wouldn't match any form.
+	if (ca.cmd == "bit" || ca.cmd == "res" || ca.cmd == "set") && len(vals) > 0 {
+		n, ok, err := getIntValue(asm, vals[0])
+		if err != nil {
+			return err
+		}
+		if ok && (n < 0 || n > 7) {
+			return asm.scanErrorf("bit index must be 0..7, got %d", n)
+		}
+	}
+	var shape string
+	if asm.pass == 0 && asm.computeLabelsFirst {
+		shape = ca.cmd + " " + argsShape(vals)
+		if n, ok := asm.lengths[shape]; ok {
+			// Pass 0 doesn't store bytes, so only the
+			// length matters.
+			return asm.writeBytes(make([]byte, n))
+		}
+	}
+	startPC := asm.pc
 	found := false
 	for argVariant, bs := range ca.args {
 		argData, ok, err := asm.argsCompatible(vals, argVariant)
@@ -484,6 +1549,10 @@ func (ca commandAssembler) W(asm *Assembler) error {
 				log.Fatalf("more than one variant of %s possible: args %#v, found alt variant %s", ca.cmd, vals, argVariant)
 			}
 			found = true
+			if _, ok := undocumented[ca.cmd][argVariant]; ok && asm.strict {
+				return asm.scanErrorf("%s %s is an undocumented instruction, which isn't allowed in strict mode", ca.cmd, argVariant)
+			}
+			reloc := asm.pendingReloc
 			// Longer instructions (bit operations on ix or iy)
 			// interleave the fixed part of the instruction with
 			// the variable part.
@@ -492,15 +1561,20 @@ func (ca commandAssembler) W(asm *Assembler) error {
 			if n > 2 {
 				n = 2
 			}
+			pc := asm.pc
 			if err := asm.writeBytes(bs[:n]); err != nil {
 				return err
 			}
+			asm.addReloc(reloc)
 			if err := asm.writeBytes(argData); err != nil {
 				return err
 			}
 			if err := asm.writeBytes(bs[n:]); err != nil {
 				return err
 			}
+			if asm.peepholes {
+				asm.peephole(pc, append(append(append([]byte{}, bs[:n]...), argData...), bs[n:]...))
+			}
 		}
 	}
 	if !found {
@@ -510,6 +1584,9 @@ func (ca commandAssembler) W(asm *Assembler) error {
 		}
 		return asm.scanErrorf("no suitable form of %s found that matches %s %s", ca.cmd, ca.cmd, strings.Join(vs, ", "))
 	}
+	if shape != "" {
+		asm.lengths[shape] = asm.pc - startPC
+	}
 
 	return nil
 }
@@ -542,19 +1619,161 @@ func getString(e expr) (string, error) {
 	return "", fmt.Errorf("expected string, got %v", e)
 }
 
+// W for include assembles the named file. With the form
+// include "filename.asm" at addr, the file is assembled at addr,
+// and the pc and target are restored afterwards.
 func (commandInclude) W(asm *Assembler) error {
+	arg, tok, err := asm.parseExpression(0, false)
+	if err != nil {
+		return err
+	}
+	var addr expr
+	if tok.t == scanner.Ident && tok.s == "at" {
+		addr, tok, err = asm.parseExpression(0, false)
+		if err != nil {
+			return err
+		}
+	}
+	if !endStatement(tok) {
+		return asm.scanErrorf("expected \"filename.asm\" to follow include, got: %v %s", arg, tok)
+	}
+	name, err := getString(arg)
+	if err != nil {
+		return asm.scanErrorf("expected \"filename.asm\" to follow include, got: %v", arg)
+	}
+	if addr == nil {
+		return asm.pushScanner(name)
+	}
+	pc, target := asm.pc, asm.target
+	if err := asm.setOrg(addr, addr); err != nil {
+		return err
+	}
+	if err := asm.pushScanner(name); err != nil {
+		return err
+	}
+	asm.onPop[len(asm.onPop)-1] = func() error {
+		asm.pc, asm.target = pc, target
+		return nil
+	}
+	return nil
+}
+
+type commandIncbin struct{}
+
+// W for incbin writes the bytes of a binary file:
+// incbin "file"[, offset[, length]].
+func (commandIncbin) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 3 {
+		return asm.scanErrorf("expected syntax: incbin \"filename\", <offset>, <length>, got: incbin %v", args)
+	}
+	name, err := getString(args[0])
+	if err != nil {
+		return asm.scanErrorf("expected \"filename\" to follow incbin, got: %v", args[0])
+	}
+	data, err := asm.readFile("binary file", name)
+	if err != nil {
+		return err
+	}
+	var nums []int64
+	for _, a := range args[1:] {
+		n, ok, err := getIntValue(asm, a)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return asm.scanErrorf("incbin offset and length should be numbers, found %s", a)
+		}
+		if n < 0 {
+			return asm.scanErrorf("incbin offset and length should not be negative, found %s = %d", a, n)
+		}
+		nums = append(nums, n)
+	}
+	offset, length := int64(0), int64(len(data))
+	if len(nums) > 0 {
+		offset = nums[0]
+		if offset > int64(len(data)) {
+			return asm.scanErrorf("incbin offset %d is past the end of %q, which has %d bytes", offset, name, len(data))
+		}
+		length -= offset
+	}
+	if len(nums) > 1 {
+		if offset+nums[1] > int64(len(data)) {
+			return asm.scanErrorf("incbin of %d bytes at offset %d is past the end of %q, which has %d bytes", nums[1], offset, name, len(data))
+		}
+		length = nums[1]
+	}
+	return asm.writeBytes(data[offset : offset+length])
+}
+
+type commandIncludeList struct{}
+
+// readFile reads the named file using the assembler's opener.
+// kind describes the file in error messages.
+func (asm *Assembler) readFile(kind, name string) ([]byte, error) {
+	f, err := asm.opener(name)
+	if err != nil {
+		return nil, asm.scanErrorf("failed to open %s %q: %v", kind, name, err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, asm.scanErrorf("failed to read %s %q: %v", kind, name, err)
+	}
+	return data, nil
+}
+
+// W for includelist assembles each file named in the given list
+// file, in order, as if each had its own include. The list has one
+// filename per line; blank lines and lines starting with # are
+// skipped.
+func (commandIncludeList) W(asm *Assembler) error {
 	args, err := asm.parseArgs(false)
 	if err != nil {
 		return err
 	}
 	if len(args) != 1 {
-		return asm.scanErrorf("expected \"filename.asm\" to follow include, got: %v", args)
+		return asm.scanErrorf("expected \"filename\" to follow includelist, got: %v", args)
 	}
 	name, err := getString(args[0])
 	if err != nil {
-		return asm.scanErrorf("expected \"filename.asm\" to follow include, got: %v", args[0])
+		return asm.scanErrorf("expected \"filename\" to follow includelist, got: %v", args[0])
 	}
-	return asm.pushScanner(name)
+	data, err := asm.readFile("include list", name)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	return asm.pushIncludeList(files)
+}
+
+// pushIncludeList assembles the files one after the other. Only
+// the first is pushed now, and each following file is pushed when
+// the one before it is finished, so that a file can be listed
+// twice, or include another listed file.
+func (asm *Assembler) pushIncludeList(files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if err := asm.pushScanner(files[0]); err != nil {
+		return asm.scanErrorf("%v", err)
+	}
+	asm.onPop[len(asm.onPop)-1] = func() error {
+		return asm.pushIncludeList(files[1:])
+	}
+	return nil
 }
 
 type commandConst struct{}
@@ -582,13 +1801,44 @@ func (commandConst) W(asm *Assembler) error {
 	if err != nil {
 		return err
 	}
-	n, ok, err := getIntValue(asm, args[1])
+	return asm.defineConstExpr(name, args[1])
+}
+
+type commandEqu struct{}
+
+// W for equ reports an error, since the name of the const
+// comes before equ: name equ value. That case is handled by
+// assemble, which calls assembleEqu.
+func (commandEqu) W(asm *Assembler) error {
+	return asm.scanErrorf("expected syntax: <ident> equ <value>")
+}
+
+// assembleEqu defines the const name, from the rest of
+// the statement: name equ value.
+func (asm *Assembler) assembleEqu(name string) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return asm.scanErrorf("expected syntax: %s equ <value>, got: %s equ %v", name, name, args)
+	}
+	return asm.defineConstExpr(name, args[0])
+}
+
+// defineConstExpr defines the const name as the value of e.
+func (asm *Assembler) defineConstExpr(name string, e expr) error {
+	n, ok, err := getIntValue(asm, e)
 	if err != nil {
 		return err
 	}
 	if !ok {
-		return asm.scanErrorf("failed to evaluate const %q value %q", name, args[1])
+		return asm.scanErrorf("failed to evaluate const %q value %q", name, e)
 	}
+	return asm.defineConst(name, n)
+}
+
+func (asm *Assembler) defineConst(name string, n int64) error {
 	if asm.constsDef[name] {
 		return asm.scanErrorf("redefining %q", name)
 	}
@@ -597,6 +1847,177 @@ func (commandConst) W(asm *Assembler) error {
 	return nil
 }
 
+// defineBlockSize defines the const name as the size of the
+// block from the label start to the pc.
+func (asm *Assembler) defineBlockSize(name string, start expr) error {
+	n, ok, err := getIntValue(asm, start)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("failed to evaluate the start of block %q: %s", name, start)
+	}
+	return asm.defineConst(name, int64(asm.pc)-n)
+}
+
+type commandBlockSize struct{}
+
+// W for blocksize defines a const as the number of bytes since
+// the start of a block: blocksize name, start.
+func (commandBlockSize) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return asm.scanErrorf("expected syntax: blocksize <ident>, <start>, got: blocksize %v", args)
+	}
+	name, err := getIdent(args[0])
+	if err != nil {
+		return err
+	}
+	return asm.defineBlockSize(name, args[1])
+}
+
+type commandSizeOf struct{}
+
+// W for sizeof defines the const name_size as the number
+// of bytes since the label name: sizeof name.
+func (commandSizeOf) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return asm.scanErrorf("expected syntax: sizeof <label>, got: sizeof %v", args)
+	}
+	name, err := getIdent(args[0])
+	if err != nil {
+		return err
+	}
+	return asm.defineBlockSize(name+"_size", args[0])
+}
+
+type commandTLabel struct{}
+
+// W for tlabel defines the const name as the current target,
+// where in memory the next byte is written, rather than the pc:
+// tlabel name. As with labels, the value is found in the first
+// pass, so the const can be used before it's defined.
+func (commandTLabel) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return asm.scanErrorf("expected syntax: tlabel <ident>, got: tlabel %v", args)
+	}
+	name, err := getIdent(args[0])
+	if err != nil {
+		return err
+	}
+	asm.tlabels[name] = true
+	return asm.defineConst(name, int64(asm.target))
+}
+
+type commandTable struct{}
+
+// W for table writes a byte for each i from 0 to count-1, with
+// i in the expression bound to the index: table label, expr, count.
+func (commandTable) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 3 {
+		return asm.scanErrorf("expected syntax: table <label>, <expr>, <count>, got: table %v", args)
+	}
+	name, err := getIdent(args[0])
+	if err != nil {
+		return err
+	}
+	count, ok, err := getIntValue(asm, args[2])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("table count should be a number, found %s", args[2])
+	}
+	if count < 0 || count > 65535 {
+		return asm.scanErrorf("table count %d is not in the range 0...65535", count)
+	}
+	if err := asm.setLabel(name, 0); err != nil {
+		return err
+	}
+	defer func() { asm.inTable = false }()
+	for i := int64(0); i < count; i++ {
+		asm.inTable, asm.tableIndex = true, i
+		v, ok, err := getIntValue(asm, args[1])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return asm.scanErrorf("bad table value: %s", args[1])
+		}
+		if min, max, _ := argRange(const8); v < min || v > max {
+			return asm.scanErrorf("%s = %d for i = %d is not in the range %d...%d", args[1], v, i, min, max)
+		}
+		bs, _, err := serializeIntArg(asm, v, const8)
+		if err != nil {
+			return err
+		}
+		if err := asm.writeBytes(bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type commandAlign struct{}
+
+// W for align writes fill bytes (by default 0) until the pc
+// is a multiple of n, which must be a power of two:
+// align n or align n, fill.
+func (commandAlign) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return asm.scanErrorf("expected syntax: align <n> or align <n>, <fill>, got: align %v", args)
+	}
+	n, ok, err := getIntValue(asm, args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("align argument should be a number, found %s", args[0])
+	}
+	if n <= 0 || n&(n-1) != 0 {
+		return asm.scanErrorf("align %d is not a positive power of two", n)
+	}
+	fill := []byte{0}
+	if len(args) == 2 {
+		fill, ok, err = args[1].evalAs(asm, const8, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return asm.scanErrorf("bad align fill value: %s", args[1])
+		}
+	}
+	pc := (int64(asm.pc) + n - 1) &^ (n - 1)
+	if pc > 0x10000 {
+		return asm.scanErrorf("align %d moves the pc past 0x10000", n)
+	}
+	for int64(asm.pc) < pc {
+		if err := asm.writeBytes(fill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type commandOrg struct{}
 
 func (commandOrg) W(asm *Assembler) error {
@@ -607,27 +2028,39 @@ func (commandOrg) W(asm *Assembler) error {
 	if len(args) < 1 || len(args) > 2 {
 		return asm.scanErrorf("org takes one or two arguments: %d found", len(args))
 	}
-	n, ok, err := getIntValue(asm, args[0])
-	if err != nil {
-		return err
-	}
 	arg1 := args[0]
 	if len(args) >= 2 {
 		arg1 = args[1]
 	}
+	return asm.setOrg(args[0], arg1)
+}
+
+// setOrg sets the pc and target from the given expressions.
+func (asm *Assembler) setOrg(pcArg, targetArg expr) error {
+	asm.unresolved = false
+	n, ok, err := getIntValue(asm, pcArg)
+	if err != nil {
+		return err
+	}
 	if !ok {
-		return asm.scanErrorf("org first (pc) argument should be an address, found %s", args[0])
+		return asm.scanErrorf("org first (pc) argument should be an address, found %s", pcArg)
 	}
 	if n < 0 || n >= 65536 {
 		return asm.scanErrorf("org first (pc) argument %x out of range", n)
 	}
 
-	t, ok, err := getIntValue(asm, arg1)
+	t, ok, err := getIntValue(asm, targetArg)
 	if err != nil {
 		return err
 	}
 	if !ok {
-		return asm.scanErrorf("org second (target) argument should be an address, found %s", arg1)
+		return asm.scanErrorf("org second (target) argument should be an address, found %s", targetArg)
+	}
+	if asm.pass == 0 && asm.unresolved {
+		// Leave the pc and target as they are until the
+		// labels are known.
+		asm.provisionalOrg = true
+		return nil
 	}
 	if t < 0 || t >= 1024*1024*2 {
 		return asm.scanErrorf("org second (target) argument %x out of range", t)
@@ -638,22 +2071,256 @@ func (commandOrg) W(asm *Assembler) error {
 	return nil
 }
 
+type commandOrgIf struct{}
+
+// W for orgif behaves like org, using the second argument as the
+// address if the first is non-zero, and the third otherwise.
+func (commandOrgIf) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 3 {
+		return asm.scanErrorf("orgif takes three arguments: %d found", len(args))
+	}
+	cond, ok, err := getIntValue(asm, args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("orgif condition should be a number, found %s", args[0])
+	}
+	addr := args[2]
+	if cond != 0 {
+		addr = args[1]
+	}
+	return asm.setOrg(addr, addr)
+}
+
+// A RegionKind says whether a region of memory holds code or data.
+type RegionKind int
+
+const (
+	RegionNone RegionKind = iota
+	RegionCode
+	RegionData
+)
+
+func (rk RegionKind) String() string {
+	switch rk {
+	case RegionCode:
+		return "code"
+	case RegionData:
+		return "data"
+	}
+	return "none"
+}
+
+// A Region is a range of memory, [Start, End), that was written
+// after a code or data directive.
+type Region struct {
+	Start, End int
+	Kind       RegionKind
+}
+
+// Regions returns the regions of memory marked as code or data,
+// in the order they were written. Bytes written before any code
+// or data directive aren't in any region.
+// It is only valid after the assembler has run.
+func (asm *Assembler) Regions() []Region {
+	return append([]Region{}, asm.regions...)
+}
+
+// addToRegion adds the current target to the current region,
+// or starts a new region if it's not contiguous.
+func (asm *Assembler) addToRegion() {
+	if n := len(asm.regions); n > 0 {
+		last := &asm.regions[n-1]
+		if last.Kind == asm.regionKind && last.End == asm.target {
+			last.End++
+			return
+		}
+	}
+	asm.regions = append(asm.regions, Region{asm.target, asm.target + 1, asm.regionKind})
+}
+
+type commandRegion RegionKind
+
+// W for code and data marks the following bytes as code or data,
+// for use by tools such as disassemblers.
+func (rk commandRegion) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return asm.scanErrorf("%s takes no arguments: %d found", RegionKind(rk), len(args))
+	}
+	asm.regionKind = RegionKind(rk)
+	return nil
+}
+
+type commandPhase struct{}
+
+// W for phase sets the pc, without changing the target, so that
+// the following code is assembled to run at a different address
+// from where it's stored. Labels and relative jumps inside the
+// phase block use the phased pc.
+func (commandPhase) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return asm.scanErrorf("phase takes one argument: %d found", len(args))
+	}
+	if asm.phased {
+		return asm.scanErrorf("phase inside another phase block")
+	}
+	pc, target := asm.pc, asm.target
+	if err := asm.setOrg(args[0], exprInt{int64(asm.target)}); err != nil {
+		return err
+	}
+	asm.phased = true
+	asm.phasePC, asm.phaseTarget = pc, target
+	return nil
+}
+
+type commandDephase struct{}
+
+// W for dephase ends a phase block, setting the pc back to
+// match where the code is stored.
+func (commandDephase) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return asm.scanErrorf("dephase takes no arguments: %d found", len(args))
+	}
+	if !asm.phased {
+		return asm.scanErrorf("dephase without phase")
+	}
+	asm.phased = false
+	asm.pc = asm.phasePC + asm.target - asm.phaseTarget
+	return nil
+}
+
+type commandAssertRange struct{}
+
+// W for assert_range checks that a label's value lies
+// within the given inclusive bounds:
+// assert_range label, min, max.
+func (commandAssertRange) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 3 {
+		return asm.scanErrorf("assert_range takes three arguments: %d found", len(args))
+	}
+	// Labels may not have their final values until pass 1.
+	if asm.pass == 0 {
+		return nil
+	}
+	var ns []int64
+	for _, a := range args {
+		n, ok, err := getIntValue(asm, a)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return asm.scanErrorf("assert_range arguments should be numbers, found %s", a)
+		}
+		ns = append(ns, n)
+	}
+	if ns[0] < ns[1] || ns[0] > ns[2] {
+		return asm.scanErrorf("assert_range failed: %s is %04x, not in the range %04x...%04x", args[0], ns[0], ns[1], ns[2])
+	}
+	return nil
+}
+
+type commandWarning struct{}
+
+// W for warning records a diagnostic with the given message,
+// without stopping the assembly: warning "message".
+func (commandWarning) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return asm.scanErrorf("expected syntax: warning \"message\", got: warning %v", args)
+	}
+	msg, err := getString(args[0])
+	if err != nil {
+		return asm.scanErrorf("expected syntax: warning \"message\", got: warning %v", args[0])
+	}
+	asm.diagf("%s", msg)
+	return nil
+}
+
+type commandBank struct{}
+
+// W for bank sets the target so that code is written into the given
+// 16k RAM bank, as paged in at 0xc000 on the 128K Spectrum.
+// The pc is unchanged.
+func (commandBank) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return asm.scanErrorf("bank takes one argument: %d found", len(args))
+	}
+	n, ok, err := getIntValue(asm, args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("bank argument should be a number, found %s", args[0])
+	}
+	if n < 0 || n >= 128 {
+		return asm.scanErrorf("bank %d out of range", n)
+	}
+	if asm.pc < 0xc000 {
+		return asm.scanErrorf("bank needs the pc to be at 0xc000 or above, found %x", asm.pc)
+	}
+	asm.target = int(n)*0x4000 + asm.pc - 0xc000
+	return nil
+}
+
 func (asm *Assembler) setLabel(label string, level int) error {
+	// The register or condition code wins when the name is used,
+	// so such a label is almost certainly a mistake.
+	if _, ok := regFromString[label]; ok {
+		asm.diagf("label %q has the same name as a register, which is used instead of it", label)
+	} else if _, ok := ccFromString[label]; ok {
+		asm.diagf("label %q has the same name as a condition code, which is used instead of it", label)
+	}
 	if level == 0 {
 		asm.currentMajorLabel = label
 	} else {
 		label = asm.currentMajorLabel + "." + label
 	}
+	label = asm.labelPrefix + label
+	asm.labelsDef[label] = true
 	if asm.pass == 1 {
 		fass := asm.labelAssign[label]
 		if asm.location() != fass {
 			return asm.scanErrorf("label %q redefined. First defined at %s", label, fass)
 		}
+		if v := asm.l[label]; uint16(asm.pc) != v {
+			return asm.scanErrorf("label %q moved from %04x in the first pass to %04x", label, v, asm.pc)
+		}
 		return nil
 	}
 	asm.l[label] = uint16(asm.pc)
+	asm.labelTarget[label] = asm.target
 	if asm.pass == 0 && asm.labelAssign[label] == "" {
 		asm.labelAssign[label] = asm.location()
+		pos := asm.scan().Position
+		asm.labelDefs = append(asm.labelDefs, LabelInfo{Name: label, File: pos.Filename, Line: pos.Line})
 	}
 	return nil
 }
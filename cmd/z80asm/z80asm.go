@@ -6,7 +6,8 @@
 // if everything is ok.
 //
 // The assembler file must define a .main label which is used as
-// the entrypoint for the .sna file.
+// the entrypoint for the .sna file. With -no-entry, there's no
+// entrypoint, and the assembled bytes are written as a raw binary.
 package main
 
 import (
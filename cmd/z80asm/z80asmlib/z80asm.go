@@ -1,19 +1,127 @@
 package z80asmlib
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/scanner"
+	"time"
 
 	"github.com/paulhankin/z80asm"
 	"github.com/paulhankin/z80asm/z80io"
 )
 
+// Version is the version of the assembler, recorded in
+// signatures. It can be set at build time with -ldflags.
+var Version = "dev"
+
 type Options struct {
 	SourceFile string
 	OutFile    string
 	AsmOptions []z80asm.AssemblerOpt
+
+	// Dump causes a hexdump of the assembled bytes to be
+	// written to Stdout (or os.Stdout if Stdout is nil).
+	Dump   bool
+	Stdout io.Writer
+
+	// Sizes causes the number of bytes from each major label
+	// to the next (see z80asm.SizeByLabel) to be written to
+	// Stdout, largest first.
+	Sizes bool
+
+	// Lint causes warnings about unused labels to be
+	// written to Stderr (or os.Stderr if Stderr is nil).
+	Lint   bool
+	Stderr io.Writer
+
+	// Verbose causes timings and statistics about the
+	// assembly to be written to Stderr.
+	Verbose bool
+
+	// Sign causes a signature record (see z80io.WriteSignature)
+	// to be appended to the output, after the memory image.
+	// Only raw binaries can be signed.
+	Sign bool
+
+	// GoFile, if set, is a Go source file to write the labels
+	// to as consts, in package GoPackage.
+	GoFile    string
+	GoPackage string
+
+	// Extract, if set, is a label. Instead of a .sna file, the
+	// bytes from the label up to the next major label are written
+	// to OutFile as a raw binary.
+	Extract string
+
+	// NoEntry means there's no .main entrypoint. Instead of a
+	// .sna file, the assembled bytes are written to OutFile as
+	// a raw binary.
+	NoEntry bool
+
+	// CArray, if set, is the name of a C array. The assembled
+	// bytes are written as that array to a .c file, with a .h
+	// file declaring it, named after the source file.
+	CArray string
+
+	// Entries, if set, are labels of entrypoints. A stub of
+	// jumps to them is added after the assembled code, and the
+	// snapshot starts at the stub rather than at .main.
+	Entries []string
+
+	// Format is the format of OutFile: "sna" for a snapshot,
+	// which needs a .main entrypoint, "tap" for a tape that
+	// loads the code and calls .main, or "bin" for the bytes
+	// from the lowest to the highest address written. If it's
+	// empty, the format is given by the extension of OutFile,
+	// defaulting to "sna".
+	Format string
+
+	// GapFill is the byte written in the output for memory
+	// that's skipped over, for example by org, rather than 0.
+	GapFill uint8
+
+	// Verify, if set, is a golden binary file. Instead of
+	// writing output, the assembled bytes from the lowest to
+	// the highest address written are compared with it.
+	Verify string
+
+	// Dir, if set, is a directory to assemble instead of
+	// SourceFile. Each .asm file in it that isn't included by
+	// another is assembled as if it were SourceFile, with its
+	// output named after it. Included files are looked for in
+	// Dir as well as the current directory.
+	Dir string
+}
+
+// Output formats.
+const (
+	FormatSNA = "sna"
+	FormatTAP = "tap"
+	FormatBin = "bin"
+)
+
+// format returns the output format.
+func (opts *Options) format() (string, error) {
+	f := opts.Format
+	if f == "" {
+		f = strings.TrimPrefix(strings.ToLower(path.Ext(opts.OutFile)), ".")
+		if f != FormatBin && f != FormatTAP {
+			f = FormatSNA
+		}
+	}
+	if f != FormatSNA && f != FormatTAP && f != FormatBin {
+		return "", fmt.Errorf("ERROR: unknown output format %q: want %s, %s or %s", f, FormatSNA, FormatTAP, FormatBin)
+	}
+	return f, nil
 }
 
 func OptionsFromFlags(args []string) *Options {
@@ -21,12 +129,42 @@ func OptionsFromFlags(args []string) *Options {
 		outFile string
 		help    bool
 		cpu     string
+		dump    bool
+		sizes   bool
+		lint    bool
+		verbose bool
+		sign    bool
+		goFile  string
+		goPkg   string
+		extract string
+		noEntry bool
+		cArray  string
+		entries string
+		format  string
+		verify  string
+		dir     string
+		gapFill uint
 	)
 
 	fs := flag.NewFlagSet("", flag.ExitOnError)
-	fs.StringVar(&outFile, "o", "", "the sna filename to output")
+	fs.StringVar(&outFile, "o", "", "the filename to output")
+	fs.StringVar(&format, "format", "", "the output format: sna, tap for a tape with a BASIC loader, or bin for a raw binary. By default, it's given by the extension of the -o filename, and is sna otherwise.")
 	fs.BoolVar(&help, "help", false, "show usage information about this command.")
 	fs.StringVar(&cpu, "cpu", "z80", "which cpu to use: z80, z80n1, z80n=z80n2")
+	fs.BoolVar(&dump, "dump", false, "write a hexdump of the assembled bytes to stdout.")
+	fs.BoolVar(&sizes, "sizes", false, "write the number of bytes from each label to the next to stdout, largest first.")
+	fs.BoolVar(&lint, "lint", false, "warn about labels that are never used.")
+	fs.BoolVar(&verbose, "v", false, "write timings and statistics to stderr.")
+	fs.BoolVar(&sign, "sign", false, "append the assembler version and build time to the output, which must be a raw binary.")
+	fs.StringVar(&goFile, "go", "", "a Go source file to write the labels to as consts.")
+	fs.StringVar(&goPkg, "gopkg", "labels", "the package of the Go source file written by -go.")
+	fs.StringVar(&extract, "extract", "", "write only the bytes from this label to the next major label, as a raw binary.")
+	fs.StringVar(&cArray, "carray", "", "write the assembled bytes as a C array with this name, to .c and .h files.")
+	fs.StringVar(&entries, "entries", "", "comma-separated entrypoint labels: a stub of jumps to them is added after the code, and the snapshot starts at the stub.")
+	fs.UintVar(&gapFill, "gap-fill", 0, "the byte to output for memory that's skipped over, for example by org. For example, 0xff for an EPROM.")
+	fs.StringVar(&verify, "verify", "", "instead of writing output, check that the assembled bytes match this golden binary file.")
+	fs.StringVar(&dir, "dir", "", "assemble each .asm file in this directory that isn't included by another, instead of a single file.")
+	fs.BoolVar(&noEntry, "no-entry", false, "don't require a .main entrypoint, and write the assembled bytes as a raw binary.")
 
 	arg0 := args[0]
 	if err := fs.Parse(args[1:]); err != nil {
@@ -35,31 +173,52 @@ func OptionsFromFlags(args []string) *Options {
 	if help {
 		usage(fs, arg0)
 	}
-	if len(fs.Args()) < 1 {
+	if len(fs.Args()) < 1 && dir == "" {
+		usage(fs, arg0)
+	}
+	if len(fs.Args()) > 0 && dir != "" {
+		pf("ERROR: -dir can't be used with a file to assemble: %s\n\n", fs.Args())
 		usage(fs, arg0)
 	}
 	if len(fs.Args()) > 1 {
 		pf("ERROR: too many command-line arguments: %s\n\n", fs.Args())
 		usage(fs, arg0)
 	}
+	if gapFill > 0xff {
+		pf("ERROR: -gap-fill %#x isn't a byte\n\n", gapFill)
+		usage(fs, arg0)
+	}
 	aopts, ok := asmOpts[cpu]
 	if !ok {
 		pf("ERROR: unrecognized cpu: %q\n", cpu)
 		usage(fs, arg0)
 	}
+	var entryList []string
+	if entries != "" {
+		entryList = strings.Split(entries, ",")
+	}
 	return &Options{
 		SourceFile: fs.Arg(0),
 		OutFile:    outFile,
 		AsmOptions: aopts,
+		Dump:       dump,
+		Sizes:      sizes,
+		Lint:       lint,
+		Verbose:    verbose,
+		Sign:       sign,
+		GoFile:     goFile,
+		GoPackage:  goPkg,
+		Extract:    extract,
+		NoEntry:    noEntry,
+		CArray:     cArray,
+		Entries:    entryList,
+		Format:     format,
+		Verify:     verify,
+		GapFill:    uint8(gapFill),
+		Dir:        dir,
 	}
 }
 
-var (
-	outFile = flag.String("o", "", "the sna filename to output")
-	help    = flag.Bool("help", false, "show usage information about this command.")
-	cpu     = flag.String("cpu", "z80", "which cpu to use: z80, z80n1, z80n=z80n2")
-)
-
 var asmOpts = map[string][]z80asm.AssemblerOpt{
 	"z80":   nil,
 	"z80n":  []z80asm.AssemblerOpt{z80asm.UseNextCore(2)},
@@ -72,42 +231,476 @@ func pf(f string, args ...interface{}) {
 }
 
 func usage(fs *flag.FlagSet, arg0 string) {
-	pf("%s is a z80 assembler, which writes ZX Spectrum .sna files\n\n", arg0)
+	pf("%s is a z80 assembler, which writes ZX Spectrum .sna or .tap files, or raw binaries\n\n", arg0)
 	pf("Usage:\n\n")
 	pf("%s <filename>: file to assemble\n", arg0)
+	pf("%s -dir <directory>: assemble each file in the directory that isn't included by another\n", arg0)
 	fs.PrintDefaults()
 	os.Exit(2)
 }
 
 func Main(opts *Options) error {
-	asm, err := z80asm.NewAssembler(opts.AsmOptions...)
+	if opts.Dir != "" {
+		return assembleDir(opts)
+	}
+	stderr := opts.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	asmOpts := append([]z80asm.AssemblerOpt{}, opts.AsmOptions...)
+	if opts.Verbose {
+		var passStart time.Time
+		asmOpts = append(asmOpts, z80asm.WithPassHook(func(pass int, phase z80asm.PassPhase) {
+			if phase == z80asm.PassStart {
+				passStart = time.Now()
+			} else {
+				fmt.Fprintf(stderr, "pass %d: %v\n", pass, time.Since(passStart))
+			}
+		}))
+	}
+	format, err := opts.format()
+	if err != nil {
+		return err
+	}
+	asm, err := z80asm.NewAssembler(asmOpts...)
 	if err != nil {
 		return err
 	}
 	if err := asm.AssembleFile(opts.SourceFile); err != nil {
 		return err
 	}
+	if opts.GapFill != 0 {
+		asm.FillGaps(opts.GapFill)
+	}
 
+	if opts.Verbose {
+		start, end := asm.WrittenRange()
+		fmt.Fprintf(stderr, "source files: %s\n", strings.Join(asm.SourceFiles(), ", "))
+		labels, consts := asm.SymbolCounts()
+		fmt.Fprintf(stderr, "labels: %d, consts: %d\n", labels, consts)
+		fmt.Fprintf(stderr, "bytes emitted: %d (%04x-%04x)\n", asm.BytesWritten(), start, end)
+	}
+
+	for _, d := range asm.Diagnostics() {
+		fmt.Fprintf(stderr, "%s\n", d)
+	}
+
+	if opts.Lint {
+		for _, l := range asm.UnusedLabels() {
+			fmt.Fprintf(stderr, "warning: unused label %q\n", l)
+		}
+	}
+
+	if opts.GoFile != "" {
+		if err := writeGoFile(opts.GoFile, opts.GoPackage, asm.SymbolTable()); err != nil {
+			return err
+		}
+	}
+
+	if opts.CArray != "" {
+		start, end := asm.WrittenRange()
+		if err := writeCFiles(replaceExt(opts.SourceFile, ""), opts.CArray, asm.RAM()[start:end]); err != nil {
+			return err
+		}
+	}
+
+	if opts.Dump {
+		w := opts.Stdout
+		if w == nil {
+			w = os.Stdout
+		}
+		start, end := asm.WrittenRange()
+		if err := hexDump(w, start, asm.RAM()[start:end]); err != nil {
+			return fmt.Errorf("failed to write hexdump: %v", err)
+		}
+	}
+
+	if opts.Sizes {
+		w := opts.Stdout
+		if w == nil {
+			w = os.Stdout
+		}
+		for _, ls := range asm.SizeByLabel() {
+			if _, err := fmt.Fprintf(w, "%6d  %04x  %s\n", ls.Size, ls.Target, ls.Name); err != nil {
+				return fmt.Errorf("failed to write sizes: %v", err)
+			}
+		}
+	}
+
+	if opts.Verify != "" {
+		start, end := asm.WrittenRange()
+		return verifyGolden(opts, start, asm.RAM()[start:end])
+	}
+
+	if opts.Extract != "" {
+		start, end, err := asm.LabelSpan(opts.Extract)
+		if err != nil {
+			return fmt.Errorf("ERROR: can't extract %s from %s: %v", opts.Extract, opts.SourceFile, err)
+		}
+		return writeBinary(opts, asm.RAM()[start:end])
+	}
+	if opts.NoEntry || format == FormatBin {
+		start, end := asm.WrittenRange()
+		if err := writeBinary(opts, asm.RAM()[start:end]); err != nil {
+			return err
+		}
+		if opts.Sign {
+			return appendSignature(binaryOutFile(opts))
+		}
+		return nil
+	}
+
+	if format == FormatTAP {
+		return writeTAP(opts, asm)
+	}
+
+	if opts.Sign {
+		return fmt.Errorf("ERROR: a .sna file can't be signed, since emulators use its size to tell 48K from 128K snapshots")
+	}
+	// The entrypoint stub, if any, is added to the RAM.
+	pc, err := entryPoint(opts, asm, "a .sna file")
+	if err != nil {
+		return err
+	}
 	m, err := z80io.NewSNAMachine(asm.RAM())
 	if err != nil {
 		return err
 	}
+	m.PC = pc
+
+	out := opts.OutFile
+	if out == "" {
+		out = replaceExt(opts.SourceFile, ".sna")
+	}
 
+	if err := z80io.SaveSNA(out, m); err != nil {
+		return fmt.Errorf("failed to write .sna file %s: %v\n", out, err)
+	}
+	return nil
+}
+
+// entryPoint returns the address where the code starts: a stub
+// of jumps to the entries, or .main. what is the output that
+// needs it, for errors.
+func entryPoint(opts *Options, asm *z80asm.Assembler, what string) (uint16, error) {
+	if len(opts.Entries) > 0 {
+		stub, err := addEntryStub(asm, opts.Entries)
+		if err != nil {
+			return 0, fmt.Errorf("ERROR: %v in %s", err, opts.SourceFile)
+		}
+		return stub, nil
+	}
 	value, ok := asm.GetLabel("", "main")
 	if !ok {
-		return fmt.Errorf("ERROR: missing .main entrypoint in %s\n", opts.SourceFile)
+		return 0, fmt.Errorf("ERROR: missing .main entrypoint in %s, which %s needs (use -format bin for a raw binary without one)", opts.SourceFile, what)
 	}
-	m.PC = value
+	return value, nil
+}
 
-	out := *outFile
+// assembleDir assembles each of the root files in opts.Dir.
+func assembleDir(opts *Options) error {
+	if opts.OutFile != "" || opts.Verify != "" || opts.GoFile != "" {
+		return fmt.Errorf("ERROR: -o, -verify and -go can't be used with -dir, which assembles several files")
+	}
+	roots, err := dirRoots(opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		o := *opts
+		o.Dir = ""
+		o.SourceFile = root
+		o.AsmOptions = append(append([]z80asm.AssemblerOpt{}, opts.AsmOptions...), z80asm.WithIncludeDir(opts.Dir))
+		if err := Main(&o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirRoots returns the .asm files in dir that aren't
+// included by another .asm file in dir, in sorted order.
+func dirRoots(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.asm"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: can't list the files in %s: %v", dir, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("ERROR: there are no .asm files in %s", dir)
+	}
+	included := map[string]bool{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: failed to read %s: %v", f, err)
+		}
+		for _, name := range includedFiles(dir, data) {
+			included[filepath.Clean(name)] = true
+			if !filepath.IsAbs(name) {
+				included[filepath.Join(dir, name)] = true
+			}
+		}
+	}
+	var roots []string
+	for _, f := range files {
+		if !included[filepath.Clean(f)] {
+			roots = append(roots, f)
+		}
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("ERROR: every .asm file in %s is included by another", dir)
+	}
+	return roots, nil
+}
+
+// includedFiles returns the names of the files that the source
+// includes, with include or includelist. It only looks at the
+// text, so a file is counted even if it's included in a branch
+// of an if block that isn't assembled.
+func includedFiles(dir string, data []byte) []string {
+	var s scanner.Scanner
+	s.Init(bytes.NewReader(data))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanChars | scanner.ScanStrings | scanner.ScanRawStrings | scanner.ScanComments | scanner.SkipComments
+	s.Whitespace = (1 << ' ') | (1 << '\t')
+	s.Error = func(*scanner.Scanner, string) {}
+	var names []string
+	atStart := true
+	for t := s.Scan(); t != scanner.EOF; t = s.Scan() {
+		start := atStart
+		atStart = t == '\n' || t == ';'
+		if !start {
+			continue
+		}
+		// A label may come before the directive, as in
+		// x: include "a.asm" or .y include "b.asm".
+		if t == '.' {
+			t = s.Scan()
+			atStart = t == scanner.Ident || t == '\n' || t == ';'
+			continue
+		}
+		if t != scanner.Ident {
+			continue
+		}
+		cmd := strings.ToLower(s.TokenText())
+		if cmd != "include" && cmd != "includelist" {
+			t = s.Scan()
+			atStart = t == ':' || t == '\n' || t == ';'
+			continue
+		}
+		if s.Scan() != scanner.String {
+			continue
+		}
+		name, err := strconv.Unquote(s.TokenText())
+		if err != nil {
+			continue
+		}
+		if cmd == "include" {
+			names = append(names, name)
+			continue
+		}
+		list, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) && !filepath.IsAbs(name) {
+			list, err = ioutil.ReadFile(filepath.Join(dir, name))
+		}
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(list), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				names = append(names, line)
+			}
+		}
+	}
+	return names
+}
+
+// writeTAP writes the assembled code to a .tap file, with a
+// BASIC loader that runs it. The tape is named after the
+// source file.
+func writeTAP(opts *Options, asm *z80asm.Assembler) error {
+	if opts.Sign {
+		return fmt.Errorf("ERROR: a .tap file can't be signed, since tape loaders don't expect the signature")
+	}
+	exec, err := entryPoint(opts, asm, "a .tap file")
+	if err != nil {
+		return err
+	}
+	// The written range includes the entrypoint stub, if any.
+	start, end := asm.WrittenRange()
+	name := path.Base(replaceExt(opts.SourceFile, ""))
+	if len(name) > 10 {
+		name = name[:10]
+	}
+	out := opts.OutFile
 	if out == "" {
-		dir, base := path.Split(opts.SourceFile)
-		ext := path.Ext(opts.SourceFile)
-		out = path.Join(dir, base[:len(base)-len(ext)]+".sna")
+		out = replaceExt(opts.SourceFile, ".tap")
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("failed to create .tap file: %v", err)
+	}
+	loader := z80io.TAPLoaderOptions{AutoStart: true, ExecAddr: exec}
+	if err := loader.WriteTAP(f, asm.RAM()[start:end], uint16(start), name); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write .tap file %s: %v", out, err)
 	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close .tap file %s: %v", out, err)
+	}
+	return nil
+}
 
-	if err := z80io.SaveSNA(out, m); err != nil {
-		return fmt.Errorf("failed to write .sna file %s: %v\n", out, err)
+// verifyGolden checks that data, assembled at addr, is the
+// same as the golden file, reporting the first difference.
+func verifyGolden(opts *Options, addr int, data []byte) error {
+	golden, err := ioutil.ReadFile(opts.Verify)
+	if err != nil {
+		return fmt.Errorf("ERROR: failed to read golden file: %v", err)
+	}
+	for i := 0; i < len(data) && i < len(golden); i++ {
+		if data[i] != golden[i] {
+			return fmt.Errorf("ERROR: %s doesn't match %s at offset %#x (address %04x): assembled %02x, golden %02x",
+				opts.SourceFile, opts.Verify, i, addr+i, data[i], golden[i])
+		}
+	}
+	if len(data) != len(golden) {
+		n := len(data)
+		if len(golden) < n {
+			n = len(golden)
+		}
+		return fmt.Errorf("ERROR: %s doesn't match %s at offset %#x: assembled %d bytes, golden %d bytes",
+			opts.SourceFile, opts.Verify, n, len(data), len(golden))
 	}
 	return nil
 }
+
+// writeBinary writes data to the output file, which by default
+// is the source file with the extension .bin.
+func writeBinary(opts *Options, data []byte) error {
+	out := binaryOutFile(opts)
+	if err := ioutil.WriteFile(out, data, 0666); err != nil {
+		return fmt.Errorf("failed to write %s: %v", out, err)
+	}
+	return nil
+}
+
+// binaryOutFile returns the name of the file that
+// writeBinary writes.
+func binaryOutFile(opts *Options) string {
+	if opts.OutFile == "" {
+		return replaceExt(opts.SourceFile, ".bin")
+	}
+	return opts.OutFile
+}
+
+// addEntryStub writes jp instructions to each of the entries
+// after the assembled code, returning the pc of the first.
+func addEntryStub(asm *z80asm.Assembler, entries []string) (uint16, error) {
+	var stub []byte
+	for _, e := range entries {
+		addr, ok := asm.GetLabel("", e)
+		if !ok {
+			return 0, fmt.Errorf("missing entrypoint %q", e)
+		}
+		stub = append(stub, 0xc3, byte(addr), byte(addr>>8))
+	}
+	pc, err := asm.AppendCode(stub)
+	if err != nil {
+		return 0, fmt.Errorf("can't add the entrypoint stub: %v", err)
+	}
+	return pc, nil
+}
+
+// replaceExt returns filename with its extension replaced by ext.
+func replaceExt(filename, ext string) string {
+	dir, base := path.Split(filename)
+	return path.Join(dir, base[:len(base)-len(path.Ext(base))]+ext)
+}
+
+// writeCFiles writes data as a C array called name to base.c,
+// and a header declaring it to base.h.
+func writeCFiles(base, name string, data []byte) error {
+	for _, ext := range []string{".c", ".h"} {
+		filename := base + ext
+		f, err := os.Create(filename)
+		if err != nil {
+			return fmt.Errorf("failed to create C file: %v", err)
+		}
+		if ext == ".c" {
+			err = z80io.WriteCArray(f, name, data)
+		} else {
+			err = z80io.WriteCHeader(f, name, len(data))
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write %s: %v", filename, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to close %s: %v", filename, err)
+		}
+	}
+	return nil
+}
+
+// writeGoFile writes the labels to the named file as Go consts.
+func writeGoFile(filename, pkg string, syms map[string]uint16) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create Go file: %v", err)
+	}
+	if err := z80io.WriteGoConstants(f, pkg, syms); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write Go file %s: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close Go file %s: %v", filename, err)
+	}
+	return nil
+}
+
+// appendSignature appends a signature record to the named file.
+func appendSignature(filename string) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s to sign it: %v", filename, err)
+	}
+	if err := z80io.WriteSignature(f, Version); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sign %s: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s after signing: %v", filename, err)
+	}
+	return nil
+}
+
+// hexDump writes data in the style of xxd, 16 bytes per line,
+// with addresses starting at addr.
+func hexDump(w io.Writer, addr int, data []byte) error {
+	bw := bufio.NewWriter(w)
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		var hex, ascii strings.Builder
+		for j := 0; j < 16; j++ {
+			if j > 0 && j%2 == 0 {
+				hex.WriteByte(' ')
+			}
+			if j >= len(line) {
+				hex.WriteString("  ")
+				continue
+			}
+			fmt.Fprintf(&hex, "%02x", line[j])
+			if c := line[j]; c >= 0x20 && c < 0x7f {
+				ascii.WriteByte(c)
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+		fmt.Fprintf(bw, "%08x: %s  %s\n", addr+i, hex.String(), ascii.String())
+	}
+	return bw.Flush()
+}
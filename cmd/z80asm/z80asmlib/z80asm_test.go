@@ -0,0 +1,403 @@
+package z80asmlib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/paulhankin/z80asm/z80io"
+)
+
+// writeSource writes the given source into a new temporary
+// directory, returning the filename.
+func writeSource(t *testing.T, src string) string {
+	dir, err := ioutil.TempDir("", "z80asmlib")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	name := filepath.Join(dir, "a.asm")
+	if err := ioutil.WriteFile(name, []byte(src), 0666); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	return name
+}
+
+func TestDump(t *testing.T) {
+	src := `main: ld a, 42 ; ret ; ds "Hello, world!\n"; db 0xff`
+	var out bytes.Buffer
+	opts := &Options{
+		SourceFile: writeSource(t, src),
+		Dump:       true,
+		Stdout:     &out,
+	}
+	if err := Main(opts); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	want := []string{
+		"00008000: 3e2a c948 656c 6c6f 2c20 776f 726c 6421  >*.Hello, world!",
+		"00008010: 0aff                                     ..",
+	}
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got dump:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLint(t *testing.T) {
+	src := "main: call used; ret; used: ret; unused: ret"
+	var errs bytes.Buffer
+	opts := &Options{
+		SourceFile: writeSource(t, src),
+		Lint:       true,
+		Stderr:     &errs,
+	}
+	if err := Main(opts); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	if got, want := errs.String(), "warning: unused label \"unused\"\n"; got != want {
+		t.Errorf("got warnings %q, want %q", got, want)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	src := "main: call f; ret; f: ld a, 1; ld b, 2; ret"
+	var out bytes.Buffer
+	opts := &Options{
+		SourceFile: writeSource(t, src),
+		Sizes:      true,
+		Stdout:     &out,
+	}
+	if err := Main(opts); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	if got, want := out.String(), "     5  8004  f\n     4  8000  main\n"; got != want {
+		t.Errorf("got sizes %q, want %q", got, want)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var errs bytes.Buffer
+	opts := &Options{
+		SourceFile: writeSource(t, "warning \"deprecated\"\nmain: ret"),
+		Stderr:     &errs,
+	}
+	if err := Main(opts); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	if got, want := errs.String(), "a.asm:1.21: deprecated\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want it to end with %q", got, want)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	src := "const x = 1; main: ld a, x; org 0x8010; ret"
+	var errs bytes.Buffer
+	opts := &Options{
+		SourceFile: writeSource(t, src),
+		Verbose:    true,
+		Stderr:     &errs,
+	}
+	if err := Main(opts); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	for _, want := range []string{
+		"pass 0: ",
+		"pass 1: ",
+		"labels: 1, consts: 1\n",
+		"bytes emitted: 3 (8000-8011)\n",
+	} {
+		if !strings.Contains(errs.String(), want) {
+			t.Errorf("verbose output %q doesn't contain %q", errs.String(), want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	src := writeSource(t, "main: ret")
+	if err := Main(&Options{SourceFile: src, Format: FormatBin, Sign: true}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	bin, err := ioutil.ReadFile(strings.TrimSuffix(src, ".asm") + ".bin")
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if len(bin) <= 1 || bin[0] != 0xc9 {
+		t.Fatalf("signed output is % x, want c9 followed by the signature", bin)
+	}
+	sig := bin[1:]
+	want := append(append([]byte(z80io.SignatureMagic), byte(len(Version))), Version...)
+	if !bytes.HasPrefix(sig, want) || len(sig) != len(want)+8 {
+		t.Errorf("signature = %q, want %q followed by 8 bytes of time", sig, want)
+	}
+
+	// The size of a .sna file says whether it's 48K or 128K,
+	// so it can't have a signature appended.
+	err = Main(&Options{SourceFile: src, Sign: true})
+	if err == nil || !strings.Contains(err.Error(), "can't be signed") {
+		t.Errorf("signing a .sna file gave error %v, want can't be signed", err)
+	}
+}
+
+func TestGoFile(t *testing.T) {
+	src := writeSource(t, "main: .loop jr loop")
+	goFile := filepath.Join(filepath.Dir(src), "labels.go")
+	if err := Main(&Options{SourceFile: src, GoFile: goFile, GoPackage: "mylabels"}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(goFile)
+	if err != nil {
+		t.Fatalf("failed to read Go file: %v", err)
+	}
+	for _, want := range []string{"package mylabels\n", "Main_loop = 0x8000\n"} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("Go file doesn't contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	src := writeSource(t, "main: call routine; ret; routine: ld a, 42; ld b, 3; .loop out (254), a; djnz loop; ret; after: nop")
+	out := filepath.Join(filepath.Dir(src), "routine.bin")
+	if err := Main(&Options{SourceFile: src, OutFile: out, Extract: "routine"}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if want := []byte{0x3e, 42, 0x06, 3, 0xd3, 254, 0x10, 0xfc, 0xc9}; !bytes.Equal(got, want) {
+		t.Errorf("extracted % x (%d bytes), want % x", got, len(got), want)
+	}
+
+	err = Main(&Options{SourceFile: src, OutFile: out, Extract: "missing"})
+	if err == nil || !strings.Contains(err.Error(), `unknown label "missing"`) {
+		t.Errorf("extracting a missing label gave error %v, want unknown label", err)
+	}
+}
+
+func TestNoEntry(t *testing.T) {
+	src := writeSource(t, "org 0x9000; font: db 1, 2, 3; dw font")
+	if err := Main(&Options{SourceFile: src, NoEntry: true}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(strings.TrimSuffix(src, ".asm") + ".bin")
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if want := []byte{1, 2, 3, 0x00, 0x90}; !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestCArray(t *testing.T) {
+	src := writeSource(t, "main: ld a, 42; ret")
+	if err := Main(&Options{SourceFile: src, CArray: "prog"}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	base := strings.TrimSuffix(src, ".asm")
+	c, err := ioutil.ReadFile(base + ".c")
+	if err != nil {
+		t.Fatalf("failed to read C file: %v", err)
+	}
+	if !strings.Contains(string(c), "const unsigned char prog[PROG_LEN] = {\n\t0x3e, 0x2a, 0xc9,\n};\n") {
+		t.Errorf("C file doesn't contain the array:\n%s", c)
+	}
+	h, err := ioutil.ReadFile(base + ".h")
+	if err != nil {
+		t.Fatalf("failed to read C header: %v", err)
+	}
+	if !strings.Contains(string(h), "#define PROG_LEN 3\n") {
+		t.Errorf("C header doesn't define PROG_LEN:\n%s", h)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	src := writeSource(t, "org 0x9000; menu: ret; game: nop; ret; editor: ld a, 1; ret")
+	if err := Main(&Options{SourceFile: src, Entries: []string{"menu", "game", "editor"}}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	sna, err := ioutil.ReadFile(strings.TrimSuffix(src, ".asm") + ".sna")
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	ram := func(addr int) []byte { return sna[27+addr-0x4000:] }
+	// The stub follows the code, which ends at 0x9006.
+	want := []byte{0xc3, 0x00, 0x90, 0xc3, 0x01, 0x90, 0xc3, 0x03, 0x90}
+	if got := ram(0x9006)[:len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("stub is % x, want % x", got, want)
+	}
+	// The PC is pushed onto the stack, at the top of memory.
+	if got := ram(0xfffe)[:2]; !bytes.Equal(got, []byte{0x06, 0x90}) {
+		t.Errorf("pc is % x, want 06 90", got)
+	}
+
+	err = Main(&Options{SourceFile: src, Entries: []string{"menu", "missing"}})
+	if err == nil || !strings.Contains(err.Error(), `missing entrypoint "missing"`) {
+		t.Errorf("got error %v, want missing entrypoint", err)
+	}
+
+	// Code assembled to run somewhere other than where it's
+	// written gets a stub that runs from the matching pc.
+	src = writeSource(t, "org 0x6000, 0x9000; menu: ret; game: nop; ret")
+	if err := Main(&Options{SourceFile: src, Entries: []string{"menu", "game"}}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	sna, err = ioutil.ReadFile(strings.TrimSuffix(src, ".asm") + ".sna")
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	want = []byte{0xc3, 0x00, 0x60, 0xc3, 0x01, 0x60}
+	if got := ram(0x9003)[:len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("stub is % x, want % x", got, want)
+	}
+	if got := ram(0xfffe)[:2]; !bytes.Equal(got, []byte{0x03, 0x60}) {
+		t.Errorf("pc is % x, want 03 60", got)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	src := writeSource(t, "org 0x9000; db 1, 2; org 0x9004; db 3")
+	dir := filepath.Dir(src)
+	want := []byte{1, 2, 0, 0, 3}
+
+	// The format is given by the flag, or by the extension.
+	for _, opts := range []*Options{
+		{SourceFile: src, Format: FormatBin},
+		{SourceFile: src, OutFile: filepath.Join(dir, "out.bin")},
+	} {
+		if err := Main(opts); err != nil {
+			t.Fatalf("Main(%+v) failed: %v", opts, err)
+		}
+		out := opts.OutFile
+		if out == "" {
+			out = strings.TrimSuffix(src, ".asm") + ".bin"
+		}
+		got, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%+v: got % x, want % x", opts, got, want)
+		}
+	}
+
+	err := Main(&Options{SourceFile: src, OutFile: filepath.Join(dir, "out.sna")})
+	if err == nil || !strings.Contains(err.Error(), "missing .main entrypoint") {
+		t.Errorf("got error %v, want missing .main for a .sna file", err)
+	}
+	if err := Main(&Options{SourceFile: src, Format: "xyz"}); err == nil || !strings.Contains(err.Error(), `unknown output format "xyz"`) {
+		t.Errorf("got error %v, want unknown format", err)
+	}
+
+	// A .sna file is written to OutFile.
+	src = writeSource(t, "main: ret")
+	out := filepath.Join(filepath.Dir(src), "game.sna")
+	if err := Main(&Options{SourceFile: src, OutFile: out}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("sna file wasn't written to -o: %v", err)
+	}
+}
+
+func TestTAP(t *testing.T) {
+	src := writeSource(t, "org 0x8000; db 1; main: ret")
+	if err := Main(&Options{SourceFile: src, Format: FormatTAP}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(strings.TrimSuffix(src, ".asm") + ".tap")
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	var want bytes.Buffer
+	loader := z80io.TAPLoaderOptions{AutoStart: true, ExecAddr: 0x8001}
+	if err := loader.WriteTAP(&want, []byte{1, 0xc9}, 0x8000, "a"); err != nil {
+		t.Fatalf("WriteTAP failed: %v", err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("got % x, want % x", got, want.Bytes())
+	}
+
+	// The format is given by the extension too, and a .tap
+	// file needs an entrypoint.
+	src = writeSource(t, "org 0x8000; db 1")
+	err = Main(&Options{SourceFile: src, OutFile: filepath.Join(filepath.Dir(src), "out.tap")})
+	if err == nil || !strings.Contains(err.Error(), "missing .main entrypoint") {
+		t.Errorf("got error %v, want missing .main for a .tap file", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	src := writeSource(t, "org 0x8000; db 1, 2, 3")
+	dir := filepath.Dir(src)
+	for _, tc := range []struct {
+		golden []byte
+		want   string
+	}{
+		{[]byte{1, 2, 3}, ""},
+		{[]byte{1, 2, 4}, "at offset 0x2 (address 8002): assembled 03, golden 04"},
+		{[]byte{1, 2}, "at offset 0x2: assembled 3 bytes, golden 2 bytes"},
+		{[]byte{1, 2, 3, 4}, "at offset 0x3: assembled 3 bytes, golden 4 bytes"},
+	} {
+		golden := filepath.Join(dir, "golden.bin")
+		if err := ioutil.WriteFile(golden, tc.golden, 0666); err != nil {
+			t.Fatalf("failed to write golden file: %v", err)
+		}
+		err := Main(&Options{SourceFile: src, Verify: golden})
+		if tc.want == "" && err != nil {
+			t.Errorf("golden % x: got error %v, want success", tc.golden, err)
+		}
+		if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("golden % x: got error %v, want %q", tc.golden, err, tc.want)
+		}
+	}
+	if _, err := os.Stat(strings.TrimSuffix(src, ".asm") + ".sna"); err == nil {
+		t.Errorf("output was written when verifying")
+	}
+}
+
+func TestGapFill(t *testing.T) {
+	src := writeSource(t, "org 0x9000; db 1, 0; org 0x9004; db 0")
+	if err := Main(&Options{SourceFile: src, Format: FormatBin, GapFill: 0xff}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(strings.TrimSuffix(src, ".asm") + ".bin")
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if want := []byte{1, 0, 0xff, 0xff, 0}; !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := filepath.Dir(writeSource(t, "main: call lib; ret\ninclude \"lib.asm\""))
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.asm"), []byte("lib: ld a, 1; ret\n"), 0666); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	if err := Main(&Options{Dir: dir, Format: FormatBin}); err != nil {
+		t.Fatalf("Main failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "a.bin"))
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if want := []byte{0xcd, 0x04, 0x80, 0xc9, 0x3e, 0x01, 0xc9}; !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lib.bin")); err == nil {
+		t.Errorf("the included file was assembled on its own")
+	}
+}
+
+func TestIncludedFiles(t *testing.T) {
+	src := "include \"a.asm\"\nx: include \"b.asm\"; .y include \"c.asm\"\nld a, 1; include \"d.asm\"\n// include \"e.asm\"\nld a, include"
+	got := includedFiles(".", []byte(src))
+	if want := []string{"a.asm", "b.asm", "c.asm", "d.asm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("includedFiles = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,165 @@
+package z80asm
+
+import (
+	"strings"
+	"text/scanner"
+)
+
+// Conditional assembly: if expr, else and endif. Statements in a
+// branch that's not taken are skipped: no bytes are written and no
+// labels are defined, although they're still split into tokens.
+
+// A condState is the state of an if block.
+type condState struct {
+	outerSkip bool // the whole block is in a skipped branch
+	taken     bool // a branch of the block has been assembled
+	seenElse  bool
+	skip      bool // the current branch is skipped
+}
+
+// skipping reports whether statements are currently skipped.
+func (asm *Assembler) skipping() bool {
+	return len(asm.conds) > 0 && asm.conds[len(asm.conds)-1].skip
+}
+
+// isCondCommand reports whether the identifier is one of the
+// conditional assembly directives, which are handled even
+// when statements are skipped.
+func isCondCommand(id string) bool {
+	switch strings.ToLower(id) {
+	case "if", "else", "endif":
+		return true
+	}
+	return false
+}
+
+// skipStatement skips the tokens up to the end of the statement.
+func (asm *Assembler) skipStatement() error {
+	for {
+		tok, err := asm.nextToken()
+		if err != nil {
+			return err
+		}
+		if endStatement(tok) {
+			return nil
+		}
+	}
+}
+
+type commandIf struct{}
+
+// W for if starts a block that's assembled only if the
+// condition is non-zero: if cond.
+func (commandIf) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return asm.scanErrorf("expected syntax: if <expr>, got: if %v", args)
+	}
+	if asm.skipping() {
+		asm.conds = append(asm.conds, condState{outerSkip: true, skip: true})
+		return nil
+	}
+	asm.unresolved = false
+	n, ok, err := getIntValue(asm, args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("if condition should be a number, found %s", args[0])
+	}
+	// The branch taken must be the same in both passes, or the
+	// labels from pass 0 would be wrong. A condition using a label
+	// that's not yet defined is evaluated again once it's known,
+	// but it's an error if the result changes in the final pass.
+	asm.conds = append(asm.conds, condState{taken: n != 0, skip: n == 0})
+	i := asm.condCount
+	asm.condCount++
+	if asm.pass == 0 {
+		if asm.unresolved {
+			asm.provisionalOrg = true
+		}
+		asm.condResults = append(asm.condResults[:i], n != 0)
+	} else if i < len(asm.condResults) && asm.condResults[i] != (n != 0) {
+		return asm.scanErrorf("if condition %s changed between passes: it depends on a label that it moves", args[0])
+	}
+	return nil
+}
+
+type commandElse struct{}
+
+// W for else switches to the other branch of an if block.
+func (commandElse) W(asm *Assembler) error {
+	if err := asm.noArgs("else"); err != nil {
+		return err
+	}
+	if len(asm.conds) == 0 {
+		return asm.scanErrorf("else without if")
+	}
+	c := &asm.conds[len(asm.conds)-1]
+	if c.seenElse {
+		return asm.scanErrorf("more than one else for the same if")
+	}
+	c.seenElse = true
+	c.skip = c.outerSkip || c.taken
+	c.taken = true
+	return nil
+}
+
+type commandEndif struct{}
+
+// W for endif ends an if block.
+func (commandEndif) W(asm *Assembler) error {
+	if err := asm.noArgs("endif"); err != nil {
+		return err
+	}
+	if len(asm.conds) == 0 {
+		return asm.scanErrorf("endif without if")
+	}
+	asm.conds = asm.conds[:len(asm.conds)-1]
+	return nil
+}
+
+// noArgs checks that the directive cmd has no arguments.
+func (asm *Assembler) noArgs(cmd string) error {
+	tok, err := asm.nextToken()
+	if err != nil {
+		return err
+	}
+	if !endStatement(tok) {
+		return asm.scanErrorf("unexpected %s after %s", tok, cmd)
+	}
+	return nil
+}
+
+// skipOrAssemble handles a token at the start of a statement
+// when statements are skipped.
+func (asm *Assembler) skipOrAssemble(tok token) error {
+	isLabel := tok.t == scanner.Ident && asm.peekNonSpace() == ':'
+	if tok.t == scanner.Ident && !isLabel && isCondCommand(tok.s) {
+		return asm.commandTable[strings.ToLower(tok.s)].W(asm)
+	}
+	if tok.t == scanner.Ident && !isLabel && strings.ToLower(tok.s) == "macro" {
+		return asm.skipMacro()
+	}
+	if endStatement(tok) {
+		return nil
+	}
+	// A label is a statement of its own, so an else or endif
+	// that follows it on the same line isn't skipped.
+	if tok.t == '.' {
+		_, err := asm.nextToken()
+		return err
+	}
+	if tok.t == scanner.Ident {
+		if _, ok := asm.commandTable[strings.ToLower(tok.s)]; !ok || isLabel {
+			next, err := asm.nextToken()
+			if err != nil || next.t == ':' || endStatement(next) {
+				return err
+			}
+		}
+	}
+	return asm.skipStatement()
+}
@@ -4,13 +4,89 @@ package z80asm
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"strings"
 	"text/scanner"
 )
 
 type expr interface {
 	evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error)
 	stringPri(pri int) string
+	String() string
+}
+
+// An Expr is a parsed expression.
+// Its String method returns the expression in a canonical form,
+// with operators separated by spaces and redundant brackets removed.
+type Expr interface {
+	expr
+}
+
+// ParseExpr parses the given text as a single expression.
+func ParseExpr(text string) (Expr, error) {
+	asm, err := NewAssembler()
+	if err != nil {
+		return nil, err
+	}
+	var e expr
+	err = asm.withTextScanner(text, func() error {
+		var err error
+		e, err = asm.parseText()
+		return err
+	})
+	return e, err
+}
+
+// withTextScanner calls f with a temporary scanner
+// that reads the given text.
+func (asm *Assembler) withTextScanner(text string, f func() error) error {
+	asm.pushReader("expr", ioutil.NopCloser(strings.NewReader(text)))
+	err := f()
+	if _, perr := asm.popScanner(); err == nil {
+		err = perr
+	}
+	asm.scanErr = nil
+	return err
+}
+
+// parseText parses everything that remains in the scanner
+// as a single expression.
+func (asm *Assembler) parseText() (expr, error) {
+	e, tok, err := asm.parseExpression(0, false)
+	if err != nil {
+		return nil, err
+	}
+	if tok.t != scanner.EOF {
+		return nil, asm.scanErrorf("unexpected %s after expression", tok)
+	}
+	return e, nil
+}
+
+// Eval evaluates the given expression, using the labels and
+// consts from the assembled code. Minor labels can't be used.
+// It is only valid after the assembler has run.
+func (asm *Assembler) Eval(text string) (int64, error) {
+	maj := asm.currentMajorLabel
+	asm.currentMajorLabel = ""
+	defer func() { asm.currentMajorLabel = maj }()
+	var n int64
+	err := asm.withTextScanner(text, func() error {
+		e, err := asm.parseText()
+		if err != nil {
+			return err
+		}
+		var ok bool
+		n, ok, err = getIntValue(asm, e)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return asm.scanErrorf("can't compute value of %s", e)
+		}
+		return nil
+	})
+	return n, err
 }
 
 type exprInt struct {
@@ -22,8 +98,7 @@ func (ei exprInt) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error)
 	case argTypeInt, argTypeAddress:
 		return serializeIntArg(asm, ei.i, a)
 	case argTypeRelAddress:
-		/* TODO: figure out what to do here! */
-		return nil, false, nil
+		return evalAddressAs(asm, ei.i, a)
 	case argTypeFixed:
 		if !validFixedArgs[ei.i] {
 			return nil, false, asm.scanErrorf("0x%x is not a valid argument", ei.i)
@@ -88,6 +163,8 @@ func (euo exprUnaryOp) apply(n1 int64) int64 {
 		return ^n1
 	case '-':
 		return -n1
+	case '+':
+		return n1
 	}
 	log.Fatalf("Unknown unary op %c", euo.op)
 	return 0
@@ -107,6 +184,18 @@ func getIntValue(asm *Assembler, e expr) (int64, bool, error) {
 		return v.apply(n), true, nil
 	case exprInt:
 		return v.i, true, nil
+	case exprPC:
+		return int64(asm.statementPC), true, nil
+	case exprTernary:
+		return v.getIntValue(asm)
+	case exprDefined:
+		return v.getIntValue(asm)
+	case exprCall:
+		n, ok, err := getIntValue(asm, v.e)
+		if err != nil || !ok {
+			return 0, ok, err
+		}
+		return builtinFuncs[v.fn](n), true, nil
 	case exprBinaryOp:
 		n1, ok1, err1 := getIntValue(asm, v.e1)
 		if err1 != nil || !ok1 {
@@ -123,6 +212,16 @@ func getIntValue(asm *Assembler, e expr) (int64, bool, error) {
 }
 
 func (euo exprUnaryOp) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error) {
+	// A relative jump to a signed constant, such as jr +5,
+	// djnz -3 or jr -size, gives the displacement rather than
+	// the address.
+	if argType(a) == argTypeRelAddress && (euo.op == '+' || euo.op == '-') && isConstExpr(asm, euo.e) {
+		n, ok, err := getIntValue(asm, euo)
+		if err != nil || !ok {
+			return nil, ok, err
+		}
+		return serializeIntArg(asm, n, a)
+	}
 	iv, ok, err := getIntValue(asm, euo)
 	if err != nil || !ok {
 		return nil, ok, err
@@ -130,6 +229,32 @@ func (euo exprUnaryOp) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, er
 	return exprInt{iv}.evalAs(asm, a, top)
 }
 
+// isConstExpr reports whether e is made only of numbers and
+// consts, so that its value doesn't depend on any label or $.
+func isConstExpr(asm *Assembler, e expr) bool {
+	switch v := e.(type) {
+	case exprInt, exprChar:
+		return true
+	case exprBracket:
+		return isConstExpr(asm, v.e)
+	case exprUnaryOp:
+		return isConstExpr(asm, v.e)
+	case exprBinaryOp:
+		return isConstExpr(asm, v.e1) && isConstExpr(asm, v.e2)
+	case exprTernary:
+		return isConstExpr(asm, v.cond) && isConstExpr(asm, v.e1) && isConstExpr(asm, v.e2)
+	case exprCall:
+		return isConstExpr(asm, v.e)
+	case exprIdent:
+		if asm.inTable && strings.ToLower(v.id) == "i" {
+			return true
+		}
+		_, ok, _ := asm.GetConst(v.id)
+		return ok && !asm.tlabels[v.id]
+	}
+	return false
+}
+
 type exprBinaryOp struct {
 	op     rune
 	e1, e2 expr
@@ -143,7 +268,11 @@ func (ebo exprBinaryOp) stringPri(pri int) string {
 	myPri := opPrecedence[ebo.op]
 	left := ebo.e1.stringPri(myPri)
 	right := ebo.e2.stringPri(myPri + 1)
-	result := fmt.Sprintf("%s %c %s", left, ebo.op, right)
+	op := string(ebo.op)
+	if s, ok := tokStrings[ebo.op]; ok {
+		op = s
+	}
+	result := fmt.Sprintf("%s %s %s", left, op, right)
 	if myPri < pri {
 		return "(" + result + ")"
 	}
@@ -231,6 +360,132 @@ func (ebo exprBinaryOp) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, e
 	return exprInt{iv}.evalAs(asm, a, false)
 }
 
+// exprTernary is cond ? e1 : e2. Only the branch that's
+// chosen is evaluated.
+type exprTernary struct {
+	cond, e1, e2 expr
+}
+
+func (et exprTernary) getIntValue(asm *Assembler) (int64, bool, error) {
+	c, ok, err := getIntValue(asm, et.cond)
+	if err != nil || !ok {
+		return 0, ok, err
+	}
+	e := et.e1
+	if c == 0 {
+		e = et.e2
+	}
+	n, ok, err := getIntValue(asm, e)
+	if err == nil && !ok {
+		return 0, false, asm.scanErrorf("can't compute constant: %s", e)
+	}
+	return n, ok, err
+}
+
+func (et exprTernary) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error) {
+	iv, ok, err := et.getIntValue(asm)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	return exprInt{iv}.evalAs(asm, a, false)
+}
+
+func (et exprTernary) String() string {
+	return et.stringPri(0)
+}
+
+func (et exprTernary) stringPri(pri int) string {
+	result := fmt.Sprintf("%s ? %s : %s", et.cond.stringPri(precTernary+1), et.e1.stringPri(precDup+1), et.e2.stringPri(precTernary))
+	if precTernary < pri {
+		return "(" + result + ")"
+	}
+	return result
+}
+
+// builtinFuncs are the functions that can be used in
+// expressions, such as high(label).
+var builtinFuncs = map[string]func(int64) int64{
+	"high": func(n int64) int64 { return (n >> 8) & 0xff },
+	"low":  func(n int64) int64 { return n & 0xff },
+}
+
+// exprCall is fn(e), a call of one of the builtinFuncs.
+type exprCall struct {
+	fn string
+	e  expr
+}
+
+func (ec exprCall) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error) {
+	iv, ok, err := getIntValue(asm, ec)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	return exprInt{iv}.evalAs(asm, a, false)
+}
+
+func (ec exprCall) String() string {
+	return fmt.Sprintf("%s(%s)", ec.fn, ec.e)
+}
+
+func (ec exprCall) stringPri(int) string {
+	return ec.String()
+}
+
+// exprDefined is defined(id): 1 if id is a const or label
+// that's defined before it's used, and 0 otherwise. Labels
+// defined later in the source don't count, even in the final
+// pass when their values are known, so that the value is the
+// same in every pass.
+type exprDefined struct {
+	id string
+}
+
+func (ed exprDefined) getIntValue(asm *Assembler) (int64, bool, error) {
+	if asm.constsDef[ed.id] {
+		return 1, true, nil
+	}
+	name, _, ok := asm.lookupLabel(asm.currentMajorLabel, ed.id)
+	return bool2int(ok && asm.labelsDef[name]), true, nil
+}
+
+func (ed exprDefined) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error) {
+	iv, _, err := ed.getIntValue(asm)
+	if err != nil {
+		return nil, false, err
+	}
+	return exprInt{iv}.evalAs(asm, a, false)
+}
+
+func (ed exprDefined) String() string {
+	return fmt.Sprintf("defined(%s)", ed.id)
+}
+
+func (ed exprDefined) stringPri(int) string {
+	return ed.String()
+}
+
+// exprDup is n copies of e, which can only be used as
+// an argument to db or dw.
+type exprDup struct {
+	n, e expr
+}
+
+func (ed exprDup) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error) {
+	return nil, false, nil
+}
+
+func (ed exprDup) String() string {
+	return ed.stringPri(0)
+}
+
+func (ed exprDup) stringPri(pri int) string {
+	result := fmt.Sprintf("%s dup %s", ed.n.stringPri(precDup), ed.e.stringPri(precDup+1))
+	if precDup < pri {
+		return "(" + result + ")"
+	}
+	return result
+}
+
 type exprBracket struct {
 	e expr
 }
@@ -329,6 +584,9 @@ func (ei exprIdent) stringPri(int) string {
 }
 
 func (ei exprIdent) getIntValue(asm *Assembler) (int64, bool, error) {
+	if asm.inTable && strings.ToLower(ei.id) == "i" {
+		return asm.tableIndex, true, nil
+	}
 	if ei.r != 0 || ei.cc != 0 {
 		return 0, false, nil
 	}
@@ -339,10 +597,16 @@ func (ei exprIdent) getIntValue(asm *Assembler) (int64, bool, error) {
 	if ok {
 		return int64(c), true, nil
 	}
-	i, ok := asm.GetLabel(asm.currentMajorLabel, ei.id)
+	name, i, ok := asm.lookupLabel(asm.currentMajorLabel, ei.id)
 	if asm.pass > 0 && !ok {
 		return 0, false, asm.scanErrorf("unknown const or label %q", ei.id)
 	}
+	if !ok {
+		asm.unresolved = true
+	}
+	if asm.pass > 0 {
+		asm.labelUsed[name] = true
+	}
 	return int64(i), true, nil
 }
 
@@ -357,21 +621,59 @@ func (ei exprIdent) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error
 		if err != nil || !ok {
 			return nil, ok, err
 		}
-		if argType(a) == argTypeRelAddress && ok {
-			if asm.pass == 0 {
-				// We may not have the label defined in pass 0.
-				// So we set the relative jump to 0 to make
-				// sure it's in range.
-				// If it's out of range, pass 1 will catch it.
-				r = 0
-			} else {
-				// 2 assumes that the length of the instruction is 2 bytes.
-				// That happens to be true for all the z80 instructions
-				// that take a relative offset.
-				r -= int64(asm.pc + 2)
+		if asm.pass == 1 && (a == const16 || a == addr16) {
+			if _, isConst, _ := asm.GetConst(ei.id); !isConst {
+				name, _, _ := asm.lookupLabel(asm.currentMajorLabel, ei.id)
+				asm.pendingReloc = &Reloc{Label: name}
 			}
 		}
-		return serializeIntArg(asm, r, a)
+		return evalAddressAs(asm, r, a)
+	}
+	return nil, false, nil
+}
+
+// evalAddressAs serializes r, which may be an address, as the
+// given int, address or relative address argument.
+func evalAddressAs(asm *Assembler, r int64, a arg) ([]byte, bool, error) {
+	if argType(a) == argTypeRelAddress {
+		if asm.pass == 0 {
+			// We may not have the label defined in pass 0.
+			// So we set the relative jump to 0 to make
+			// sure it's in range.
+			// If it's out of range, pass 1 will catch it.
+			r = 0
+		} else {
+			// 2 assumes that the length of the instruction is 2 bytes.
+			// That happens to be true for all the z80 instructions
+			// that take a relative offset.
+			target := r
+			if target < 0 || target > 0xffff {
+				return nil, false, asm.scanErrorf("relative jump to %d is outside the address range 0..0xffff", target)
+			}
+			r -= int64(asm.pc + 2)
+			if min, max, _ := argRange(a); r < min || r > max {
+				return nil, false, asm.scanErrorf("relative jump to 0x%04x is out of range (%d..%d), offset %d", target, min, max, r)
+			}
+		}
+	}
+	return serializeIntArg(asm, r, a)
+}
+
+// exprPC is $, the pc at the start of the statement.
+type exprPC struct{}
+
+func (exprPC) String() string {
+	return "$"
+}
+
+func (ep exprPC) stringPri(int) string {
+	return ep.String()
+}
+
+func (exprPC) evalAs(asm *Assembler, a arg, top bool) ([]byte, bool, error) {
+	switch argType(a) {
+	case argTypeInt, argTypeAddress, argTypeRelAddress:
+		return evalAddressAs(asm, int64(asm.statementPC), a)
 	}
 	return nil, false, nil
 }
@@ -381,7 +683,7 @@ type exprChar struct {
 }
 
 func (ec exprChar) String() string {
-	return fmt.Sprintf("%c", ec.r)
+	return fmt.Sprintf("%q", ec.r)
 }
 
 func (ec exprChar) stringPri(int) string {
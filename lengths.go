@@ -0,0 +1,97 @@
+package z80asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The length of an instruction depends only on its mnemonic and
+// the shape of its arguments: which registers and condition codes
+// are used, and where there are brackets and numbers. With
+// WithComputeLabelsFirst, pass 0 caches instruction lengths by
+// shape, so that instructions with a shape that's been seen
+// before needn't be matched against the instruction tables.
+
+// argsShape returns the shape of a list of instruction arguments.
+func argsShape(vals []expr) string {
+	var parts []string
+	for _, v := range vals {
+		parts = append(parts, exprShape(v))
+	}
+	return strings.Join(parts, ",")
+}
+
+// exprShape returns the shape of an expression. Expressions that
+// don't involve registers or condition codes have the shape "n".
+func exprShape(e expr) string {
+	if !hasRegOrCC(e) {
+		switch e.(type) {
+		case exprBracket:
+			return "(n)"
+		case exprString:
+			return "s"
+		case exprDup:
+			return "dup"
+		}
+		return "n"
+	}
+	switch v := e.(type) {
+	case exprIdent:
+		return v.id
+	case exprBracket:
+		return "(" + exprShape(v.e) + ")"
+	case exprUnaryOp:
+		return string(v.op) + exprShape(v.e)
+	case exprBinaryOp:
+		return exprShape(v.e1) + string(v.op) + exprShape(v.e2)
+	case exprTernary:
+		return exprShape(v.cond) + "?" + exprShape(v.e1) + ":" + exprShape(v.e2)
+	case exprCall:
+		return v.fn + "(" + exprShape(v.e) + ")"
+	case exprDup:
+		return "dup"
+	}
+	return "?"
+}
+
+// hasRegOrCC reports whether the expression uses a register
+// or condition code.
+func hasRegOrCC(e expr) bool {
+	switch v := e.(type) {
+	case exprIdent:
+		return v.r != 0 || v.cc != 0
+	case exprBracket:
+		return hasRegOrCC(v.e)
+	case exprUnaryOp:
+		return hasRegOrCC(v.e)
+	case exprBinaryOp:
+		return hasRegOrCC(v.e1) || hasRegOrCC(v.e2)
+	case exprTernary:
+		return hasRegOrCC(v.cond) || hasRegOrCC(v.e1) || hasRegOrCC(v.e2)
+	case exprCall:
+		return hasRegOrCC(v.e)
+	case exprDup:
+		return hasRegOrCC(v.n) || hasRegOrCC(v.e)
+	}
+	return false
+}
+
+// InstructionLength returns the number of bytes the given
+// instruction assembles to for the given core, without writing
+// it anywhere. Labels used by the instruction needn't be defined.
+// text must contain exactly one instruction.
+func InstructionLength(core Z80Core, text string) (int, error) {
+	asm, err := NewAssembler(UseNextCore(core))
+	if err != nil {
+		return 0, err
+	}
+	// Pass 0 allows undefined labels, and doesn't store bytes.
+	start := asm.pc
+	if err := asm.assembleFile("instruction", asm.textSource("instruction", []byte(text))); err != nil {
+		return 0, err
+	}
+	if asm.commands != 1 {
+		return 0, fmt.Errorf("%q is not a single instruction", text)
+	}
+	return asm.pc - start, nil
+}
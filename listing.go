@@ -0,0 +1,183 @@
+package z80asm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// listBytesPerLine is the most bytes shown on a line of the
+// listing. Statements that write more bytes continue on the
+// following lines.
+const listBytesPerLine = 4
+
+// A lister writes the listing of the final pass: each source
+// line, with the address and bytes written by its statements.
+type lister struct {
+	w      io.Writer
+	err    error
+	active bool          // the final pass is running
+	srcs   []*listSource // parallel to the stack of scanners
+}
+
+// A listSource records the text of a source as the scanner reads
+// it, and the bytes written by the statements on the current line.
+// Lines are only listed once the scanner has moved past them, so
+// that their text has been read.
+type listSource struct {
+	r    io.ReadCloser
+	text []byte
+	off  int // the offset in text of the start of line
+	line int // the line being assembled, counting from 1
+	// listed is set if line has already been listed, because
+	// a source was pushed from it, so only bytes written
+	// afterwards remain to be listed.
+	listed bool
+	addr   int // the pc of the first byte written on the line
+	bytes  []byte
+}
+
+func (ls *listSource) Read(p []byte) (int, error) {
+	n, err := ls.r.Read(p)
+	ls.text = append(ls.text, p[:n]...)
+	return n, err
+}
+
+func (ls *listSource) Close() error {
+	return ls.r.Close()
+}
+
+// WithListing makes the assembler write a listing of the code
+// to w: each line of source, preceded by the address and the
+// bytes that it assembled to.
+func WithListing(w io.Writer) AssemblerOpt {
+	return func(a *assemblerOption) error {
+		a.listing = w
+		return nil
+	}
+}
+
+// listReader returns the reader for a source that's being pushed
+// onto the stack of scanners, recording its text if it's listed.
+func (asm *Assembler) listReader(f io.ReadCloser) io.ReadCloser {
+	if asm.listing == nil || !asm.listing.active {
+		return f
+	}
+	// List the line that includes the new source (for example
+	// by include, or using a macro) before the new source's lines.
+	if n := len(asm.listing.srcs); n > 0 {
+		asm.listing.writeCurrent(asm.listing.srcs[n-1])
+	}
+	ls := &listSource{r: f, line: 1}
+	asm.listing.srcs = append(asm.listing.srcs, ls)
+	return ls
+}
+
+// listPop lists the rest of the source that's finished.
+func (asm *Assembler) listPop() {
+	if asm.listing == nil || len(asm.listing.srcs) == 0 {
+		return
+	}
+	srcs := asm.listing.srcs
+	ls := srcs[len(srcs)-1]
+	asm.listing.srcs = srcs[:len(srcs)-1]
+	asm.listing.writeLines(ls, -1)
+}
+
+// listStatement is called at the start of each statement, and
+// lists the lines before it.
+func (asm *Assembler) listStatement() {
+	if asm.listing == nil || len(asm.listing.srcs) == 0 {
+		return
+	}
+	ls := asm.listing.srcs[len(asm.listing.srcs)-1]
+	if line := asm.scan().Position.Line; line > ls.line {
+		asm.listing.writeLines(ls, line)
+	}
+}
+
+// listByte records a byte written at the current pc.
+func (asm *Assembler) listByte(u uint8) {
+	if asm.listing == nil || len(asm.listing.srcs) == 0 {
+		return
+	}
+	ls := asm.listing.srcs[len(asm.listing.srcs)-1]
+	if len(ls.bytes) == 0 {
+		ls.addr = asm.pc
+	}
+	ls.bytes = append(ls.bytes, u)
+}
+
+// writeLines lists the lines of ls before the given line, or
+// all the remaining lines if line is negative.
+func (l *lister) writeLines(ls *listSource, line int) {
+	for (line < 0 && (ls.listed || ls.off < len(ls.text))) || ls.line < line {
+		if ls.listed {
+			if len(ls.bytes) > 0 {
+				l.writeLine(ls.addr, ls.bytes, "")
+			}
+			ls.listed = false
+		} else {
+			l.writeLine(ls.addr, ls.bytes, ls.nextLine())
+		}
+		ls.line++
+		ls.bytes = nil
+	}
+	// Bytes written after the end of the text, for
+	// example by a statement with no newline after it.
+	if len(ls.bytes) > 0 {
+		l.writeLine(ls.addr, ls.bytes, "")
+		ls.bytes = nil
+	}
+}
+
+// writeCurrent lists the current line of ls.
+func (l *lister) writeCurrent(ls *listSource) {
+	if ls.listed {
+		return
+	}
+	l.writeLine(ls.addr, ls.bytes, ls.nextLine())
+	ls.listed = true
+	ls.bytes = nil
+}
+
+// nextLine returns the text of the next line of ls to be listed.
+func (ls *listSource) nextLine() string {
+	text := ls.text[ls.off:]
+	if i := bytes.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+		ls.off += i + 1
+	} else {
+		ls.off = len(ls.text)
+	}
+	return strings.TrimRight(string(text), "\r")
+}
+
+// writeLine writes a line of source to the listing, with the
+// bytes written by its statements starting at addr.
+func (l *lister) writeLine(addr int, bs []byte, src string) {
+	width := 3*listBytesPerLine - 1
+	if len(bs) == 0 {
+		l.write(fmt.Sprintf("%4s  %*s  %s", "", width, "", src))
+		return
+	}
+	for i := 0; i < len(bs); i += listBytesPerLine {
+		end := i + listBytesPerLine
+		if end > len(bs) {
+			end = len(bs)
+		}
+		var hex []string
+		for _, b := range bs[i:end] {
+			hex = append(hex, fmt.Sprintf("%02x", b))
+		}
+		l.write(fmt.Sprintf("%04x  %-*s  %s", (addr+i)&0xffff, width, strings.Join(hex, " "), src))
+		src = ""
+	}
+}
+
+func (l *lister) write(line string) {
+	if l.err == nil {
+		_, l.err = fmt.Fprintln(l.w, strings.TrimRight(line, " "))
+	}
+}
@@ -0,0 +1,258 @@
+package z80asm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/scanner"
+)
+
+// Macros: macro name p1, p2, ... defines name as a directive,
+// and the statements up to endm are its body. When the macro is
+// used, the parameters in the body are replaced by the arguments,
+// and the result is assembled in place of the invocation.
+
+// maxMacroDepth limits how deeply macros can invoke each other,
+// to catch a macro that invokes itself.
+const maxMacroDepth = 64
+
+// A macroToken is a token in the body of a macro, as written.
+type macroToken struct {
+	t      rune
+	text   string
+	offset int // byte offset in the source, to reproduce spacing
+}
+
+type macro struct {
+	name   string
+	params []string
+	body   []macroToken
+	labels map[string]bool // labels defined in the body
+}
+
+type commandMacro struct{}
+
+// W for macro defines a macro: macro name p1, p2, ... up to endm.
+func (commandMacro) W(asm *Assembler) error {
+	tok, err := asm.nextToken()
+	if err != nil {
+		return err
+	}
+	if tok.t != scanner.Ident {
+		return asm.scanErrorf("expected syntax: macro <name> <param>, ..., got macro %s", tok)
+	}
+	name := strings.ToLower(tok.s)
+	m := &macro{name: name}
+	for {
+		tok, err := asm.nextToken()
+		if err != nil {
+			return err
+		}
+		if endStatement(tok) && len(m.params) == 0 {
+			break
+		}
+		if tok.t != scanner.Ident {
+			return asm.scanErrorf("expected macro parameter name, found %s", tok)
+		}
+		for _, p := range m.params {
+			if p == tok.s {
+				return asm.scanErrorf("duplicate macro parameter %s", p)
+			}
+		}
+		m.params = append(m.params, tok.s)
+		if tok, err = asm.nextToken(); err != nil {
+			return err
+		}
+		if endStatement(tok) {
+			break
+		}
+		if tok.t != ',' {
+			return asm.scanErrorf("unexpected %s after macro parameter", tok)
+		}
+	}
+	if m.body, err = asm.readBlock("macro "+name, "macro", "endm"); err != nil {
+		return err
+	}
+	m.labels = macroLabels(m.body)
+	if _, ok := asm.macros[name]; ok {
+		return asm.scanErrorf("macro %s is already defined", name)
+	}
+	if _, ok := asm.commandTable[name]; ok {
+		return asm.scanErrorf("can't define macro %s: it's already a directive or instruction", name)
+	}
+	asm.macros[name] = m
+	asm.commandTable[name] = m
+	return nil
+}
+
+// readBlock reads the tokens up to the end directive that
+// finishes the block started by the directive dir. Blocks of the
+// same kind can be nested, except for macro definitions. what
+// describes the block for errors.
+func (asm *Assembler) readBlock(what, dir, end string) ([]macroToken, error) {
+	var body []macroToken
+	atStart := true
+	depth := 0
+	for {
+		s := asm.scan()
+		t := s.Scan()
+		if asm.scanErr != nil {
+			return nil, asm.scanErr
+		}
+		tok := macroToken{t: t, text: s.TokenText(), offset: s.Position.Offset}
+		switch t {
+		case scanner.EOF:
+			return nil, asm.scanErrorf("%s without %s", what, end)
+		case scanner.Ident:
+			// As in expressions, af' is read as one identifier.
+			if tok.text == "af" && s.Peek() == '\'' {
+				s.Next()
+				tok.text += "'"
+			}
+			// A name followed by a ':' is a label, not a directive.
+			if atStart && asm.peekNonSpace() != ':' {
+				switch strings.ToLower(tok.text) {
+				case end:
+					if depth == 0 {
+						if err := asm.noArgs(end); err != nil {
+							return nil, err
+						}
+						return body, nil
+					}
+					depth--
+				case dir:
+					if dir == "macro" {
+						return nil, asm.scanErrorf("macro definitions can't be nested")
+					}
+					depth++
+				}
+			}
+		}
+		atStart = t == '\n' || t == ';'
+		body = append(body, tok)
+	}
+}
+
+// macroLabels finds the labels that are defined in a macro body.
+func macroLabels(body []macroToken) map[string]bool {
+	labels := map[string]bool{}
+	atStart := true
+	for i := 0; i < len(body); i++ {
+		t := body[i].t
+		if atStart && i+1 < len(body) {
+			if t == '.' && body[i+1].t == scanner.Ident {
+				labels[body[i+1].text] = true
+				i++
+				continue
+			}
+			if t == scanner.Ident && body[i+1].t == ':' {
+				labels[body[i].text] = true
+				i++
+				continue
+			}
+		}
+		atStart = t == '\n' || t == ';'
+	}
+	return labels
+}
+
+// W for a macro assembles its body, with the arguments
+// in place of the parameters.
+func (m *macro) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != len(m.params) {
+		return asm.scanErrorf("macro %s expects %d arguments, got %d", m.name, len(m.params), len(args))
+	}
+	if asm.macroDepth >= maxMacroDepth {
+		return asm.scanErrorf("macros nested more than %d deep in macro %s", maxMacroDepth, m.name)
+	}
+	subst := map[string]string{}
+	for i, p := range m.params {
+		subst[p] = args[i].String()
+	}
+	asm.pushText("macro "+m.name, asm.expandBlock(m.name, m.body, m.labels, subst))
+	return nil
+}
+
+// expandBlock returns the text of the tokens in body, with
+// identifiers in subst replaced. The labels defined in the body
+// get a suffix that's different each time the body is expanded,
+// so that they don't collide.
+func (asm *Assembler) expandBlock(name string, body []macroToken, labels map[string]bool, subst map[string]string) string {
+	asm.macroCount++
+	for l := range labels {
+		if _, ok := subst[l]; !ok {
+			subst[l] = fmt.Sprintf("%s__%s%d", l, name, asm.macroCount)
+			asm.localLabels[asm.labelPrefix+subst[l]] = true
+		}
+	}
+	var sb strings.Builder
+	for i, tok := range body {
+		if i > 0 {
+			prev := body[i-1]
+			if tok.offset != prev.offset+len(prev.text) {
+				sb.WriteByte(' ')
+			}
+		}
+		if s, ok := subst[tok.text]; ok && tok.t == scanner.Ident {
+			sb.WriteString(s)
+		} else {
+			sb.WriteString(tok.text)
+		}
+	}
+	if n := len(body); n == 0 || body[n-1].t != '\n' {
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// pushText assembles text next, as the expansion of what.
+func (asm *Assembler) pushText(what, text string) {
+	asm.pushReader(fmt.Sprintf("%s: %s", asm.location(), what), ioutil.NopCloser(strings.NewReader(text)))
+	asm.macroDepth++
+	// Major labels in the text don't change the major label of
+	// the statements that follow it.
+	major := asm.currentMajorLabel
+	asm.onPop[len(asm.onPop)-1] = func() error {
+		asm.macroDepth--
+		asm.currentMajorLabel = major
+		return nil
+	}
+}
+
+type commandEndm struct{}
+
+// W for endm reports an error, since endm is read
+// as part of the macro definition.
+func (commandEndm) W(asm *Assembler) error {
+	return asm.scanErrorf("endm without macro")
+}
+
+// skipMacro skips the definition of a macro in a branch
+// of an if block that isn't assembled.
+func (asm *Assembler) skipMacro() error {
+	tok, err := asm.nextToken()
+	if err != nil {
+		return err
+	}
+	if !endStatement(tok) {
+		if err := asm.skipStatement(); err != nil {
+			return err
+		}
+	}
+	_, err = asm.readBlock("macro "+tok.s, "macro", "endm")
+	return err
+}
+
+// resetMacros forgets the macros defined in the previous pass,
+// so that a macro can't be used before its definition.
+func (asm *Assembler) resetMacros() {
+	for name := range asm.macros {
+		delete(asm.commandTable, name)
+	}
+	asm.macros = map[string]*macro{}
+	asm.macroCount = 0
+}
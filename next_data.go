@@ -0,0 +1,139 @@
+package z80asm
+
+import (
+	"path"
+	"strings"
+)
+
+// This file contains directives that write data structures
+// used by Spectrum Next hardware.
+
+var nextDirectiveTable = map[string]instrAssembler{
+	"copwait": commandCopWait{},
+	"copmove": commandCopMove{},
+	"dmaload": commandDMALoad{},
+	"palette": commandPalette{},
+}
+
+// parseIntArgs parses exactly n integer arguments for the
+// named directive, and checks they're in the given ranges.
+func (asm *Assembler) parseIntArgs(cmd string, ranges ...[2]int64) ([]int64, error) {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != len(ranges) {
+		return nil, asm.scanErrorf("%s takes %d arguments: %d found", cmd, len(ranges), len(args))
+	}
+	var r []int64
+	for i, a := range args {
+		n, ok, err := getIntValue(asm, a)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, asm.scanErrorf("%s argument %d should be a number, found %s", cmd, i+1, a)
+		}
+		if n < ranges[i][0] || n > ranges[i][1] {
+			return nil, asm.scanErrorf("%s argument %d is %d, not in the range %d...%d", cmd, i+1, n, ranges[i][0], ranges[i][1])
+		}
+		r = append(r, n)
+	}
+	return r, nil
+}
+
+type commandCopWait struct{}
+
+// W for copwait writes a copper WAIT instruction:
+// copwait line, hpos.
+func (commandCopWait) W(asm *Assembler) error {
+	ns, err := asm.parseIntArgs("copwait", [2]int64{0, 511}, [2]int64{0, 63})
+	if err != nil {
+		return err
+	}
+	w := 0x8000 | ns[1]<<9 | ns[0]
+	return asm.writeBytes([]byte{byte(w >> 8), byte(w)})
+}
+
+type commandCopMove struct{}
+
+// W for copmove writes a copper MOVE instruction:
+// copmove reg, value.
+func (commandCopMove) W(asm *Assembler) error {
+	ns, err := asm.parseIntArgs("copmove", [2]int64{0, 127}, [2]int64{0, 255})
+	if err != nil {
+		return err
+	}
+	return asm.writeBytes([]byte{byte(ns[0]), byte(ns[1])})
+}
+
+type commandDMALoad struct{}
+
+// W for dmaload writes a zxnDMA program that copies memory:
+// dmaload source, dest, length.
+func (commandDMALoad) W(asm *Assembler) error {
+	ns, err := asm.parseIntArgs("dmaload", [2]int64{0, 65535}, [2]int64{0, 65535}, [2]int64{0, 65535})
+	if err != nil {
+		return err
+	}
+	src, dest, length := ns[0], ns[1], ns[2]
+	return asm.writeBytes([]byte{
+		0x83,                      // WR6: disable dma
+		0x7d,                      // WR0: transfer A->B, port A address and length follow
+		byte(src), byte(src >> 8), // port A start address
+		byte(length), byte(length >> 8), // block length
+		0x54, 0x02, // WR1: port A is memory, incrementing, 2t cycle
+		0x50, 0x02, // WR2: port B is memory, incrementing, 2t cycle
+		0xad,                        // WR4: continuous mode, port B address follows
+		byte(dest), byte(dest >> 8), // port B start address
+		0x82, // WR5: stop on end of block, /ce only
+		0xcf, // WR6: load
+		0x87, // WR6: enable dma
+	})
+}
+
+type commandPalette struct{}
+
+// W for palette writes the palette in the named file as
+// Next 9-bit palette entries: RRRGGGBB, then 0000000B.
+// Files with the extension .nxp are already in this format.
+// Other files contain 8-bit RGB triples, which are reduced
+// to 3 bits per channel.
+func (commandPalette) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return asm.scanErrorf("expected \"filename\" to follow palette, got: %v", args)
+	}
+	name, err := getString(args[0])
+	if err != nil {
+		return asm.scanErrorf("expected \"filename\" to follow palette, got: %v", args[0])
+	}
+	data, err := asm.readFile("palette", name)
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(path.Ext(name)) == ".nxp" {
+		if len(data)%2 != 0 {
+			return asm.scanErrorf("palette %q has %d bytes, which isn't a whole number of 2-byte entries", name, len(data))
+		}
+		for i := 1; i < len(data); i += 2 {
+			if data[i] > 1 {
+				return asm.scanErrorf("palette %q has bad second byte %02x in entry %d", name, data[i], i/2)
+			}
+		}
+		return asm.writeBytes(data)
+	}
+	if len(data)%3 != 0 {
+		return asm.scanErrorf("palette %q has %d bytes, which isn't a whole number of RGB triples", name, len(data))
+	}
+	for i := 0; i < len(data); i += 3 {
+		r, g, b := data[i]>>5, data[i+1]>>5, data[i+2]>>5
+		if err := asm.writeBytes([]byte{r<<5 | g<<2 | b>>1, b & 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package z80asm
+
+// nextPorts are the I/O ports of the Spectrum Next. When assembling
+// for a Next core, they're predefined as consts, using the names
+// from the Next's documentation: the port's function followed by
+// _P_ and the port number in hex.
+var nextPorts = map[string]int64{
+	"ULA_P_FE":                         0xfe,
+	"TIMEX_P_FF":                       0xff,
+	"ZX128_MEMORY_P_7FFD":              0x7ffd,
+	"ZXN_MEMORY_P_DFFD":                0xdffd,
+	"ZX128P3_MEMORY_P_1FFD":            0x1ffd,
+	"AY_REG_P_FFFD":                    0xfffd,
+	"AY_DATA_P_BFFD":                   0xbffd,
+	"ZXN_DMA_P_6B":                     0x6b,
+	"ZX_DMA_P_0B":                      0x0b,
+	"TBBLUE_REGISTER_SELECT_P_243B":    0x243b,
+	"TBBLUE_REGISTER_ACCESS_P_253B":    0x253b,
+	"LAYER2_ACCESS_P_123B":             0x123b,
+	"I2C_SCL_P_103B":                   0x103b,
+	"I2C_SDA_P_113B":                   0x113b,
+	"UART_TX_P_133B":                   0x133b,
+	"UART_RX_P_143B":                   0x143b,
+	"UART_SELECT_P_153B":               0x153b,
+	"UART_FRAME_P_163B":                0x163b,
+	"SPRITE_STATUS_SLOT_SELECT_P_303B": 0x303b,
+	"SPRITE_ATTRIBUTE_P_57":            0x57,
+	"SPRITE_PATTERN_P_5B":              0x5b,
+	"KEMPSTON_JOYSTICK_P_1F":           0x1f,
+	"KEMPSTON_JOYSTICK_2_P_37":         0x37,
+	"KEMPSTON_MOUSE_X_P_FBDF":          0xfbdf,
+	"KEMPSTON_MOUSE_Y_P_FFDF":          0xffdf,
+	"KEMPSTON_MOUSE_B_P_FADF":          0xfadf,
+	"SPI_CS_P_E7":                      0xe7,
+	"SPI_DATA_P_EB":                    0xeb,
+}
@@ -0,0 +1,157 @@
+package z80asm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/paulhankin/z80asm/z80io"
+)
+
+// labelRange returns the memory locations [start, end) of the
+// code between two labels.
+func (asm *Assembler) labelRange(startLabel, endLabel string) (int, int, error) {
+	if asm.stream != nil {
+		return 0, 0, fmt.Errorf("assembled code isn't in RAM when streaming output")
+	}
+	startName, _, ok := asm.lookupLabel("", startLabel)
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown label %q", startLabel)
+	}
+	endName, _, ok := asm.lookupLabel("", endLabel)
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown label %q", endLabel)
+	}
+	start, end := asm.labelTarget[startName], asm.labelTarget[endName]
+	if end < start || end > len(asm.m) {
+		return 0, 0, fmt.Errorf("labels %q and %q don't give a valid range: %x...%x", startLabel, endLabel, start, end)
+	}
+	return start, end, nil
+}
+
+// CRC16 returns the CRC-16 of the assembled bytes from startLabel
+// up to (but not including) endLabel. The CRC uses the given
+// polynomial (for example, 0x1021 for CRC-16/CCITT-FALSE), starts
+// from 0xffff, processes bits most-significant first with no
+// reflection of the input or output, and has no final xor.
+// It is only valid after the assembler has run.
+func (asm *Assembler) CRC16(startLabel, endLabel string, poly uint16) (uint16, error) {
+	start, end, err := asm.labelRange(startLabel, endLabel)
+	if err != nil {
+		return 0, err
+	}
+	crc := uint16(0xffff)
+	for _, b := range asm.m[start:end] {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc, nil
+}
+
+// Patch overwrites the assembled bytes at the given label,
+// for example to fill a reserved word with a CRC16.
+// It is only valid after the assembler has run.
+func (asm *Assembler) Patch(label string, data []byte) error {
+	start, _, err := asm.labelRange(label, label)
+	if err != nil {
+		return err
+	}
+	if start+len(data) > len(asm.m) {
+		return fmt.Errorf("patch of %d bytes at %q (%x) goes past the end of RAM", len(data), label, start)
+	}
+	copy(asm.m[start:], data)
+	return nil
+}
+
+// AppendCode writes data just after the last byte of the written
+// range, as code that runs from the pc that follows that byte,
+// which may differ from its target if it was assembled with
+// org pc, target. It returns the pc of the first byte of data.
+// It is only valid after the assembler has run.
+func (asm *Assembler) AppendCode(data []byte) (uint16, error) {
+	if asm.stream != nil {
+		return 0, fmt.Errorf("assembled code isn't in RAM when streaming output")
+	}
+	if !asm.written {
+		return 0, fmt.Errorf("no code to append to")
+	}
+	pc := asm.maxWrittenPC + 1
+	if pc+len(data) > 0x10000 {
+		return 0, fmt.Errorf("no room for %d bytes after the code at %04x", len(data), pc)
+	}
+	if asm.fixedRAM && asm.maxWritten+1+len(data) > len(asm.m) {
+		return 0, fmt.Errorf("no room for %d bytes after the code in the %d byte RAM buffer", len(data), len(asm.m))
+	}
+	asm.pc, asm.target = pc, asm.maxWritten+1
+	for _, b := range data {
+		if err := asm.storeByte(b); err != nil {
+			return 0, err
+		}
+		asm.pc++
+		asm.target++
+	}
+	return uint16(pc), nil
+}
+
+// PeekTarget returns the byte written at the given memory location
+// (a target, rather than a pc), or false if nothing has been written
+// there so far, for example because it's in a gap skipped over by
+// org. Bytes are only written in the final pass, and aren't
+// available when streaming the output.
+func (asm *Assembler) PeekTarget(offset int) (byte, bool) {
+	if asm.stream != nil || !asm.isWritten(offset) {
+		return 0, false
+	}
+	return asm.m[offset], true
+}
+
+// LabelSpan returns the memory locations [start, end) of the code
+// from the given label up to the next major label in memory, or to
+// the end of the written range if there's no later major label.
+// Minor labels, such as the loops inside a routine, don't end the
+// span.
+// It is only valid after the assembler has run.
+func (asm *Assembler) LabelSpan(label string) (int, int, error) {
+	start, _, err := asm.labelRange(label, label)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, end := asm.WrittenRange()
+	for name, t := range asm.labelTarget {
+		if strings.Contains(name, ".") {
+			continue
+		}
+		if t > start && t < end {
+			end = t
+		}
+	}
+	if end < start {
+		end = start
+	}
+	return start, end, nil
+}
+
+// WriteIHEX writes the written range of RAM to w in Intel HEX
+// format, skipping the given gaps, each as [start, end). With no
+// gaps, it skips the bytes the assembler didn't write, as given
+// by Gaps, so that memory skipped over by org isn't in the file.
+// It is only valid after the assembler has run.
+func (asm *Assembler) WriteIHEX(w io.Writer, gaps ...[2]int) error {
+	if asm.stream != nil {
+		return fmt.Errorf("assembled code isn't in RAM when streaming output")
+	}
+	start, end := asm.WrittenRange()
+	if end > 0x10000 {
+		return fmt.Errorf("written range %04x...%04x doesn't fit in 64k", start, end)
+	}
+	if len(gaps) == 0 {
+		gaps = asm.Gaps(start, end)
+	}
+	return z80io.WriteIHEX(w, asm.m[start:end], uint16(start), gaps...)
+}
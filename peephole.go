@@ -0,0 +1,28 @@
+package z80asm
+
+import "bytes"
+
+// peepholeRules are instruction encodings which have a shorter or
+// faster alternative. The alternatives may affect the flags
+// differently, so they're offered as advice rather than applied.
+var peepholeRules = []struct {
+	code   []byte
+	advice string
+}{
+	{[]byte{0x3e, 0x00}, "ld a, 0 could be xor a, which is shorter and faster but changes the flags"},
+	{[]byte{0xc6, 0x01}, "add a, 1 could be inc a, which is shorter and faster but doesn't set the carry flag"},
+	{[]byte{0xc6, 0xff}, "add a, 255 could be dec a, which is shorter and faster but doesn't set the carry flag"},
+	{[]byte{0xd6, 0x01}, "sub 1 could be dec a, which is shorter and faster but doesn't set the carry flag"},
+	{[]byte{0xfe, 0x00}, "cp 0 could be or a, which is shorter and faster but resets N and sets P/V for parity rather than overflow"},
+	{[]byte{0xcb, 0x27}, "sla a could be add a, a, which is shorter and faster but sets H from bit 3 and P/V for overflow rather than parity"},
+}
+
+// peephole records advice about the given assembled instruction,
+// if there's a better alternative.
+func (asm *Assembler) peephole(pc int, code []byte) {
+	for _, r := range peepholeRules {
+		if bytes.Equal(code, r.code) {
+			asm.diagf("%04x: %s", pc, r.advice)
+		}
+	}
+}
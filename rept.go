@@ -0,0 +1,69 @@
+package z80asm
+
+import "strings"
+
+type commandRept struct{}
+
+// W for rept assembles the statements up to endr count times:
+// rept count[, var]. In the block, var is the number of the
+// repeat, starting from 0.
+func (commandRept) W(asm *Assembler) error {
+	args, err := asm.parseArgs(false)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return asm.scanErrorf("expected syntax: rept <count>, <var>, got: rept %v", args)
+	}
+	var v string
+	if len(args) == 2 {
+		id, ok := args[1].(exprIdent)
+		if !ok {
+			return asm.scanErrorf("rept variable should be a name, found %s", args[1])
+		}
+		v = id.id
+	}
+	body, err := asm.readBlock("rept", "rept", "endr")
+	if err != nil {
+		return err
+	}
+	asm.unresolved = false
+	count, ok, err := getIntValue(asm, args[0])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return asm.scanErrorf("rept count should be a number, found %s", args[0])
+	}
+	if asm.pass == 0 && asm.unresolved {
+		// Like org, the labels after this are provisional
+		// until the count is known.
+		asm.provisionalOrg = true
+		count = 0
+	}
+	if count < 0 || count > 65535 {
+		return asm.scanErrorf("rept count %d is not in the range 0...65535", count)
+	}
+	if asm.macroDepth >= maxMacroDepth {
+		return asm.scanErrorf("macros nested more than %d deep in rept", maxMacroDepth)
+	}
+	labels := macroLabels(body)
+	var sb strings.Builder
+	for i := int64(0); i < count; i++ {
+		subst := map[string]string{}
+		if v != "" {
+			subst[v] = exprInt{i}.String()
+		}
+		sb.WriteString(asm.expandBlock("rept", body, labels, subst))
+	}
+	asm.pushText("rept", sb.String())
+	return nil
+}
+
+type commandEndr struct{}
+
+// W for endr reports an error, since endr is read
+// as part of the rept block.
+func (commandEndr) W(asm *Assembler) error {
+	return asm.scanErrorf("endr without rept")
+}
@@ -0,0 +1,145 @@
+package z80asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+// spectrumControls are the ZX Spectrum's PRINT control codes that
+// can be written in dspec strings as \{NAME args}, with the number
+// of arguments each takes.
+var spectrumControls = map[string]struct {
+	code  byte
+	nargs int
+}{
+	"ENTER":   {0x0d, 0},
+	"INK":     {0x10, 1},
+	"PAPER":   {0x11, 1},
+	"FLASH":   {0x12, 1},
+	"BRIGHT":  {0x13, 1},
+	"INVERSE": {0x14, 1},
+	"OVER":    {0x15, 1},
+	"AT":      {0x16, 2},
+	"TAB":     {0x17, 1},
+}
+
+// spectrumControl returns the bytes for the inside of a \{...}
+// escape: a control code with its arguments, or a number.
+func spectrumControl(s string) ([]byte, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty escape \\{}")
+	}
+	var args []byte
+	for _, f := range fields[1:] {
+		n, err := strconv.ParseInt(f, 0, 64)
+		if err != nil || n < 0 || n > 255 {
+			return nil, fmt.Errorf("bad argument %q in \\{%s}", f, s)
+		}
+		args = append(args, byte(n))
+	}
+	name := strings.ToUpper(fields[0])
+	if n, err := strconv.ParseInt(name, 0, 64); err == nil && len(args) == 0 {
+		if n < 0 || n > 255 {
+			return nil, fmt.Errorf("\\{%s} is not in the range 0...255", s)
+		}
+		return []byte{byte(n)}, nil
+	}
+	c, ok := spectrumControls[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown control code \\{%s}", s)
+	}
+	if len(args) != c.nargs {
+		return nil, fmt.Errorf("%s takes %d arguments, found %d", name, c.nargs, len(args))
+	}
+	if name == "TAB" {
+		// The column is two bytes, but only the low one matters.
+		args = append(args, 0)
+	}
+	return append([]byte{c.code}, args...), nil
+}
+
+// spectrumString returns the bytes of a string token, decoding
+// \{...} escapes as Spectrum control codes. Other escapes in
+// double-quoted strings are as in Go.
+func spectrumString(tok token) ([]byte, error) {
+	s := tok.s[1 : len(tok.s)-1]
+	var r, seg []byte
+	flush := func() error {
+		if tok.t == scanner.String {
+			u, err := strconv.Unquote(`"` + string(seg) + `"`)
+			if err != nil {
+				return err
+			}
+			seg = []byte(u)
+		}
+		r = append(r, seg...)
+		seg = nil
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			seg = append(seg, s[i])
+			continue
+		}
+		if s[i+1] != '{' {
+			// Keep other escapes for Unquote, skipping the
+			// escaped character so \\{ isn't a control code.
+			seg = append(seg, s[i], s[i+1])
+			i++
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated escape %s", s[i:])
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		bs, err := spectrumControl(s[i+2 : i+end])
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, bs...)
+		i += end
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type commandDSpec struct{}
+
+// W for dspec writes strings, which may contain Spectrum
+// control codes as \{...} escapes: dspec "\{AT 1,2}hello".
+func (commandDSpec) W(asm *Assembler) error {
+	for {
+		tok, err := asm.nextToken()
+		if err != nil {
+			return err
+		}
+		if tok.t != scanner.String && tok.t != scanner.RawString {
+			return asm.scanErrorf("dspec expects strings, found %s", tok)
+		}
+		bs, err := spectrumString(tok)
+		if err != nil {
+			return asm.scanErrorf("bad string %s: %v", tok.s, err)
+		}
+		if err := asm.writeBytes(bs); err != nil {
+			return err
+		}
+		tok, err = asm.nextToken()
+		if err != nil {
+			return err
+		}
+		if endStatement(tok) {
+			return nil
+		}
+		if tok.t != ',' {
+			return asm.scanErrorf("unexpected %s after string", tok)
+		}
+	}
+}
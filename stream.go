@@ -0,0 +1,75 @@
+package z80asm
+
+import (
+	"fmt"
+	"io"
+)
+
+// streamBufSize is the most bytes a streamWriter
+// holds before writing them out.
+const streamBufSize = 4096
+
+// A streamWriter writes assembled bytes to an io.Writer as they're
+// produced. Offset 0 of the output is the first target written.
+// Contiguous runs of bytes are buffered. If the writer is also an
+// io.WriterAt, gaps and backward jumps in the target are handled by
+// writing at the right offset. Otherwise, forward gaps are
+// filled with zeros, and backward jumps are an error.
+type streamWriter struct {
+	w       io.Writer
+	started bool
+	base    int    // the target at offset 0
+	start   int    // the target of buf[0]
+	buf     []byte // bytes not yet written
+	written int    // the number of bytes written to a plain writer
+}
+
+func (s *streamWriter) writeByte(target int, u uint8) error {
+	if s.started && target == s.start+len(s.buf) {
+		s.buf = append(s.buf, u)
+		if len(s.buf) >= streamBufSize {
+			return s.flush()
+		}
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if !s.started {
+		s.started = true
+		s.base = target
+	}
+	s.start = target
+	s.buf = append(s.buf, u)
+	return nil
+}
+
+// flush writes out the buffered bytes.
+func (s *streamWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	off := s.start - s.base
+	if off < 0 {
+		return fmt.Errorf("can't stream output to %x, before the first byte written at %x", s.start, s.base)
+	}
+	if wa, ok := s.w.(io.WriterAt); ok {
+		if _, err := wa.WriteAt(s.buf, int64(off)); err != nil {
+			return fmt.Errorf("failed to write streamed output: %v", err)
+		}
+	} else {
+		if off < s.written {
+			return fmt.Errorf("can't stream output to %x: the output has already been written past it, and can't seek", s.start)
+		}
+		if _, err := s.w.Write(make([]byte, off-s.written)); err != nil {
+			return fmt.Errorf("failed to write streamed output: %v", err)
+		}
+		if _, err := s.w.Write(s.buf); err != nil {
+			return fmt.Errorf("failed to write streamed output: %v", err)
+		}
+		s.written = off + len(s.buf)
+	}
+	s.start += len(s.buf)
+	s.buf = s.buf[:0]
+	return nil
+}
@@ -0,0 +1,94 @@
+package z80asm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Symbol file formats for WriteSymbols.
+const (
+	// SymbolsMap is lines of the form "8000 label".
+	SymbolsMap = "map"
+	// SymbolsEqu is lines of the form "label: equ $8000".
+	SymbolsEqu = "equ"
+)
+
+// WriteSymbols writes the labels of the assembled code and their
+// addresses to w, in the given format (SymbolsMap or SymbolsEqu),
+// for loading into emulators and debuggers. Labels are sorted by
+// address, and minor labels have their full names, for example
+// "main.loop". It is only valid after the assembler has run.
+func WriteSymbols(w io.Writer, asm *Assembler, format string) error {
+	var line string
+	switch format {
+	case SymbolsMap:
+		line = "%04[2]x %[1]s\n"
+	case SymbolsEqu:
+		line = "%[1]s: equ $%04[2]x\n"
+	default:
+		return fmt.Errorf("unknown symbol file format %q", format)
+	}
+	syms := asm.SymbolTable()
+	var names []string
+	for name := range syms {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if syms[names[i]] != syms[names[j]] {
+			return syms[names[i]] < syms[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, line, name, syms[name]); err != nil {
+			return fmt.Errorf("failed to write symbols: %v", err)
+		}
+	}
+	return nil
+}
+
+// A LabelSize is the number of bytes written from a major
+// label up to the next major label.
+type LabelSize struct {
+	Name   string
+	Target int // where in memory the label is
+	Size   int
+}
+
+// SizeByLabel returns the number of bytes written from each major
+// label up to the next major label in memory, or to the end of the
+// written range for the last one, largest first. Bytes skipped
+// over, for example by org, aren't counted. When labels are at the
+// same location, the bytes count for the one defined last. Labels
+// local to a macro or rept expansion aren't major labels, so their
+// bytes count for the label before them.
+// It is only valid after the assembler has run.
+func (asm *Assembler) SizeByLabel() []LabelSize {
+	var sizes []LabelSize
+	for _, def := range asm.labelDefs {
+		if !strings.Contains(def.Name, ".") && !asm.localLabels[def.Name] {
+			sizes = append(sizes, LabelSize{Name: def.Name, Target: asm.labelTarget[def.Name]})
+		}
+	}
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].Target < sizes[j].Target
+	})
+	_, end := asm.WrittenRange()
+	for i := range sizes {
+		next := end
+		if i+1 < len(sizes) {
+			next = sizes[i+1].Target
+		}
+		for t := sizes[i].Target; t < next; t++ {
+			if asm.isWritten(t) {
+				sizes[i].Size++
+			}
+		}
+	}
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].Size > sizes[j].Size
+	})
+	return sizes
+}
@@ -44,7 +44,7 @@ func argType(a arg) argumentType {
 		return argTypeIndReg
 	case indIXplus, indIYplus:
 		return argTypeIndRegPlusInt
-	case const8, const16, const16be, constS8:
+	case const8, const16, const16be, const24, constU8, constS8:
 		return argTypeInt
 	case addr16:
 		return argTypeAddress
@@ -110,6 +110,8 @@ const (
 	const8
 	const16
 	const16be
+	const24 // only used for directives (eg: dt)
+	constU8 // only used for directives (eg: db!)
 	constS8
 	addr16 // TODO: use this consistently
 	reladdr8
@@ -175,6 +177,8 @@ var argMap = map[arg]string{
 	const8:    "*",
 	const16:   "**",
 	const16be: "**",
+	const24:   "***",
+	constU8:   "*",
 	constS8:   "*",
 	addr16:    "**",
 	reladdr8:  "*",
@@ -352,8 +356,8 @@ var commandsArgs = map[string]args{
 	"rr":   stdOpts(0, 0x18, 0xcb),
 	"sla":  stdOpts(0, 0x20, 0xcb),
 	"sra":  stdOpts(0, 0x28, 0xcb),
-	//"sll":  stdOpts(0, 0x30, 0xcb),
-	"srl": stdOpts(0, 0x38, 0xcb),
+	"sll":  stdOpts(0, 0x30, 0xcb), // undocumented
+	"srl":  stdOpts(0, 0x38, 0xcb),
 	"ld": joinOpts(
 		args{
 			arg2(regBC, const16): b(0x01),
@@ -533,6 +537,9 @@ var commandsArgs = map[string]args{
 		arg2(regE, portC): b(0xed, 0x58),
 		arg2(regL, portC): b(0xed, 0x68),
 		arg2(regA, portC): b(0xed, 0x78),
+		// Undocumented: the input only sets the flags. It can
+		// also be written "in f, (c)".
+		portC: b(0xed, 0x70),
 	},
 	"out": args{
 		arg2(port8, regA): b(0xd3),
@@ -543,6 +550,8 @@ var commandsArgs = map[string]args{
 		arg2(portC, regE): b(0xed, 0x59),
 		arg2(portC, regL): b(0xed, 0x69),
 		arg2(portC, regA): b(0xed, 0x79),
+		// Undocumented: outputs 0 (or 0xff on some CMOS z80s).
+		arg2(portC, val00h): b(0xed, 0x71),
 	},
 	"im": args{
 		val00h: b(0xed, 0x46),
@@ -610,14 +619,30 @@ var (
 		indHL: indIYplus,
 	}
 
+	// Undocumented: the prefixes also make h and l
+	// refer to the halves of ix and iy.
+	ixHalfMap = map[arg]arg{
+		regH: regIXH,
+		regL: regIXL,
+	}
+
+	iyHalfMap = map[arg]arg{
+		regH: regIYH,
+		regL: regIYL,
+	}
+
 	ixyExcludes = map[string]map[arg]bool{
 		"ex":  map[arg]bool{arg2(regDE, regHL): true},
 		"jp":  map[arg]bool{indHL: true},
 		"sll": map[arg]bool{indHL: true},
 	}
 
+	ixHalfCommands = replaceCommands(halfRegArgs(commandsArgs), ixHalfMap, 0xdd, nil)
+	iyHalfCommands = replaceCommands(halfRegArgs(commandsArgs), iyHalfMap, 0xfd, nil)
+
 	ixCommands = joinCommands(
 		replaceCommands(commandsArgs, ixMap, 0xdd, ixyExcludes),
+		ixHalfCommands,
 		map[string]args{
 			"jp": map[arg][]byte{
 				indIX: []byte{0xdd, 0xe9},
@@ -625,11 +650,23 @@ var (
 		})
 	iyCommands = joinCommands(
 		replaceCommands(commandsArgs, iyMap, 0xfd, ixyExcludes),
+		iyHalfCommands,
 		map[string]args{
 			"jp": map[arg][]byte{
 				indIY: []byte{0xfd, 0xe9},
 			},
 		})
+
+	// undocumented has the forms of instructions that aren't
+	// in Zilog's documentation, which strict mode rejects.
+	undocumented = joinCommands(
+		map[string]args{
+			"sll": commandsArgs["sll"],
+			"in":  args{portC: commandsArgs["in"][portC]},
+			"out": args{arg2(portC, val00h): commandsArgs["out"][arg2(portC, val00h)]},
+		},
+		ixHalfCommands,
+		iyHalfCommands)
 )
 
 func doRename(a arg, rename map[arg]arg) arg {
@@ -643,11 +680,37 @@ func doRename(a arg, rename map[arg]arg) arg {
 	return a0*1024 + a1
 }
 
+// halfRegArgs returns the variants of cmds that can use the
+// halves of ix and iy in place of h and l. Variants that also
+// use (hl) are dropped, since the prefix makes that (ix+d) and
+// leaves h and l alone, as are cb-prefixed instructions, whose
+// prefixed forms only use (ix+d).
+func halfRegArgs(cmds map[string]args) map[string]args {
+	result := map[string]args{}
+	for k, variants := range cmds {
+		for as, bs := range variants {
+			if as/1024 == indHL || as%1024 == indHL || bs[0] == 0xcb {
+				continue
+			}
+			if result[k] == nil {
+				result[k] = args{}
+			}
+			result[k][as] = bs
+		}
+	}
+	return result
+}
+
+// replaceCommands returns the prefixed variants of cmds whose
+// arguments are changed by rename. Variants whose arguments are
+// unchanged are dropped, since the prefix would have no effect.
+// So are ED-prefixed instructions (eg: adc hl, bc), since the
+// cpu ignores a dd or fd prefix before them.
 func replaceCommands(cmds map[string]args, rename map[arg]arg, prefix byte, exclude map[string]map[arg]bool) map[string]args {
 	result := map[string]args{}
 	for k, variants := range cmds {
 		for as, bs := range variants {
-			if exclude[k][as] {
+			if exclude[k][as] || bs[0] == 0xed {
 				continue
 			}
 			rnas := doRename(as, rename)
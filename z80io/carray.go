@@ -0,0 +1,68 @@
+package z80io
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// cIdentOK reports whether name is a valid C identifier.
+func cIdentOK(name string) bool {
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// cLenMacro is the name of the macro giving the length of the
+// array called name.
+func cLenMacro(name string) string {
+	return strings.ToUpper(name) + "_LEN"
+}
+
+// WriteCArray writes C source that defines data as an array of
+// bytes called name, with a macro NAME_LEN (the name in upper
+// case) giving its length.
+func WriteCArray(w io.Writer, name string, data []byte) error {
+	if !cIdentOK(name) {
+		return fmt.Errorf("%q is not a valid C identifier", name)
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "/* Generated by z80asm. */\n\n")
+	fmt.Fprintf(bw, "#define %s %d\n\n", cLenMacro(name), len(data))
+	fmt.Fprintf(bw, "const unsigned char %s[%s] = {\n", name, cLenMacro(name))
+	for i := 0; i < len(data); i += 12 {
+		row := data[i:]
+		if len(row) > 12 {
+			row = row[:12]
+		}
+		var hex []string
+		for _, b := range row {
+			hex = append(hex, fmt.Sprintf("0x%02x", b))
+		}
+		fmt.Fprintf(bw, "\t%s,\n", strings.Join(hex, ", "))
+	}
+	fmt.Fprintf(bw, "};\n")
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write C array: %v", err)
+	}
+	return nil
+}
+
+// WriteCHeader writes a C header that declares the array written
+// by WriteCArray, for data of length n.
+func WriteCHeader(w io.Writer, name string, n int) error {
+	if !cIdentOK(name) {
+		return fmt.Errorf("%q is not a valid C identifier", name)
+	}
+	guard := strings.ToUpper(name) + "_H"
+	_, err := fmt.Fprintf(w, "/* Generated by z80asm. */\n\n#ifndef %s\n#define %s\n\n#define %s %d\n\nextern const unsigned char %s[%s];\n\n#endif\n",
+		guard, guard, cLenMacro(name), n, name, cLenMacro(name))
+	if err != nil {
+		return fmt.Errorf("failed to write C header: %v", err)
+	}
+	return nil
+}
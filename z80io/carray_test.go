@@ -0,0 +1,60 @@
+package z80io
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWriteCArray(t *testing.T) {
+	data := make([]byte, 30)
+	for i := range data {
+		data[i] = byte(i * 9)
+	}
+	var buf bytes.Buffer
+	if err := WriteCArray(&buf, "blob", data); err != nil {
+		t.Fatalf("WriteCArray failed: %v", err)
+	}
+	src := buf.String()
+	if !strings.Contains(src, "#define BLOB_LEN 30\n") {
+		t.Errorf("missing length macro:\n%s", src)
+	}
+
+	// The array is a comma-separated list of hex bytes in braces.
+	m := regexp.MustCompile(`const unsigned char blob\[BLOB_LEN\] = \{([^{}]*)\};\n$`).FindStringSubmatch(src)
+	if m == nil {
+		t.Fatalf("array declaration not found:\n%s", src)
+	}
+	var got []string
+	for _, v := range strings.Split(m[1], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			got = append(got, v)
+		}
+	}
+	if len(got) != len(data) {
+		t.Fatalf("array has %d elements, want %d:\n%s", len(got), len(data), src)
+	}
+	for i, v := range got {
+		if want := fmt.Sprintf("0x%02x", data[i]); v != want {
+			t.Errorf("element %d is %s, want %s", i, v, want)
+		}
+	}
+
+	if err := WriteCArray(&buf, "1blob", data); err == nil {
+		t.Errorf("WriteCArray with an invalid name succeeded, want error")
+	}
+}
+
+func TestWriteCHeader(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteCHeader(&buf, "blob", 30); err != nil {
+		t.Fatalf("WriteCHeader failed: %v", err)
+	}
+	for _, want := range []string{"#define BLOB_LEN 30\n", "extern const unsigned char blob[BLOB_LEN];\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("header doesn't contain %q:\n%s", want, buf.String())
+		}
+	}
+}
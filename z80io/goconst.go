@@ -0,0 +1,71 @@
+package z80io
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"sort"
+)
+
+// goIdent turns a label name into an exported Go identifier.
+// Characters that can't appear in identifiers (such as the dot in
+// minor labels like main.loop) are replaced with underscores, and
+// the first letter is capitalized. Names that don't start with a
+// letter are prefixed with L.
+func goIdent(name string) string {
+	r := []rune(name)
+	for i, c := range r {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			r[i] = '_'
+		}
+	}
+	switch {
+	case len(r) > 0 && r[0] >= 'a' && r[0] <= 'z':
+		r[0] += 'A' - 'a'
+	case len(r) == 0 || r[0] < 'A' || r[0] > 'Z':
+		r = append([]rune{'L'}, r...)
+	}
+	return string(r)
+}
+
+// WriteGoConstants writes a Go source file in package pkg that
+// defines a const for each of the given symbols. Symbol names
+// are turned into exported Go identifiers by replacing invalid
+// characters with underscores and capitalizing the first letter,
+// so main.loop becomes Main_loop.
+func WriteGoConstants(w io.Writer, pkg string, syms map[string]uint16) error {
+	if !token.IsIdentifier(pkg) {
+		return fmt.Errorf("%q is not a valid package name", pkg)
+	}
+	var names []string
+	for name := range syms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by z80asm. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	if len(names) > 0 {
+		fmt.Fprintf(&buf, "const (\n")
+		idents := map[string]string{}
+		for _, name := range names {
+			id := goIdent(name)
+			if prev, ok := idents[id]; ok {
+				return fmt.Errorf("labels %q and %q both become Go identifier %s", prev, name, id)
+			}
+			idents[id] = name
+			fmt.Fprintf(&buf, "\t%s = 0x%04x\n", id, syms[name])
+		}
+		fmt.Fprintf(&buf, ")\n")
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format Go constants: %v", err)
+	}
+	if _, err := w.Write(src); err != nil {
+		return fmt.Errorf("failed to write Go constants: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package z80io
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+func TestWriteGoConstants(t *testing.T) {
+	syms := map[string]uint16{
+		"main":      0x8000,
+		"main.loop": 0x8003,
+		"type":      0x9000,
+		"_start":    0x9001,
+	}
+	var buf bytes.Buffer
+	if err := WriteGoConstants(&buf, "labels", syms); err != nil {
+		t.Fatalf("WriteGoConstants failed: %v", err)
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "labels.go", buf.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("generated Go doesn't parse: %v\n%s", err, buf.String())
+	}
+	if f.Name.Name != "labels" {
+		t.Errorf("package %s, want labels", f.Name.Name)
+	}
+	got := map[string]string{}
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			got[vs.Names[0].Name] = vs.Values[0].(*ast.BasicLit).Value
+		}
+	}
+	want := map[string]string{
+		"Main":      "0x8000",
+		"Main_loop": "0x8003",
+		"Type":      "0x9000",
+		"L_start":   "0x9001",
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("const %s = %q, want %q\n%s", name, got[name], v, buf.String())
+		}
+	}
+
+	if err := WriteGoConstants(&buf, "labels", map[string]uint16{"a.b": 1, "A_b": 2}); err == nil {
+		t.Errorf("WriteGoConstants with clashing names succeeded, want error")
+	}
+}
@@ -0,0 +1,92 @@
+package z80io
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// ihexRecordLen is the most data bytes in an Intel HEX record.
+const ihexRecordLen = 16
+
+// Intel HEX record types.
+const (
+	ihexData = 0x00
+	ihexEOF  = 0x01
+)
+
+// WriteIHEX writes data, which is loaded at startAddr, to w in
+// Intel HEX format: data records of up to 16 bytes, followed by
+// an end of file record. gaps are ranges of addresses, each as
+// [start, end), that weren't written (for example, from
+// Assembler.Gaps). Their bytes aren't written, so runs of unused
+// memory don't take up space in the file. Other bytes are
+// written whatever their value, including zero, so with no gaps
+// every byte is written; Assembler.WriteIHEX finds the gaps from
+// what the assembler wrote.
+func WriteIHEX(w io.Writer, data []byte, startAddr uint16, gaps ...[2]int) error {
+	if int(startAddr)+len(data) > 0x10000 {
+		return fmt.Errorf("%d bytes at %04x don't fit in 64k", len(data), startAddr)
+	}
+	unused := make([]bool, len(data))
+	for _, g := range gaps {
+		for a := g[0]; a < g[1]; a++ {
+			if i := a - int(startAddr); i >= 0 && i < len(data) {
+				unused[i] = true
+			}
+		}
+	}
+	bw := bufio.NewWriter(w)
+	for i := 0; i < len(data); {
+		if unused[i] {
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(data) && end-i < ihexRecordLen && !unused[end] {
+			end++
+		}
+		writeIHEXRecord(bw, int(startAddr)+i, ihexData, data[i:end])
+		i = end
+	}
+	writeIHEXRecord(bw, 0, ihexEOF, nil)
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write Intel HEX: %v", err)
+	}
+	return nil
+}
+
+// writeIHEXRecord writes a record of the given type. The
+// checksum makes the sum of the record's bytes zero.
+func writeIHEXRecord(w *bufio.Writer, addr int, typ byte, data []byte) {
+	rec := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), typ}, data...)
+	var sum byte
+	for _, b := range rec {
+		sum += b
+	}
+	rec = append(rec, -sum)
+	fmt.Fprintf(w, ":%X\n", rec)
+}
+
+// SaveIHEX writes data, which is loaded at startAddr, to the
+// named file. The documentation for WriteIHEX contains more
+// information.
+func SaveIHEX(filename string, data []byte, startAddr uint16, gaps ...[2]int) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+
+	if err = WriteIHEX(f, data, startAddr, gaps...); err != nil {
+		if cerr := f.Close(); cerr != nil {
+			log.Printf("Error closing file during failed write: %v", cerr)
+		}
+		return fmt.Errorf("failed to write Intel HEX file %q: %v", filename, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to close Intel HEX file %q: %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package z80io
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestWriteIHEX(t *testing.T) {
+	ihex := func(data []byte, addr uint16, gaps ...[2]int) string {
+		var buf bytes.Buffer
+		if err := WriteIHEX(&buf, data, addr, gaps...); err != nil {
+			t.Fatalf("WriteIHEX failed: %v", err)
+		}
+		return buf.String()
+	}
+
+	// The gaps around the data aren't written.
+	data := make([]byte, 0x100)
+	copy(data[0x30:], []byte{0x02, 0x33, 0x7a})
+	if got, want := ihex(data, 0, [2]int{0, 0x30}, [2]int{0x33, 0x100}), ":0300300002337A1E\n:00000001FF\n"; got != want {
+		t.Errorf("WriteIHEX gave %q, want %q", got, want)
+	}
+
+	// Zero bytes that aren't in a gap, such as a nop at the
+	// end of a record, are written.
+	data = make([]byte, 0x12)
+	data[0x10] = 0xc9
+	want := ":109000000000000000000000000000000000000060\n:02901000C90095\n:00000001FF\n"
+	if got := ihex(data, 0x9000); got != want {
+		t.Errorf("WriteIHEX gave %q, want %q", got, want)
+	}
+
+	// Long runs are split into records of 16 bytes.
+	data = make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	lines := strings.Split(strings.TrimSuffix(ihex(data, 0x8000), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("WriteIHEX gave %d records, want 4:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	var got []byte
+	for i, line := range lines {
+		rec, err := hex.DecodeString(strings.TrimPrefix(line, ":"))
+		if err != nil || len(rec) < 5 || int(rec[0]) != len(rec)-5 {
+			t.Fatalf("record %d is malformed: %q", i, line)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			t.Errorf("record %d has a bad checksum: %q", i, line)
+		}
+		if i < 3 {
+			if addr := int(rec[1])<<8 | int(rec[2]); addr != 0x8000+len(got) {
+				t.Errorf("record %d is at %04x, want %04x", i, addr, 0x8000+len(got))
+			}
+			got = append(got, rec[4:len(rec)-1]...)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("records contain % x, want % x", got, data)
+	}
+	if lines[3] != ":00000001FF" {
+		t.Errorf("last record is %q, want the end of file record", lines[3])
+	}
+
+	if err := WriteIHEX(&bytes.Buffer{}, data, 0xfff0); err == nil {
+		t.Errorf("WriteIHEX of data past 64k succeeded")
+	}
+}
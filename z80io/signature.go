@@ -0,0 +1,34 @@
+package z80io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SignatureMagic is the start of every signature record.
+const SignatureMagic = "Z80ASIG1"
+
+// WriteSignature writes a record that identifies the version of
+// the assembler, and when the output was built. The record is
+// SignatureMagic, a length byte followed by the version string,
+// and the build time in seconds since the unix epoch as an 8-byte
+// little-endian number. It's meant to follow a raw binary: formats
+// whose size has a meaning, such as .sna, can't be signed.
+func WriteSignature(w io.Writer, version string) error {
+	if len(version) > 255 {
+		return fmt.Errorf("version %q is too long for a signature", version)
+	}
+	var buf []byte
+	buf = append(buf, SignatureMagic...)
+	buf = append(buf, byte(len(version)))
+	buf = append(buf, version...)
+	var t [8]byte
+	binary.LittleEndian.PutUint64(t[:], uint64(time.Now().Unix()))
+	buf = append(buf, t[:]...)
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write signature: %v", err)
+	}
+	return nil
+}
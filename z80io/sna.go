@@ -1,5 +1,7 @@
 // Package z80io can write z80 binary images.
-// Currently, ZX Spectrum .sna files are supported.
+// Currently, ZX Spectrum .sna, .z80 and .tap files, and Intel HEX
+// files, are supported. Signature records identifying the assembler,
+// and labels as Go consts, can also be written.
 package z80io
 
 import (
@@ -10,7 +12,7 @@ import (
 )
 
 // A SNAMachine describes the machine state
-// of a 48k ZX Spectrum. Except for the ROM.
+// of a 48k or 128K ZX Spectrum. Except for the ROM.
 type SNAMachine struct {
 	AF, BC, DE, HL, IX, IY uint16
 	AF2, BC2, DE2, HL2     uint16
@@ -22,8 +24,21 @@ type SNAMachine struct {
 	IntMode                uint8 // 0, 1 or 2.
 	BorderColor            uint8 // 0 to 7.
 	RAM                    []uint8
+
+	// Banks, if set, are the eight 16k RAM banks of a 128K
+	// Spectrum, and a 128K snapshot is written. RAM is
+	// not used.
+	Banks [][]uint8
+	// Port7FFD is the last value written to the 128K's paging
+	// port. Bits 0-2 are the bank paged in at 0xc000.
+	Port7FFD uint8
+	// TRDOS is set if the TR-DOS ROM is paged in.
+	TRDOS bool
 }
 
+// snaBankSize is the size of a 128K RAM bank.
+const snaBankSize = 16384
+
 // NewSNAMachine returns a newly initialised SNAMachine.
 func NewSNAMachine(RAM []uint8) (*SNAMachine, error) {
 	return &SNAMachine{
@@ -70,17 +85,31 @@ func pushpc(m *SNAMachine) func() {
 
 // WriteSNA writes the given machine as a SNA file.
 // The writer is flushed before returning.
-// The SNA format involves pushing PC onto the stack.
+// The 48k SNA format involves pushing PC onto the stack.
 // Thus the written SP, and the two bytes of RAM before
 // the given SP will not be the same as in the machine
 // image.
 // The SNAMachine is modified during saving, but it restored
 // before the function returns.
+// If m has Banks, a 128K SNA file is written instead: the
+// 48k of memory is banks 5, 2 and the paged bank, followed
+// by PC, the paging port, the TR-DOS flag and the other banks.
 func WriteSNA(f *bufio.Writer, m *SNAMachine) error {
 	var writeErr error
 
-	undo := pushpc(m)
-	defer undo()
+	if m.Banks != nil {
+		if len(m.Banks) != 8 {
+			return fmt.Errorf("128K snapshot has %d RAM banks, want 8", len(m.Banks))
+		}
+		for i, b := range m.Banks {
+			if len(b) != snaBankSize {
+				return fmt.Errorf("128K RAM bank %d is %d bytes, want %d", i, len(b), snaBankSize)
+			}
+		}
+	} else {
+		undo := pushpc(m)
+		defer undo()
+	}
 
 	// write byte
 	wb := func(b uint8) {
@@ -114,13 +143,37 @@ func WriteSNA(f *bufio.Writer, m *SNAMachine) error {
 		return fmt.Errorf("failed to write header: %v", writeErr)
 	}
 
-	for i := 0; i < 16384; i++ {
-		if m.RAM[i] != 0 {
-			return fmt.Errorf("Non-zero ROM byte %02x found at address %04x", m.RAM[i], i)
+	if m.Banks != nil {
+		paged := int(m.Port7FFD & 7)
+		for _, b := range []int{5, 2, paged} {
+			for _, u := range m.Banks[b] {
+				wb(u)
+			}
+		}
+		ww(m.PC)
+		wb(m.Port7FFD)
+		var trdos uint8
+		if m.TRDOS {
+			trdos = 1
+		}
+		wb(trdos)
+		for b := 0; b < 8; b++ {
+			if b == 5 || b == 2 || b == paged {
+				continue
+			}
+			for _, u := range m.Banks[b] {
+				wb(u)
+			}
+		}
+	} else {
+		for i := 0; i < 16384; i++ {
+			if m.RAM[i] != 0 {
+				return fmt.Errorf("Non-zero ROM byte %02x found at address %04x", m.RAM[i], i)
+			}
+		}
+		for i := 16384; i < 65536; i++ {
+			wb(m.RAM[i])
 		}
-	}
-	for i := 16384; i < 65536; i++ {
-		wb(m.RAM[i])
 	}
 	if writeErr != nil {
 		return fmt.Errorf("failed to write memory: %v", writeErr)
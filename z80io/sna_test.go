@@ -0,0 +1,77 @@
+package z80io
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestWriteSNA(t *testing.T) {
+	sna := func(m *SNAMachine) []byte {
+		var buf bytes.Buffer
+		if err := WriteSNA(bufio.NewWriter(&buf), m); err != nil {
+			t.Fatalf("WriteSNA failed: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	// A 48k snapshot has PC pushed on the stack.
+	ram := make([]byte, 65536)
+	ram[0x8000] = 0xc9
+	m := &SNAMachine{SP: 0xff00, PC: 0x8000, I: 0x3f, RAM: ram}
+	got := sna(m)
+	if len(got) != 27+49152 {
+		t.Fatalf("48k snapshot is %d bytes, want %d", len(got), 27+49152)
+	}
+	if got[0] != 0x3f || got[23] != 0xfe || got[24] != 0xfe {
+		t.Errorf("48k header is % x, want I=3f and SP=fefe", got[:27])
+	}
+	if got[27+0xfefe-0x4000] != 0x00 || got[27+0xfeff-0x4000] != 0x80 || got[27+0x4000] != 0xc9 {
+		t.Errorf("48k snapshot doesn't have the code and PC on the stack")
+	}
+	if m.SP != 0xff00 || ram[0xfeff] != 0 {
+		t.Errorf("WriteSNA didn't restore the machine")
+	}
+
+	// A 128K snapshot has banks 5, 2 and the paged bank, then
+	// PC, the paging port, TR-DOS flag, and the other banks.
+	for _, tc := range []struct {
+		port  uint8
+		order []byte
+	}{
+		{0x13, []byte{5, 2, 3, 0, 1, 4, 6, 7}},
+		{0x10, []byte{5, 2, 0, 1, 3, 4, 6, 7}},
+		{0x15, []byte{5, 2, 5, 0, 1, 3, 4, 6, 7}},
+	} {
+		banks := make([][]uint8, 8)
+		for i := range banks {
+			banks[i] = bytes.Repeat([]byte{byte(i)}, 16384)
+		}
+		m := &SNAMachine{SP: 0xff00, PC: 0x8000, Banks: banks, Port7FFD: tc.port}
+		got := sna(m)
+		if want := 27 + 4 + len(tc.order)*16384; len(got) != want {
+			t.Fatalf("port %02x: 128K snapshot is %d bytes, want %d", tc.port, len(got), want)
+		}
+		if got[23] != 0x00 || got[24] != 0xff {
+			t.Errorf("port %02x: 128K header has SP %02x%02x, want ff00", tc.port, got[24], got[23])
+		}
+		if tail := got[27+49152 : 27+49152+4]; !bytes.Equal(tail, []byte{0x00, 0x80, tc.port, 0}) {
+			t.Errorf("port %02x: 128K extra header is % x", tc.port, tail)
+		}
+		var order []byte
+		for off := 27; off < len(got); off += 16384 {
+			if off == 27+49152 {
+				off += 4
+			}
+			order = append(order, got[off])
+		}
+		if !bytes.Equal(order, tc.order) {
+			t.Errorf("port %02x: banks written in order %v, want %v", tc.port, order, tc.order)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSNA(bufio.NewWriter(&buf), &SNAMachine{Banks: make([][]uint8, 3)}); err == nil {
+		t.Errorf("WriteSNA with 3 banks succeeded")
+	}
+}
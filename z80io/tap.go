@@ -0,0 +1,159 @@
+package z80io
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// TAPLoaderOptions describes the BASIC loader program
+// that loads and runs the code in a .tap file.
+type TAPLoaderOptions struct {
+	// ClearAddr, if non-zero, is the address passed to CLEAR
+	// before the code is loaded.
+	ClearAddr uint16
+	// LineNumber is the line number of the loader. If zero,
+	// line 10 is used.
+	LineNumber uint16
+	// AutoStart makes the loader run as soon as it's loaded.
+	AutoStart bool
+	// ExecAddr, if non-zero, is the address the loader calls
+	// once the code is loaded. Otherwise, it's the load address.
+	ExecAddr uint16
+}
+
+// BASIC tokens used by the loader.
+const (
+	tokUSR       = 0xc0
+	tokCODE      = 0xaf
+	tokLOAD      = 0xef
+	tokRANDOMIZE = 0xf9
+	tokCLEAR     = 0xfd
+
+	basicNumber = 0x0e // introduces the 5-byte form of a number
+	basicEOL    = 0x0d
+)
+
+// Flag bytes and header types of .tap blocks.
+const (
+	tapFlagHeader = 0x00
+	tapFlagData   = 0xff
+
+	tapProgram = 0
+	tapCode    = 3
+
+	tapNameLen = 10
+)
+
+func (o TAPLoaderOptions) lineNumber() uint16 {
+	if o.LineNumber == 0 {
+		return 10
+	}
+	return o.LineNumber
+}
+
+// autoStartLine returns the autostart line for the BASIC header,
+// which is 32768 or more if the program shouldn't autostart.
+func (o TAPLoaderOptions) autoStartLine() uint16 {
+	if !o.AutoStart {
+		return 0x8000
+	}
+	return o.lineNumber()
+}
+
+// basicNum returns the tokenized form of n: its digits,
+// followed by its value in the 5-byte small integer form.
+func basicNum(n uint16) []byte {
+	r := []byte(strconv.Itoa(int(n)))
+	return append(r, basicNumber, 0, 0, byte(n), byte(n>>8), 0)
+}
+
+// basicProgram returns the tokenized BASIC loader:
+//
+//	CLEAR clearAddr: LOAD "" CODE : RANDOMIZE USR usrAddr
+//
+// on a single line.
+func (o TAPLoaderOptions) basicProgram(usrAddr uint16) ([]byte, error) {
+	line := o.lineNumber()
+	if line > 9999 {
+		return nil, fmt.Errorf("BASIC line number %d is out of range 1...9999", line)
+	}
+	var body []byte
+	if o.ClearAddr != 0 {
+		body = append(body, tokCLEAR)
+		body = append(body, basicNum(o.ClearAddr)...)
+		body = append(body, ':')
+	}
+	body = append(body, tokLOAD, '"', '"', tokCODE, ':')
+	body = append(body, tokRANDOMIZE, tokUSR)
+	body = append(body, basicNum(usrAddr)...)
+	body = append(body, basicEOL)
+
+	// Line numbers are big-endian, unlike line lengths.
+	r := []byte{byte(line >> 8), byte(line), byte(len(body)), byte(len(body) >> 8)}
+	return append(r, body...), nil
+}
+
+// WriteTAP writes a .tap file to w that loads data at loadAddr and
+// runs it from there. The tape has a BASIC loader, which runs as
+// soon as it's loaded, followed by the code. name is the name of
+// both on the tape, and is padded with spaces to 10 characters.
+func WriteTAP(w io.Writer, data []byte, loadAddr uint16, name string) error {
+	return TAPLoaderOptions{AutoStart: true}.WriteTAP(w, data, loadAddr, name)
+}
+
+// WriteTAP is like the function WriteTAP, but the BASIC loader
+// is described by o.
+func (o TAPLoaderOptions) WriteTAP(w io.Writer, data []byte, loadAddr uint16, name string) error {
+	if len(name) > tapNameLen {
+		return fmt.Errorf("tape name %q is longer than %d characters", name, tapNameLen)
+	}
+	if int(loadAddr)+len(data) > 0x10000 {
+		return fmt.Errorf("%d bytes at %04x don't fit in 64k", len(data), loadAddr)
+	}
+	// The block's length includes its flag and checksum.
+	if len(data)+2 > 0xffff {
+		return fmt.Errorf("%d bytes are too many for a tape block", len(data))
+	}
+	exec := o.ExecAddr
+	if exec == 0 {
+		exec = loadAddr
+	}
+	prog, err := o.basicProgram(exec)
+	if err != nil {
+		return err
+	}
+	var tap []byte
+	tap = append(tap, tapHeader(tapProgram, name, len(prog), o.autoStartLine(), uint16(len(prog)))...)
+	tap = append(tap, tapBlock(tapFlagData, prog)...)
+	tap = append(tap, tapHeader(tapCode, name, len(data), loadAddr, 0x8000)...)
+	tap = append(tap, tapBlock(tapFlagData, data)...)
+	if _, err := w.Write(tap); err != nil {
+		return fmt.Errorf("failed to write tap: %v", err)
+	}
+	return nil
+}
+
+// tapHeader returns a header block, which describes the
+// data block that follows it.
+func tapHeader(typ byte, name string, length int, param1, param2 uint16) []byte {
+	h := []byte{typ}
+	h = append(h, name...)
+	for len(h) < 1+tapNameLen {
+		h = append(h, ' ')
+	}
+	h = append(h, byte(length), byte(length>>8), byte(param1), byte(param1>>8), byte(param2), byte(param2>>8))
+	return tapBlock(tapFlagHeader, h)
+}
+
+// tapBlock returns a .tap block: its length, the flag byte, the
+// data, and a checksum which is the xor of the flag and the data.
+func tapBlock(flag byte, data []byte) []byte {
+	n := len(data) + 2
+	b := append([]byte{byte(n), byte(n >> 8), flag}, data...)
+	sum := flag
+	for _, d := range data {
+		sum ^= d
+	}
+	return append(b, sum)
+}
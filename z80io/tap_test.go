@@ -0,0 +1,206 @@
+package z80io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var tokenNames = map[byte]string{
+	tokUSR:       "USR",
+	tokCODE:      "CODE",
+	tokLOAD:      "LOAD",
+	tokRANDOMIZE: "RANDOMIZE",
+	tokCLEAR:     "CLEAR",
+}
+
+// decodeBASIC decodes a single line of tokenized BASIC, returning
+// the line number and the tokens. Numbers are returned as their
+// 5-byte form value, after checking it matches the digits.
+func decodeBASIC(t *testing.T, prog []byte) (int, []string) {
+	if len(prog) < 4 {
+		t.Fatalf("BASIC program too short: % x", prog)
+	}
+	line := int(binary.BigEndian.Uint16(prog))
+	n := int(binary.LittleEndian.Uint16(prog[2:]))
+	body := prog[4:]
+	if n != len(body) {
+		t.Fatalf("BASIC line length %d, but %d bytes follow", n, len(body))
+	}
+	if body[len(body)-1] != basicEOL {
+		t.Errorf("BASIC line doesn't end with %02x: % x", basicEOL, body)
+	}
+	var toks []string
+	for i := 0; i < len(body)-1; i++ {
+		c := body[i]
+		switch {
+		case tokenNames[c] != "":
+			toks = append(toks, tokenNames[c])
+		case c >= '0' && c <= '9':
+			j := i
+			for body[j] != basicNumber {
+				j++
+			}
+			num := body[j+1 : j+6]
+			v := int(binary.LittleEndian.Uint16(num[2:]))
+			if num[0] != 0 || num[1] != 0 || num[4] != 0 {
+				t.Errorf("number %s has bad 5-byte form % x", body[i:j], num)
+			}
+			if string(body[i:j]) != fmt.Sprint(v) {
+				t.Errorf("number %s has 5-byte value %d", body[i:j], v)
+			}
+			toks = append(toks, fmt.Sprint(v))
+			i = j + 5
+		default:
+			toks = append(toks, string(c))
+		}
+	}
+	return line, toks
+}
+
+func TestBASICLoader(t *testing.T) {
+	for _, tc := range []struct {
+		opts     TAPLoaderOptions
+		wantLine int
+		wantAuto uint16
+		want     []string
+	}{
+		{
+			opts:     TAPLoaderOptions{ClearAddr: 32767, LineNumber: 20, AutoStart: true},
+			wantLine: 20,
+			wantAuto: 20,
+			want:     []string{"CLEAR", "32767", ":", "LOAD", `"`, `"`, "CODE", ":", "RANDOMIZE", "USR", "32768"},
+		},
+		{
+			opts:     TAPLoaderOptions{},
+			wantLine: 10,
+			wantAuto: 0x8000,
+			want:     []string{"LOAD", `"`, `"`, "CODE", ":", "RANDOMIZE", "USR", "32768"},
+		},
+	} {
+		prog, err := tc.opts.basicProgram(32768)
+		if err != nil {
+			t.Fatalf("%+v: basicProgram failed: %v", tc.opts, err)
+		}
+		line, toks := decodeBASIC(t, prog)
+		if line != tc.wantLine || !reflect.DeepEqual(toks, tc.want) {
+			t.Errorf("%+v: got line %d %q, want line %d %q", tc.opts, line, toks, tc.wantLine, tc.want)
+		}
+		if got := tc.opts.autoStartLine(); got != tc.wantAuto {
+			t.Errorf("%+v: autostart line %d, want %d", tc.opts, got, tc.wantAuto)
+		}
+	}
+}
+
+// splitTAP splits a .tap file into its blocks, checking their
+// lengths and checksums, and returns each block's flag and data.
+func splitTAP(t *testing.T, tap []byte) (flags []byte, blocks [][]byte) {
+	for len(tap) > 0 {
+		if len(tap) < 2 {
+			t.Fatalf("tap has a truncated block length: % x", tap)
+		}
+		n := int(binary.LittleEndian.Uint16(tap))
+		if n < 2 || len(tap) < 2+n {
+			t.Fatalf("tap block of length %d doesn't fit in % x", n, tap)
+		}
+		block := tap[2 : 2+n]
+		var sum byte
+		for _, b := range block {
+			sum ^= b
+		}
+		if sum != 0 {
+			t.Errorf("tap block % x has a bad checksum", block)
+		}
+		flags = append(flags, block[0])
+		blocks = append(blocks, block[1:n-1])
+		tap = tap[2+n:]
+	}
+	return flags, blocks
+}
+
+func TestTAPLoaderWriteTAP(t *testing.T) {
+	data := []byte{0x3e, 0x01, 0xc9}
+	opts := TAPLoaderOptions{ClearAddr: 32767, AutoStart: true}
+	var buf bytes.Buffer
+	if err := opts.WriteTAP(&buf, data, 0x8000, "demo"); err != nil {
+		t.Fatalf("WriteTAP failed: %v", err)
+	}
+	flags, blocks := splitTAP(t, buf.Bytes())
+	if want := []byte{0x00, 0xff, 0x00, 0xff}; !bytes.Equal(flags, want) {
+		t.Fatalf("tap blocks have flags % x, want % x", flags, want)
+	}
+	if got := binary.LittleEndian.Uint16(blocks[0][13:]); got != 10 {
+		t.Errorf("program header autostarts at line %d, want 10", got)
+	}
+	line, toks := decodeBASIC(t, blocks[1])
+	if want := []string{"CLEAR", "32767", ":", "LOAD", `"`, `"`, "CODE", ":", "RANDOMIZE", "USR", "32768"}; line != 10 || !reflect.DeepEqual(toks, want) {
+		t.Errorf("loader is line %d %q, want line 10 %q", line, toks, want)
+	}
+	if got := binary.LittleEndian.Uint16(blocks[2][13:]); got != 0x8000 {
+		t.Errorf("code header loads at %04x, want 8000", got)
+	}
+	if !bytes.Equal(blocks[3], data) {
+		t.Errorf("code block is % x, want % x", blocks[3], data)
+	}
+
+	if err := opts.WriteTAP(&buf, data, 0x8000, "much too long"); err == nil {
+		t.Errorf("WriteTAP with a long name succeeded")
+	}
+}
+
+func TestWriteTAP(t *testing.T) {
+	data := []byte{0x3e, 0x01, 0xc9}
+	var buf bytes.Buffer
+	if err := WriteTAP(&buf, data, 0x8000, "demo"); err != nil {
+		t.Fatalf("WriteTAP failed: %v", err)
+	}
+	flags, blocks := splitTAP(t, buf.Bytes())
+	if want := []byte{0x00, 0xff, 0x00, 0xff}; !bytes.Equal(flags, want) {
+		t.Fatalf("tap blocks have flags % x, want % x", flags, want)
+	}
+
+	prog := blocks[1]
+	header := blocks[0]
+	word := func(h []byte, off int) uint16 { return binary.LittleEndian.Uint16(h[off:]) }
+	if header[0] != tapProgram || string(header[1:11]) != "demo      " {
+		t.Errorf("program header is % x, want a program called %q", header, "demo      ")
+	}
+	if int(word(header, 11)) != len(prog) || word(header, 13) != 10 || int(word(header, 15)) != len(prog) {
+		t.Errorf("program header % x doesn't match the %d byte program autostarting at line 10", header, len(prog))
+	}
+	line, toks := decodeBASIC(t, prog)
+	if want := []string{"LOAD", `"`, `"`, "CODE", ":", "RANDOMIZE", "USR", "32768"}; line != 10 || !reflect.DeepEqual(toks, want) {
+		t.Errorf("loader is line %d %q, want line 10 %q", line, toks, want)
+	}
+
+	header = blocks[2]
+	if header[0] != tapCode || string(header[1:11]) != "demo      " {
+		t.Errorf("code header is % x, want code called %q", header, "demo      ")
+	}
+	if int(word(header, 11)) != len(data) || word(header, 13) != 0x8000 {
+		t.Errorf("code header % x doesn't match %d bytes at 8000", header, len(data))
+	}
+	if !bytes.Equal(blocks[3], data) {
+		t.Errorf("code block is % x, want % x", blocks[3], data)
+	}
+
+	// The loader can call an address other than the load address.
+	buf.Reset()
+	opts := TAPLoaderOptions{ExecAddr: 0x8002}
+	if err := opts.WriteTAP(&buf, data, 0x8000, "demo"); err != nil {
+		t.Fatalf("WriteTAP with options failed: %v", err)
+	}
+	_, blocks = splitTAP(t, buf.Bytes())
+	if _, toks := decodeBASIC(t, blocks[1]); toks[len(toks)-1] != "32770" {
+		t.Errorf("loader calls %s, want 32770", toks[len(toks)-1])
+	}
+
+	if err := WriteTAP(&buf, data, 0x8000, "much too long"); err == nil {
+		t.Errorf("WriteTAP with a long name succeeded")
+	}
+	if err := WriteTAP(&buf, data, 0xffff, "demo"); err == nil {
+		t.Errorf("WriteTAP with data past 64k succeeded")
+	}
+}
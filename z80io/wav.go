@@ -0,0 +1,125 @@
+package z80io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Tape pulse lengths, in T-states of the Spectrum's 3.5MHz clock.
+const (
+	tapeClock = 3500000
+
+	pilotPulse       = 2168
+	headerPilotCount = 8063 // pulses of pilot tone before a header block
+	dataPilotCount   = 3223 // pulses of pilot tone before a data block
+	sync1Pulse       = 667
+	sync2Pulse       = 735
+	zeroPulse        = 855 // a bit is two pulses of the same length
+	onePulse         = 1710
+	blockPause       = tapeClock // a second of silence after each block
+)
+
+// 8-bit PCM sample values for the two signal levels.
+const (
+	wavLow  = 0x40
+	wavHigh = 0xc0
+)
+
+// A tapeEncoder converts pulses into samples. It keeps track
+// of the total time in T-states so that rounding errors don't
+// accumulate over the length of the tape.
+type tapeEncoder struct {
+	sampleRate int
+	tstates    int64
+	high       bool
+	samples    []byte
+}
+
+// level writes samples at the current level for n T-states.
+func (e *tapeEncoder) level(n int) {
+	v := byte(wavLow)
+	if e.high {
+		v = wavHigh
+	}
+	e.tstates += int64(n)
+	end := int(e.tstates * int64(e.sampleRate) / tapeClock)
+	for len(e.samples) < end {
+		e.samples = append(e.samples, v)
+	}
+}
+
+// pulse writes a pulse of n T-states, flipping the level.
+func (e *tapeEncoder) pulse(n int) {
+	e.high = !e.high
+	e.level(n)
+}
+
+// block writes the pilot tone, sync pulses and data of a block,
+// followed by a pause. The first byte of the block is its flag,
+// which is less than 128 for headers.
+func (e *tapeEncoder) block(data []byte) {
+	pilots := dataPilotCount
+	if len(data) > 0 && data[0] < 128 {
+		pilots = headerPilotCount
+	}
+	for i := 0; i < pilots; i++ {
+		e.pulse(pilotPulse)
+	}
+	e.pulse(sync1Pulse)
+	e.pulse(sync2Pulse)
+	for _, b := range data {
+		for bit := 7; bit >= 0; bit-- {
+			n := zeroPulse
+			if b&(1<<uint(bit)) != 0 {
+				n = onePulse
+			}
+			e.pulse(n)
+			e.pulse(n)
+		}
+	}
+	e.high = false
+	e.level(blockPause)
+}
+
+// WriteWAV writes the blocks in the .tap file data tap as the
+// audio that a Spectrum loads them from: a mono 8-bit PCM .wav
+// file with the given sample rate.
+func WriteWAV(w io.Writer, tap []byte, sampleRate int) error {
+	if sampleRate <= 0 {
+		return fmt.Errorf("bad sample rate %d", sampleRate)
+	}
+	e := &tapeEncoder{sampleRate: sampleRate}
+	for len(tap) > 0 {
+		if len(tap) < 2 {
+			return fmt.Errorf("tap data has a truncated block length")
+		}
+		n := int(binary.LittleEndian.Uint16(tap))
+		if len(tap) < 2+n {
+			return fmt.Errorf("tap block of %d bytes is truncated to %d bytes", n, len(tap)-2)
+		}
+		e.block(tap[2 : 2+n])
+		tap = tap[2+n:]
+	}
+
+	var h [44]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+len(e.samples)))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16) // size of the fmt chunk
+	binary.LittleEndian.PutUint16(h[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(h[22:], 1)  // mono
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate)) // bytes per second
+	binary.LittleEndian.PutUint16(h[32:], 1)                  // bytes per sample
+	binary.LittleEndian.PutUint16(h[34:], 8)                  // bits per sample
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(len(e.samples)))
+	if _, err := w.Write(h[:]); err != nil {
+		return fmt.Errorf("failed to write wav: %v", err)
+	}
+	if _, err := w.Write(e.samples); err != nil {
+		return fmt.Errorf("failed to write wav: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package z80io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWriteWAV(t *testing.T) {
+	wav := func(tap []byte, rate int) []byte {
+		var buf bytes.Buffer
+		if err := WriteWAV(&buf, tap, rate); err != nil {
+			t.Fatalf("WriteWAV(% x) failed: %v", tap, err)
+		}
+		return buf.Bytes()
+	}
+
+	// With one sample per T-state, the number of samples is exact.
+	got := wav([]byte{2, 0, 0xff, 0x00}, tapeClock)
+	for _, f := range []struct {
+		off  int
+		want string
+	}{{0, "RIFF"}, {8, "WAVE"}, {12, "fmt "}, {36, "data"}} {
+		if s := string(got[f.off : f.off+4]); s != f.want {
+			t.Errorf("wav header at %d is %q, want %q", f.off, s, f.want)
+		}
+	}
+	u16 := func(off int) int { return int(binary.LittleEndian.Uint16(got[off:])) }
+	u32 := func(off int) int { return int(binary.LittleEndian.Uint32(got[off:])) }
+	if u16(20) != 1 || u16(22) != 1 || u32(24) != tapeClock || u16(34) != 8 {
+		t.Errorf("wav format is % x, want mono 8-bit PCM at %d", got[20:36], tapeClock)
+	}
+	want := dataPilotCount*pilotPulse + sync1Pulse + sync2Pulse + 8*2*onePulse + 8*2*zeroPulse + blockPause
+	if n := u32(40); n != want || len(got) != 44+want || u32(4) != 36+want {
+		t.Errorf("wav has %d samples (file size %d, riff size %d), want %d", n, len(got), u32(4), want)
+	}
+
+	// A one bit takes longer than a zero bit.
+	ones := wav([]byte{2, 0, 0xff, 0xff}, tapeClock)
+	if d := len(ones) - len(got); d != 8*2*(onePulse-zeroPulse) {
+		t.Errorf("byte 0xff gave %d more samples than 0x00, want %d", d, 8*2*(onePulse-zeroPulse))
+	}
+
+	// A header block has a longer pilot tone.
+	header := wav([]byte{2, 0, 0x00, 0xff}, tapeClock)
+	if d := len(header) - len(got); d != (headerPilotCount-dataPilotCount)*pilotPulse {
+		t.Errorf("header gave %d more samples than data, want %d", d, (headerPilotCount-dataPilotCount)*pilotPulse)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteWAV(&buf, []byte{3, 0, 0xff}, 44100); err == nil {
+		t.Errorf("WriteWAV succeeded with a truncated block")
+	}
+}
@@ -0,0 +1,90 @@
+package z80io
+
+import (
+	"fmt"
+	"io"
+)
+
+// z80HeaderLen is the size of the version 1 .z80 header.
+const z80HeaderLen = 30
+
+// WriteZ80 writes the given 48k machine as a version 1 .z80
+// snapshot: a 30-byte header of the registers, followed by
+// the memory from 0x4000 in compressed form. Unlike a .sna
+// file, PC is stored in the header, so m isn't modified.
+func WriteZ80(w io.Writer, m *SNAMachine) error {
+	if m.Banks != nil {
+		return fmt.Errorf("version 1 .z80 files can't hold a 128K machine")
+	}
+	for i := 0; i < 16384; i++ {
+		if m.RAM[i] != 0 {
+			return fmt.Errorf("Non-zero ROM byte %02x found at address %04x", m.RAM[i], i)
+		}
+	}
+
+	var h [z80HeaderLen]byte
+	le := func(off int, u uint16) {
+		h[off] = uint8(u)
+		h[off+1] = uint8(u >> 8)
+	}
+	h[0] = uint8(m.AF >> 8)
+	h[1] = uint8(m.AF)
+	le(2, m.BC)
+	le(4, m.HL)
+	le(6, m.PC)
+	le(8, m.SP)
+	h[10] = m.I
+	h[11] = m.R & 0x7f
+	// Bit 0 is bit 7 of R, bits 1-3 are the border color, and
+	// bit 5 says that the memory is compressed.
+	h[12] = m.R>>7 | (m.BorderColor&7)<<1 | 0x20
+	le(13, m.DE)
+	le(15, m.BC2)
+	le(17, m.DE2)
+	le(19, m.HL2)
+	h[21] = uint8(m.AF2 >> 8)
+	h[22] = uint8(m.AF2)
+	le(23, m.IY)
+	le(25, m.IX)
+	if m.IntEnabled {
+		h[27] = 1 // IFF1
+		h[28] = 1 // IFF2
+	}
+	h[29] = m.IntMode & 3
+
+	if _, err := w.Write(h[:]); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+	if _, err := w.Write(z80Compress(m.RAM[16384:65536])); err != nil {
+		return fmt.Errorf("failed to write memory: %v", err)
+	}
+	return nil
+}
+
+// z80Compress compresses data in the .z80 format: a run of
+// 5 or more equal bytes, or of 2 or more EDs, is written as
+// ED ED count byte. The byte after a single ED is never the
+// start of a run, so that it can't be read as ED ED. The data
+// is followed by the end marker 00 ED ED 00.
+func z80Compress(data []byte) []byte {
+	var r []byte
+	for i := 0; i < len(data); {
+		b := data[i]
+		n := 1
+		for i+n < len(data) && n < 255 && data[i+n] == b {
+			n++
+		}
+		if n >= 5 || (b == 0xed && n >= 2) {
+			r = append(r, 0xed, 0xed, byte(n), b)
+			i += n
+			continue
+		}
+		r = append(r, b)
+		i++
+		if b == 0xed && i < len(data) {
+			r = append(r, data[i])
+			i++
+		}
+	}
+	return append(r, 0x00, 0xed, 0xed, 0x00)
+}
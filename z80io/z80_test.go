@@ -0,0 +1,89 @@
+package z80io
+
+import (
+	"bytes"
+	"testing"
+)
+
+// z80Decompress decodes memory compressed in the .z80 format,
+// up to the end marker.
+func z80Decompress(t *testing.T, data []byte) []byte {
+	var r []byte
+	for i := 0; i < len(data); {
+		if bytes.HasPrefix(data[i:], []byte{0x00, 0xed, 0xed, 0x00}) && i+4 == len(data) {
+			return r
+		}
+		if i+3 < len(data) && data[i] == 0xed && data[i+1] == 0xed {
+			r = append(r, bytes.Repeat(data[i+3:i+4], int(data[i+2]))...)
+			i += 4
+			continue
+		}
+		r = append(r, data[i])
+		i++
+	}
+	t.Fatalf("compressed data % x has no end marker", data)
+	return nil
+}
+
+func TestZ80Compress(t *testing.T) {
+	for _, tc := range []struct {
+		data, want []byte
+	}{
+		{[]byte{1, 2, 2, 2, 2}, []byte{1, 2, 2, 2, 2}},
+		{[]byte{1, 2, 2, 2, 2, 2}, []byte{1, 0xed, 0xed, 5, 2}},
+		{[]byte{0xed, 0xed}, []byte{0xed, 0xed, 2, 0xed}},
+		{[]byte{0xed, 1}, []byte{0xed, 1}},
+		// The byte after a single ED isn't the start of a run.
+		{[]byte{0xed, 0, 0, 0, 0, 0, 0}, []byte{0xed, 0, 0xed, 0xed, 5, 0}},
+		{[]byte{0xed, 0xed, 0xed, 1}, []byte{0xed, 0xed, 3, 0xed, 1}},
+	} {
+		want := append(tc.want, 0x00, 0xed, 0xed, 0x00)
+		if got := z80Compress(tc.data); !bytes.Equal(got, want) {
+			t.Errorf("z80Compress(% x) = % x, want % x", tc.data, got, want)
+		}
+	}
+
+	// Long runs are split, and everything decompresses.
+	data := append(bytes.Repeat([]byte{7}, 600), 0xed, 0xed, 0xed)
+	data = append(data, bytes.Repeat([]byte{0xed}, 300)...)
+	data = append(data, 0xed, 3, 0xed, 0xed, 0xed, 0, 0xed)
+	if got := z80Decompress(t, z80Compress(data)); !bytes.Equal(got, data) {
+		t.Errorf("z80Compress doesn't round trip:\n% x\ngave\n% x", data, got)
+	}
+}
+
+func TestWriteZ80(t *testing.T) {
+	ram := make([]byte, 65536)
+	copy(ram[0x8000:], []byte{0x3e, 0xed, 0xc9})
+	m := &SNAMachine{
+		AF: 0x1234, BC: 0x5678, DE: 0x9abc, HL: 0xdef0,
+		AF2: 0x1122, BC2: 0x3344, DE2: 0x5566, HL2: 0x7788,
+		IX: 0x99aa, IY: 0xbbcc, SP: 0xff00, PC: 0x8000,
+		I: 0x3f, R: 0x85, IntEnabled: true, IntMode: 1, BorderColor: 5,
+		RAM: ram,
+	}
+	var buf bytes.Buffer
+	if err := WriteZ80(&buf, m); err != nil {
+		t.Fatalf("WriteZ80 failed: %v", err)
+	}
+	got := buf.Bytes()
+	want := []byte{
+		0x12, 0x34, 0x78, 0x56, 0xf0, 0xde, 0x00, 0x80, 0x00, 0xff,
+		0x3f, 0x05, 0x2b, 0xbc, 0x9a, 0x44, 0x33, 0x66, 0x55, 0x88,
+		0x77, 0x11, 0x22, 0xcc, 0xbb, 0xaa, 0x99, 0x01, 0x01, 0x01,
+	}
+	if !bytes.Equal(got[:z80HeaderLen], want) {
+		t.Errorf("header is % x, want % x", got[:z80HeaderLen], want)
+	}
+	if mem := z80Decompress(t, got[z80HeaderLen:]); !bytes.Equal(mem, ram[16384:]) {
+		t.Errorf("memory doesn't match the machine's RAM")
+	}
+	if m.SP != 0xff00 || ram[0xfeff] != 0 {
+		t.Errorf("WriteZ80 modified the machine")
+	}
+
+	ram[0] = 1
+	if err := WriteZ80(&buf, m); err == nil {
+		t.Errorf("WriteZ80 with a non-zero ROM succeeded")
+	}
+}
@@ -16,8 +16,16 @@ type Memory struct {
 	// Also, we set the write slot for a ROM bank to nil.
 	ReadSlots  [8][]byte
 	WriteSlots [8][]byte
+
+	// SlotBanks is the RAM bank in each read slot,
+	// or -1 if the slot is ROM.
+	SlotBanks [8]int
 }
 
+// defaultSlotBanks are the RAM banks paged into each 8k slot
+// when the machine starts. Slots 0 and 1 are ROM.
+var defaultSlotBanks = [8]int{-1, -1, 10, 11, 4, 5, 0, 1}
+
 func (mem *Memory) Bank(n int) []byte {
 	return mem.RAM[n*1024*8 : (n+1)*1024*8]
 }
@@ -28,7 +36,8 @@ func NewMemory(sizeKB int) (*Memory, error) {
 		return nil, fmt.Errorf("RAM must be a multiple of 8kb (got %dkb)", sizeKB)
 	}
 	mem := &Memory{
-		RAM: make([]byte, ramBytes),
+		RAM:       make([]byte, ramBytes),
+		SlotBanks: defaultSlotBanks,
 	}
 	mem.ReadSlots = [8][]byte{
 		0: mem.ROM[:1024*8],
@@ -51,6 +60,16 @@ func NewMemory(sizeKB int) (*Memory, error) {
 	return mem, nil
 }
 
+// Page7FFD pages memory as a write of b to the 128K paging port
+// 0x7ffd would: the 16k RAM bank given by the bottom 3 bits
+// of b is paged in at 0xc000.
+func (mem *Memory) Page7FFD(b byte) {
+	n := int(b&7) * 2
+	mem.ReadSlots[6], mem.ReadSlots[7] = mem.Bank(n), mem.Bank(n+1)
+	mem.WriteSlots[6], mem.WriteSlots[7] = mem.Bank(n), mem.Bank(n+1)
+	mem.SlotBanks[6], mem.SlotBanks[7] = n, n+1
+}
+
 func (mem *Memory) CopyBank(n int, bank *[1024 * 8]byte) error {
 	if n < 0 || n*1024*8 >= len(mem.RAM) {
 		return fmt.Errorf("bank %d out of range (want less than %d)", n, len(mem.RAM)/8/1024)
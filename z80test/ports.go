@@ -0,0 +1,32 @@
+package z80test
+
+// ports implements the machine's i/o ports.
+// Only the 128K memory paging port (0x7ffd) is supported,
+// and reads always return 0xff.
+type ports struct {
+	mem    *Memory
+	locked bool // paging was disabled by bit 5 of 0x7ffd
+}
+
+func (p *ports) ReadPort(address uint16) byte {
+	return 0xff
+}
+
+func (p *ports) WritePort(address uint16, b byte) {
+	// The 128K decodes 0x7ffd from A15 and A1 being low.
+	if address&0x8002 == 0 && !p.locked {
+		p.mem.Page7FFD(b)
+		p.locked = b&0x20 != 0
+	}
+}
+
+func (p *ports) ReadPortInternal(address uint16, contend bool) byte {
+	return p.ReadPort(address)
+}
+
+func (p *ports) WritePortInternal(address uint16, b byte, contend bool) {
+	p.WritePort(address, b)
+}
+
+func (p *ports) ContendPortPreio(address uint16)  {}
+func (p *ports) ContendPortPostio(address uint16) {}
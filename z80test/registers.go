@@ -1,5 +1,7 @@
 package z80test
 
+import "fmt"
+
 type Register16 struct {
 	value *uint16
 }
@@ -123,3 +125,25 @@ func (tc *NextMachine) D_() Register8 {
 func (tc *NextMachine) E_() Register8 {
 	return tc.DE_().Low()
 }
+
+// flagsString returns the flags in f as letters, from bit 7 down
+// to bit 0, with - for each flag that's clear: SZ5H3PNC.
+func flagsString(f uint8) string {
+	const letters = "SZ5H3PNC"
+	r := []byte(letters)
+	for i := range r {
+		if f&(0x80>>uint(i)) == 0 {
+			r[i] = '-'
+		}
+	}
+	return string(r)
+}
+
+// String returns the registers, decoded flags and interrupt
+// flip-flops on one line, for example in test failures.
+func (tc *NextMachine) String() string {
+	return fmt.Sprintf("A=%02x F=%s BC=%04x DE=%04x HL=%04x IX=%04x IY=%04x SP=%04x PC=%04x BC'=%04x DE'=%04x HL'=%04x IFF1=%d IFF2=%d",
+		tc.A().Get(), flagsString(tc.F().Get()), tc.BC().Get(), tc.DE().Get(), tc.HL().Get(),
+		tc.IX().Get(), tc.IY().Get(), tc.SP().Get(), tc.PC().Get(),
+		tc.BC_().Get(), tc.DE_().Get(), tc.HL_().Get(), boolToByte(tc.IFF1), boolToByte(tc.IFF2))
+}
@@ -124,7 +124,12 @@ func instrED__LDIX(z80 *Z80) {
 	notImplementedOpcode()
 }
 func instrED__LDWS(z80 *Z80) {
-	notImplementedOpcode()
+	// Copy (HL) to (DE), and step down a column: only L and D
+	// are incremented, without carrying into H or from E.
+	// The flags are set as for inc d.
+	z80.memory.WriteByte(z80.DE(), z80.memory.ReadByte(z80.HL()))
+	z80.L++
+	z80.incD()
 }
 func instrED__LDDX(z80 *Z80) {
 	notImplementedOpcode()
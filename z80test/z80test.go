@@ -3,6 +3,7 @@ package z80test
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/paulhankin/z80asm"
 	"github.com/paulhankin/z80asm/z80test/z80"
@@ -18,12 +19,45 @@ type NextMachine struct {
 	bc_, de_, hl_          uint16
 	pc, sp                 uint16
 
+	// IFF1 and IFF2 are the interrupt flip-flops. IFF1 says
+	// whether maskable interrupts are enabled, and IFF2 holds
+	// its value during a non-maskable interrupt, restored by
+	// retn and reti.
+	IFF1, IFF2 bool
+
+	// slotBanks are the RAM banks paged into each 8k slot
+	// when the call finished. If it's nil, they're the
+	// default banks.
+	slotBanks []int
+
 	// TODO: hardware registers, ports
 }
 
+// Flat64K returns the 64k of memory as the code sees it: each
+// 8k slot holds the RAM bank that's paged into it at the end
+// of the call, or the default bank if the machine hasn't been
+// called. The ROM slots read as zero.
+func (tc *NextMachine) Flat64K() [65536]byte {
+	var flat [65536]byte
+	banks := tc.slotBanks
+	if banks == nil {
+		banks = defaultSlotBanks[:]
+	}
+	for slot, b := range banks {
+		if b < 0 || (b+1)*8*1024 > len(tc.RAM) {
+			continue
+		}
+		copy(flat[slot*8*1024:(slot+1)*8*1024], tc.RAM[b*8*1024:(b+1)*8*1024])
+	}
+	return flat
+}
+
 type Config struct {
-	Core            z80asm.Z80Core
-	MaxInstructions int // Maximum number of instructions to execute.
+	Core z80asm.Z80Core
+	// MaxInstructions is the maximum number of instructions to
+	// execute. It must be positive: there's no unlimited setting,
+	// since code that never halts would hang the caller.
+	MaxInstructions int
 
 	// StackTop is the location of the stack.
 	// The value 0 means the stack grows backwards from the top of memory.
@@ -35,12 +69,26 @@ type Config struct {
 // the maximum number of instructions (as set in the config).
 type ErrorMaxInstructions struct {
 	MaxInstructions int
+
+	// PC is the program counter when execution stopped.
+	PC uint16
+	// RecentPCs are the addresses of the last few instructions
+	// executed, oldest first.
+	RecentPCs []uint16
 }
 
 func (emi ErrorMaxInstructions) Error() string {
-	return fmt.Sprintf("maximum number of instructions reached: %d", emi.MaxInstructions)
+	var pcs []string
+	for _, pc := range emi.RecentPCs {
+		pcs = append(pcs, fmt.Sprintf("%04x", pc))
+	}
+	return fmt.Sprintf("maximum number of instructions reached: %d (pc=%04x, recent pcs: %s)", emi.MaxInstructions, emi.PC, strings.Join(pcs, " "))
 }
 
+// numRecentPCs is how many instruction addresses are
+// reported in ErrorMaxInstructions.
+const numRecentPCs = 8
+
 // ErrorPanic is returned when the interpreter panics (for example, when
 // it executes an unknown instruction).
 type ErrorPanic struct {
@@ -60,6 +108,9 @@ func (ErrorHalt) Error() string {
 // Call calls the code at the given address (pushing a dummy PC return
 // address onto the stack first). It finishes naturally when the
 // corresponding `ret` is executed.
+// The code may page 16k RAM banks in at 0xc000 by writing to
+// port 0x7ffd, as on the 128K Spectrum. Note that the stack
+// is paged out too if it's above 0xc000.
 // The final machine state (whenever it's not nil) can be read from the
 // returned machine.
 func Call(c *Config, address uint16) (rm *NextMachine, re error) {
@@ -73,17 +124,20 @@ func Call(c *Config, address uint16) (rm *NextMachine, re error) {
 		}
 	}()
 
+	if c.MaxInstructions <= 0 {
+		return nil, fmt.Errorf("MaxInstructions is %d, but it must be positive", c.MaxInstructions)
+	}
+
 	nm := c.NextMachine
 
-	memory, err := NewMemory(2 * 1024 * 1024)
+	memory, err := NewMemory(2 * 1024)
 	if err != nil {
 		return nil, err
 	}
 	copy(memory.RAM, nm.RAM)
 
-	var ports z80.PortAccessor
 	var registers z80.NextRegisterAccessor
-	zm := z80.NewZ80(memory, ports, registers)
+	zm := z80.NewZ80(memory, &ports{mem: memory}, registers)
 
 	zm.A = nm.A().Get()
 	zm.F = nm.F().Get()
@@ -95,6 +149,7 @@ func Call(c *Config, address uint16) (rm *NextMachine, re error) {
 	zm.SetHL_(nm.HL_().Get())
 	zm.SetIX(nm.IX().Get())
 	zm.SetIY(nm.IY().Get())
+	zm.IFF1, zm.IFF2 = boolToByte(nm.IFF1), boolToByte(nm.IFF2)
 
 	halt := c.StackTop - 1
 	sp := c.StackTop - 3
@@ -108,7 +163,9 @@ func Call(c *Config, address uint16) (rm *NextMachine, re error) {
 	zm.SetPC(address)
 
 	instructionCount := 0
+	var recentPCs [numRecentPCs]uint16
 	for (instructionCount < c.MaxInstructions) && !zm.Halted {
+		recentPCs[instructionCount%numRecentPCs] = zm.PC()
 		zm.DoOpcode()
 		instructionCount++
 	}
@@ -127,11 +184,26 @@ func Call(c *Config, address uint16) (rm *NextMachine, re error) {
 		hl_: zm.HL_(),
 		pc:  zm.PC(),
 		sp:  zm.SP(),
+
+		IFF1: zm.IFF1 != 0,
+		IFF2: zm.IFF2 != 0,
+
+		slotBanks: append([]int{}, memory.SlotBanks[:]...),
 	}
 
 	if !zm.Halted {
 		if instructionCount >= c.MaxInstructions {
-			return fm, ErrorMaxInstructions{MaxInstructions: c.MaxInstructions}
+			var recent []uint16
+			for i := instructionCount - numRecentPCs; i < instructionCount; i++ {
+				if i >= 0 {
+					recent = append(recent, recentPCs[i%numRecentPCs])
+				}
+			}
+			return fm, ErrorMaxInstructions{
+				MaxInstructions: c.MaxInstructions,
+				PC:              zm.PC(),
+				RecentPCs:       recent,
+			}
 		}
 		panic("execution stopped without HALT or instruction limit reached")
 	}
@@ -140,3 +212,10 @@ func Call(c *Config, address uint16) (rm *NextMachine, re error) {
 	}
 	return fm, nil
 }
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,304 @@
+package z80test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulhankin/z80asm"
+)
+
+// flatToBanks converts 64k of flat memory into RAM banks,
+// using the default paging.
+func flatToBanks(flat []byte) []byte {
+	ram := make([]byte, 12*8*1024)
+	for slot := 2; slot < 8; slot++ {
+		b := defaultSlotBanks[slot]
+		copy(ram[b*8*1024:(b+1)*8*1024], flat[slot*8*1024:(slot+1)*8*1024])
+	}
+	return ram
+}
+
+// assemble assembles the given source, and returns the assembled RAM.
+// The RAM is laid out as Next RAM banks, and the first 64k can
+// also be treated as flat memory.
+func assemble(t *testing.T, core z80asm.Z80Core, src string) []byte {
+	dir, err := ioutil.TempDir("", "z80test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "a.asm")
+	if err := ioutil.WriteFile(name, []byte(src), 0666); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	asm, err := z80asm.NewAssembler(z80asm.UseNextCore(core))
+	if err != nil {
+		t.Fatalf("failed to create assembler: %v", err)
+	}
+	if err := asm.AssembleFile(name); err != nil {
+		t.Fatalf("failed to assemble %q: %v", src, err)
+	}
+	return asm.RAM()
+}
+
+// run assembles the given source at 0x8000, and calls it with
+// the machine state set up by init (if not nil).
+func run(t *testing.T, src string, init func(*NextMachine)) *NextMachine {
+	nm := &NextMachine{RAM: flatToBanks(assemble(t, z80asm.Z80CoreNext2, src))}
+	if init != nil {
+		init(nm)
+	}
+	cfg := &Config{
+		Core:            z80asm.Z80CoreNext2,
+		MaxInstructions: 1000,
+		NextMachine:     nm,
+	}
+	fm, err := Call(cfg, 0x8000)
+	if err != nil {
+		t.Fatalf("%q: call failed: %v", src, err)
+	}
+	return fm
+}
+
+const (
+	flagC = 0x01
+	flagN = 0x02
+	flagV = 0x04
+	flagH = 0x10
+	flagZ = 0x40
+	flagS = 0x80
+)
+
+func TestFlagInstructions(t *testing.T) {
+	testCases := []struct {
+		src       string
+		f         uint8 // initial flags
+		wantA     uint8
+		wantSet   uint8 // flags that must be set
+		wantClear uint8 // flags that must be clear
+	}{
+		{"ld a, 1; neg; ret", 0, 0xff, flagS | flagH | flagN | flagC, flagZ | flagV},
+		{"ld a, 0; neg; ret", 0, 0, flagZ | flagN, flagS | flagC | flagV | flagH},
+		{"ld a, 0x80; neg; ret", 0, 0x80, flagS | flagV | flagN | flagC, flagZ},
+		{"ld a, 0x5a; cpl; ret", 0, 0xa5, flagH | flagN, 0},
+		{"ld a, 0x5a; cpl; ret", flagC | flagZ, 0xa5, flagH | flagN | flagC | flagZ, 0},
+		{"ld a, 0x15; add a, 0x27; daa; ret", 0, 0x42, 0, flagC | flagN | flagZ},
+		{"ld a, 0x99; add a, 0x01; daa; ret", 0, 0x00, flagZ | flagC, flagN},
+		{"ld a, 0x42; sub 0x15; daa; ret", 0, 0x27, flagN, flagC | flagZ},
+		{"scf; ret", 0, 0, flagC, flagN | flagH},
+		{"scf; ccf; ret", 0, 0, flagH, flagC | flagN},
+		{"ccf; ret", 0, 0, flagC, flagN | flagH},
+		{"ccf; ret", flagC, 0, flagH, flagC | flagN},
+	}
+	for _, tc := range testCases {
+		f := tc.f
+		m := run(t, tc.src, func(nm *NextMachine) { nm.F().Set(int(f)) })
+		if got := m.A().Get(); got != tc.wantA {
+			t.Errorf("%q: A = 0x%02x, want 0x%02x", tc.src, got, tc.wantA)
+		}
+		got := m.F().Get()
+		if got&tc.wantSet != tc.wantSet || got&tc.wantClear != 0 {
+			t.Errorf("%q: F = %08b, want %08b set and %08b clear", tc.src, got, tc.wantSet, tc.wantClear)
+		}
+	}
+}
+
+func TestFlags16(t *testing.T) {
+	testCases := []struct {
+		src       string
+		hl, rr    uint16 // rr is bc for adc, and de for sbc
+		f         uint8  // initial flags
+		wantHL    uint16
+		wantSet   uint8 // flags that must be set
+		wantClear uint8 // flags that must be clear
+	}{
+		{"sbc hl, de; ret", 0x1000, 0x1000, 0, 0x0000, flagZ | flagN, flagC | flagS | flagV | flagH},
+		{"sbc hl, de; ret", 0x1000, 0x1000, flagC, 0xffff, flagC | flagS | flagN | flagH, flagZ | flagV},
+		{"sbc hl, de; ret", 0x0000, 0x0001, 0, 0xffff, flagC | flagS | flagN | flagH, flagZ | flagV},
+		{"sbc hl, de; ret", 0x8000, 0x0001, 0, 0x7fff, flagV | flagN | flagH, flagC | flagZ | flagS},
+		{"sbc hl, de; ret", 0x1234, 0x0034, flagC, 0x11ff, flagN, flagC | flagZ | flagS | flagV | flagH},
+		{"adc hl, bc; ret", 0xffff, 0x0001, 0, 0x0000, flagZ | flagC | flagH, flagS | flagV | flagN},
+		{"adc hl, bc; ret", 0x7fff, 0x0001, 0, 0x8000, flagS | flagV | flagH, flagC | flagZ | flagN},
+		{"adc hl, bc; ret", 0x0fff, 0x0000, flagC, 0x1000, flagH, flagC | flagZ | flagS | flagV | flagN},
+		{"adc hl, bc; ret", 0x1000, 0x2000, flagC, 0x3001, 0, flagC | flagZ | flagS | flagV | flagN | flagH},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		m := run(t, tc.src, func(nm *NextMachine) {
+			nm.hl, nm.bc, nm.de = tc.hl, tc.rr, tc.rr
+			nm.F().Set(int(tc.f))
+		})
+		if m.hl != tc.wantHL {
+			t.Errorf("%q with hl=%04x, rr=%04x, f=%08b: HL = %04x, want %04x", tc.src, tc.hl, tc.rr, tc.f, m.hl, tc.wantHL)
+		}
+		got := m.F().Get()
+		if got&tc.wantSet != tc.wantSet || got&tc.wantClear != 0 {
+			t.Errorf("%q with hl=%04x, rr=%04x, f=%08b: F = %08b, want %08b set and %08b clear", tc.src, tc.hl, tc.rr, tc.f, got, tc.wantSet, tc.wantClear)
+		}
+	}
+}
+
+func TestMaxInstructionsReportsPC(t *testing.T) {
+	src := "ld b, 0; nop; .loop inc a; jr loop"
+	nm := &NextMachine{RAM: flatToBanks(assemble(t, z80asm.Z80CoreNext2, src))}
+	cfg := &Config{
+		Core:            z80asm.Z80CoreNext2,
+		MaxInstructions: 100,
+		NextMachine:     nm,
+	}
+	_, err := Call(cfg, 0x8000)
+	emi, ok := err.(ErrorMaxInstructions)
+	if !ok {
+		t.Fatalf("got error %v, want ErrorMaxInstructions", err)
+	}
+	if emi.PC != 0x8003 && emi.PC != 0x8004 {
+		t.Errorf("got PC=%04x, want it in the loop at 8003..8004", emi.PC)
+	}
+	if len(emi.RecentPCs) != numRecentPCs {
+		t.Fatalf("got %d recent PCs, want %d", len(emi.RecentPCs), numRecentPCs)
+	}
+	for _, pc := range emi.RecentPCs {
+		if pc != 0x8003 && pc != 0x8004 {
+			t.Errorf("got recent PC %04x, want it in the loop", pc)
+		}
+	}
+	if !strings.Contains(err.Error(), "pc=8003") && !strings.Contains(err.Error(), "pc=8004") {
+		t.Errorf("error %q doesn't contain the loop's PC", err)
+	}
+}
+
+func TestPaging128(t *testing.T) {
+	src := `
+		org 0x8000
+		main:
+			ld bc, 0x7ffd
+			ld a, 3
+			out (c), a
+			call 0xc000
+			ld b, a
+			ld a, 0
+			out (c), a
+			ld a, b
+			ret
+
+		org 0xc000
+		bank 3
+			ld a, 42
+			ret
+	`
+	nm := &NextMachine{RAM: assemble(t, z80asm.Z80CoreStandard, src)}
+	cfg := &Config{
+		MaxInstructions: 1000,
+		StackTop:        0xc000,
+		NextMachine:     nm,
+	}
+	fm, err := Call(cfg, 0x8000)
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	if got := fm.A().Get(); got != 42 {
+		t.Errorf("got A=%d, want 42", got)
+	}
+}
+
+func TestFlat64K(t *testing.T) {
+	fm := run(t, "ld a, 42; ld (0xc000), a; ret", nil)
+	flat := fm.Flat64K()
+	if flat[0x8000] != 0x3e || flat[0xc000] != 42 {
+		t.Errorf("got flat[8000]=%02x, flat[c000]=%02x, want 3e, 2a", flat[0x8000], flat[0xc000])
+	}
+
+	// The flat view uses the banks that are paged in at the end.
+	src := "ld bc, 0x7ffd; ld a, 3; out (c), a; ld (0xc000), a; ret"
+	nm := &NextMachine{RAM: assemble(t, z80asm.Z80CoreStandard, src)}
+	cfg := &Config{
+		MaxInstructions: 1000,
+		StackTop:        0xc000,
+		NextMachine:     nm,
+	}
+	fm, err := Call(cfg, 0x8000)
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	flat = fm.Flat64K()
+	if got := flat[0xc000]; got != 3 {
+		t.Errorf("with bank 3 paged in, got flat[c000]=%02x, want 03", got)
+	}
+	if got := fm.RAM[6*8*1024]; got != 3 {
+		t.Errorf("got %02x at the start of bank 3, want 03", got)
+	}
+}
+
+func TestReturnFromInterrupt(t *testing.T) {
+	for _, tc := range []struct {
+		ret      string
+		wantIFF1 bool
+	}{
+		{"retn", true},
+		{"reti", true},
+		{"ret", false},
+	} {
+		// The state in an NMI handler, where the NMI arrived
+		// while interrupts were enabled: IFF1 is cleared, and
+		// IFF2 holds its old value.
+		src := "call handler; ret; handler: " + tc.ret
+		fm := run(t, src, func(nm *NextMachine) {
+			nm.IFF1, nm.IFF2 = false, true
+		})
+		if fm.IFF1 != tc.wantIFF1 || !fm.IFF2 {
+			t.Errorf("%s: IFF1, IFF2 = %v, %v, want %v, true", tc.ret, fm.IFF1, fm.IFF2, tc.wantIFF1)
+		}
+	}
+
+	// di clears both flip-flops, so retn leaves interrupts disabled.
+	fm := run(t, "di; call handler; ret; handler: retn", func(nm *NextMachine) {
+		nm.IFF1, nm.IFF2 = true, true
+	})
+	if fm.IFF1 || fm.IFF2 {
+		t.Errorf("di then retn: IFF1, IFF2 = %v, %v, want false, false", fm.IFF1, fm.IFF2)
+	}
+}
+
+func TestLDWS(t *testing.T) {
+	// The source byte is at 0x80ff so that incrementing L
+	// would carry into H if it were incrementing HL.
+	src := "ldws; ret; org 0x80ff; db 0x5a"
+	fm := run(t, src, func(nm *NextMachine) {
+		nm.hl = 0x80ff
+		nm.de = 0x90ff
+	})
+	const dest = 0x90ff
+	if got := fm.RAM[defaultSlotBanks[dest/0x2000]*0x2000+dest%0x2000]; got != 0x5a {
+		t.Errorf("ldws wrote %02x to (de), want 5a", got)
+	}
+	if fm.hl != 0x8000 || fm.de != 0x91ff {
+		t.Errorf("after ldws, hl=%04x de=%04x, want hl=8000 de=91ff", fm.hl, fm.de)
+	}
+}
+
+func TestNextMachineString(t *testing.T) {
+	fm := run(t, "ld a, 0x12; ld bc, 0x3456; scf; ret", func(nm *NextMachine) {
+		nm.F().Set(flagZ | flagS)
+	})
+	s := fm.String()
+	for _, want := range []string{"A=12 ", "F=SZ-----C ", "BC=3456 ", "IFF1=0"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String() = %q, want it to contain %q", s, want)
+		}
+	}
+}
+
+func TestMaxInstructionsZero(t *testing.T) {
+	nm := &NextMachine{RAM: flatToBanks(assemble(t, z80asm.Z80CoreNext2, "ret"))}
+	cfg := &Config{
+		Core:        z80asm.Z80CoreNext2,
+		NextMachine: nm,
+	}
+	_, err := Call(cfg, 0x8000)
+	if err == nil || !strings.Contains(err.Error(), "MaxInstructions is 0") {
+		t.Errorf("got error %v, want MaxInstructions error", err)
+	}
+}